@@ -7,13 +7,110 @@ that touch each other between a set of bodies.
 
 To launch the service:
 
-    % overlapservice [-proxy PROXYADDRESS (default "")] [-port WEBPORT (default 15123)] [-registry REGISTRYADDRESS (default "")]
+    % overlapservice [-proxy PROXYADDRESS (default "")] [-port WEBPORT (default 15123)] [-registry REGISTRYADDRESS (default "")] [-instance LABELINSTANCE (default "sp2body")] [-fetchers NUMFETCHERS (default 8)] [-dvid-timeout DURATION (default 2m)] [-dvid-retries NUMRETRIES (default 3)] [-deadline DURATION (default 10m)] [-source-dir DIRECTORY (default "")] [-volume PATH (default "")] [-volume-dims X,Y,Z] [-volume-type TYPE (default "uint64")] [-precomputed URL (default "")] [-precomputed-scale SCALE (default 0)] [-cache-spans NUMSPANS (default 16777216)] [-disk-cache FILE (default "")] [-cache-results] [-admin-auth HEADER (default $ADMIN_AUTHORIZATION)] [-mutation-poll DURATION (default 30s)] [-mutation-auth HEADER (default $MUTATION_AUTHORIZATION)] [-dvid-ca CAFILE (default "")] [-dvid-auth HEADER (default $DVID_AUTHORIZATION)] [-forward-auth] [-dvid-allow SERVERS (default "")] [-backends FILE (default "")] [-dvid-location ADDR (default "")] [-srv-domain DOMAIN (default "")] [-discovery-file FILE (default "")] [-discovery-ttl DURATION (default 30s)] [-job-workers NUMJOBS (default 2)] [-job-queue NUMJOBS (default 100)] [-job-deadline DURATION (default none)] [-job-store FILE (default "")] [-job-expiry DURATION (default 24h)]
 
 This will start a web server at the given port on the current
 machine (ADDR).  Optional: The registry address specifies the serviceproxy registry location
 (e.g., "127.0.0.1:7946" if serviceproxy was launched at this address).  The proxy
 address is the location of the serviceproxy http server (e.g. "127.0.0.1:15333" if
 serviceproxy web server was launched at this address).
+Without serviceproxy, DVID can instead be located with -dvid-location ADDR (a fixed server),
+-srv-domain DOMAIN (the DNS SRV record _dvid._tcp.DOMAIN), or -discovery-file FILE (a JSON file
+such as {"dvid": ["emdata1:8000"]} that is reread when it changes).  The service adds its address to
+the discovery file under "calcoverlap" at startup and removes it on shutdown.  With -registry the
+service instead registers with the serviceproxy registry (however DVID is located).  Its serf agent
+cannot leave the registry, which drops the service once the agent stops responding after shutdown.
+Discovered locations are reused for -discovery-ttl.
+The instance is the DVID label instance queried for sparse volumes when a request
+does not provide "label-instance".  labelvol, labelarray, and labelmap instances are queried
+directly and labelblk instances are queried through their synced labelvol instance.
+The number of fetchers limits how many bodies are fetched from DVID at once for each request.
+Each request to DVID is limited by -dvid-timeout and is retried with exponential backoff
+(-dvid-retries times) after connection errors or 5xx responses.  The -deadline limits the total
+time spent fetching data for a service call.  Bodies that still cannot be fetched are listed
+in "failed-bodies" in the response.  The results are computed from the remaining bodies.
+If -source-dir is given, the bodies are read from DVID-format sparse volume files stored as
+DIRECTORY/UUID/BODYID.sparsevol instead of from DVID (only full resolution bodies without
+supervoxels or ROIs are available in this case, and the UUID must be hexadecimal).
+If -volume is given, the bodies are read from a dense label volume on local disk instead: a .npy
+array, a multi-page uncompressed .tif stack (one page per z-slice), an N5 or zarr dataset directory
+(raw, gzip, or zlib chunks), or otherwise a raw file of little-endian labels with x varying fastest
+(-volume-dims and -volume-type give its size and label type).  The volume is read one slice at a
+time and all of the requested bodies are encoded in a single pass.  The uuid is ignored.
+Similarly, -precomputed reads a neuroglancer precomputed segmentation from a local directory or
+file:// URL (raw or compressed_segmentation chunks, optionally gzipped, but not sharded) at the
+scale given by -precomputed-scale.  Body coordinates include the voxel_offset of the volume.  A
+scale other than 0 must be downsampled by the same integer factor along each axis (from the
+resolution of each scale) and the results are rescaled to full resolution units.
+
+Bodies fetched from DVID are kept in a least recently used cache keyed by the DVID server, uuid,
+label instance, query (resolution, bounds, and supervoxels), and body id.  The cache holds up to
+-cache-spans spans (16 bytes each) and -1 disables it.  Since bodies at an unlocked uuid can change,
+disable the cache when querying nodes that are still being edited.  The hit and miss counts and the
+size of the cache are available at /cache.
+
+Locked DVID nodes never change, so with -disk-cache the bodies fetched from them are also kept in
+an embedded database that survives restarts (DVID is asked whether a node is locked the first time
+it is queried).  With -cache-results the overlap and stats results for locked nodes are stored as
+well (unless some bodies could not be fetched).  GET /diskcache reports the contents of the disk
+cache and DELETE /diskcache purges it (use /diskcache/UUID to inspect or purge a single node).  A purge
+must carry the -admin-auth value as its Authorization header and is refused if it is not set.
+
+Bodies cached from unlocked nodes go stale as they are merged, split, or cleaved.  The mutations
+of each unlocked node with cached bodies are polled from its labelmap instance every
+-mutation-poll and the affected bodies (and stored results naming them) are evicted.  A node is no
+longer polled (and its cached bodies are evicted) once none of its bodies have been requested for
+an hour.  Mutation records can also be pushed to /mutations (or /mutations/UUID) as a single
+record or a list of records with the -mutation-auth value as their Authorization header (pushes
+are refused if it is not set).
+Only the records added to a node's mutation log since its last poll are decoded.  A warning is
+printed at startup if polling is disabled (-mutation-poll -1s) since cached bodies of unlocked
+nodes then go stale unless mutations are pushed.
+
+The DVID server may be given with an https:// (or http://) prefix; http:// is assumed otherwise.
+The -dvid-ca file holds the PEM certificates trusted for https servers in place of the system roots.
+The -dvid-auth value (e.g., "Bearer TOKEN") is sent as the Authorization header of the DVID requests
+to the backends, aliases, -dvid-allow servers, and discovered server (never to other servers named
+by callers).  With -forward-auth the caller's Authorization header is sent instead, and a request
+can also give its own header in "authorization".  Cached bodies and results are only shared by
+callers whose requests use the same Authorization header.
+
+Since "dvid-server" is given by the caller, only the servers listed in -dvid-allow (e.g.,
+"emdata1:8000,https://emdata2.example.org"), the servers of the backends, and the discovered server
+may be named so that the service cannot be used to reach other hosts.  An entry NAME=URL defines an
+alias that requests can give as "dvid-server" (e.g., "prod").  Requests for any other server are
+rejected with 403 and logged.  The entry * allows any server (a warning is printed at startup).
+
+Several DVID servers can be configured as named backends with -backends FILE, a JSON list such as
+
+    [{"name": "prod", "servers": ["https://emdata1:8000", "https://emdata1-replica:8000"], "uuids": ["28841", "a3f2"]},
+     {"name": "dev", "servers": ["emdata2:8000"]}]
+
+A request can name its backend in "backend" (in place of "dvid-server").  Otherwise a request without
+"dvid-server" goes to the first backend with a prefix of its uuid, or to the first backend without uuid
+prefixes, before the proxy is consulted.  When a server fails (a connection error, timeout, or 5xx
+response) the request fails over to the next server of the backend without retrying, and the failed
+server is tried last for the next 30 seconds.  Each server has an equal share of the time left
+before the -deadline, and only the last server is retried.  The servers of the backends are always
+allowed.
+
+Large requests can run in the background instead of inside the http call.  POST the same request
+to /jobs (with "service" set to "overlap" or "bodystats"; overlap if not given) to get a job id
+(202 Accepted).  GET /jobs/ID reports the status (queued, running, done, failed, or canceled) and
+the number of bodies fetched so far, GET /jobs/ID/result returns the response once the job is done,
+and DELETE /jobs/ID cancels the job (or deletes a finished job).  GET /jobs lists the caller's jobs.
+Calls to /jobs must send an Authorization header (401 otherwise) and a job is only visible to callers
+with the same header as its submission (others get 404).  Requests are validated when they are
+submitted, so an invalid request is rejected with 400 instead of queued.  -job-workers jobs run at
+once and up to -job-queue jobs can wait; further jobs are rejected with 503.  The DVID requests of a
+job are limited by -job-deadline in place of -deadline (no limit by default).
+
+With -job-store the jobs are kept in an embedded database.  Jobs that were waiting or running when
+the service stopped (or crashed) run again after a restart with the -dvid-auth header, except
+that jobs submitted with the caller's own Authorization header fail (503) since the callers'
+credentials are not stored.  Finished jobs and their results are kept for -job-expiry.
+On SIGTERM or Ctrl-C the service deregisters, waits up to 30 seconds for the service calls in
+progress, and interrupts the running jobs (which are queued again) before it exits.
 
 The simplest way to use the server is navigate to "http://ADDR" and submit the provided form.
 A DVID server location, UUID from DVID, and a set of body IDs must be provided.  Optionally, one can post
@@ -27,6 +124,46 @@ a JSON directly to the service at URI /service.  Below is a sample JSON:
 
 After posting this data, overlap (in terms of the number of touching voxel faces) will be returned
 for each pair).  Pairs without overlap will not be returned.
+Body ids can be any unsigned 64-bit integer and the volume and surface area counts are
+also 64-bit.
+
+Optionally, an "roi" field can name a DVID roi instance.  Each body is clipped to the ROI
+and the overlap (or body stats) within the ROI is returned in "roi-overlap-list" (or
+"roi-body-stats") alongside the full results.  The surface area within the ROI only counts
+faces on the surface of the whole body, not the faces where the ROI boundary cuts through it.
+
+A list of ROIs can be given in "rois" to break the results down by ROI in one pass over
+the bodies.  The response will contain "overlap-by-roi" (or "body-stats-by-roi") mapping each
+ROI name to its results.  Each voxel is assigned to the first ROI that contains it, and the
+contact between two bodies is assigned to the ROI of the voxel in the body with the smaller id.
+
+The bodies can be restricted to a bounding box with the optional "minx", "maxx", "miny", "maxy",
+"minz", and "maxz" fields (inclusive voxel coordinates).  The bounds are passed to DVID so
+only the needed part of each sparse volume is fetched.
+
+For faster (approximate) results, the bodies can be fetched at lower resolution.  Setting "scale"
+fetches a downsampled level from a labelmap instance and setting "coarse" fetches the blocks
+intersecting each body with sparsevol-coarse ("block-size" gives the block size, default 32, at
+most 1024).  The results are rescaled to full resolution units.  For overlap, "two-stage" first
+fetches every body at coarse resolution and then only fetches the bodies that touch another body
+at the requested resolution.  ROIs can only be used at full resolution.
+
+For labelmap instances, setting "supervoxels" computes the results at the supervoxel level.
+Each body is expanded into its supervoxels, and the supervoxel results are aggregated
+to the bodies.  The overlap response also contains "supervoxel-overlap-list", which gives the
+supervoxel pairs carrying each contact as [body 1, body 2, supervoxel 1, supervoxel 2, overlap].
+The stats response also contains "supervoxel-stats" as [body, supervoxel, volume, surface area].
+
+A "mapping" from body id to a new body id (e.g., {"100": 140}) can be given to preview how
+the results would change after merges that are not in DVID.  Bodies mapped to the same id are
+merged before computing, and the results are reported with the new ids.
+
+Bodies that are not in DVID (e.g., candidate segmentations) can be uploaded with the request.
+Either give "rles" mapping each body id to its list of [x, y, z, length] spans, or post a
+multipart form with the JSON in a part named "request" and a DVID-format sparse volume in a
+part named by each body id.  The "uuid" and "bodies" default to the uploaded bodies.
+The spans of a body may not overlap, and requests are limited to 1 GiB (which also bounds the
+spans decoded from the uploaded sparse volumes).
 
 For more details, the rest interface specification is in RAML (http://raml.org) format.
 To view the interface, navigate to "http://ADDR/interface".
@@ -0,0 +1,176 @@
+package overlap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// dvidAllowlist holds the DVID servers that requests may name as "scheme://host" or "host" (any scheme)
+var dvidAllowlist []string
+
+// dvidAliases maps a short name (e.g., "prod") to the URL of a DVID server
+var dvidAliases map[string]string
+
+// allowAnyServer lets requests name any DVID server (the allowlist is "*")
+var allowAnyServer bool
+
+// discoveredServers are the DVID servers located by the discovery (trusted with the configured Authorization
+// header)
+var (
+	discoveredMutex   sync.Mutex
+	discoveredServers = make(map[string]bool)
+)
+
+// forbiddenServerError reports a DVID server that is not in the allowlist
+type forbiddenServerError struct {
+	server string
+}
+
+func (e *forbiddenServerError) Error() string {
+	return fmt.Sprintf("DVID server %s is not allowed", e.server)
+}
+
+// remoteAddrKey is the context key for the address of the caller of a service call
+type remoteAddrKey struct{}
+
+// setAllowlist configures the allowed servers from entries that are either a server or alias=URL
+// (aliases are always allowed, and "*" allows any server)
+func setAllowlist(entries []string) {
+	dvidAllowlist = nil
+	dvidAliases = make(map[string]string)
+	allowAnyServer = false
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			allowAnyServer = true
+			continue
+		}
+		if pos := strings.Index(entry, "="); pos > 0 {
+			dvidAliases[entry[:pos]] = serverURL(entry[pos+1:])
+			continue
+		}
+		if !strings.Contains(entry, "://") {
+			dvidAllowlist = append(dvidAllowlist, strings.TrimRight(entry, "/"))
+		} else {
+			dvidAllowlist = append(dvidAllowlist, serverURL(entry))
+		}
+	}
+}
+
+// resolveServer converts the "dvid-server" of a request to a URL, replacing an alias by its URL and
+// rejecting servers that are not allowed (the servers of the backends and the discovered server are
+// allowed as well, and any server is allowed only if the allowlist is "*")
+func resolveServer(name string) (string, error) {
+	if target, found := dvidAliases[name]; found {
+		return target, nil
+	}
+	server := serverURL(name)
+	if allowAnyServer {
+		return server, nil
+	}
+
+	// only a bare scheme and host can match so that user info or paths cannot redirect the requests
+	parsed, err := url.Parse(server)
+	if err != nil || parsed.Host == "" || parsed.User != nil || parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", &forbiddenServerError{name}
+	}
+	if isAllowed(parsed) || isAliasTarget(server) || isBackendServer(server) || isDiscoveredServer(server) {
+		return server, nil
+	}
+	return "", &forbiddenServerError{name}
+}
+
+// isAllowed checks whether the host of the URL is in the allowlist
+func isAllowed(parsed *url.URL) bool {
+	for _, allowed := range dvidAllowlist {
+		if allowed == parsed.Host || allowed == parsed.Scheme+"://"+parsed.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// isAliasTarget checks whether the URL is the server of an alias
+func isAliasTarget(server string) bool {
+	for _, target := range dvidAliases {
+		if target == server {
+			return true
+		}
+	}
+	return false
+}
+
+// addDiscoveredServer remembers a server located by the discovery
+func addDiscoveredServer(server string) {
+	discoveredMutex.Lock()
+	defer discoveredMutex.Unlock()
+	discoveredServers[server] = true
+}
+
+// isDiscoveredServer checks whether the URL is the server currently located by the discovery
+func isDiscoveredServer(server string) bool {
+	if discovery == nil {
+		return false
+	}
+	location, err := discovery.Lookup(dvidService)
+	if err != nil || serverURL(location) != server {
+		return false
+	}
+	addDiscoveredServer(server)
+	return true
+}
+
+// warnOpenServers reports at startup how requests naming a "dvid-server" are restricted
+func warnOpenServers() {
+	if allowAnyServer {
+		fmt.Printf("Warning: requests may name any DVID server (-dvid-allow includes *)\n")
+	} else if len(dvidAllowlist) == 0 && len(dvidAliases) == 0 && len(dvidBackends) == 0 && discovery == nil {
+		fmt.Printf("Warning: no DVID servers are allowed, configured as backends, or discovered, so requests naming a DVID server are rejected\n")
+	}
+}
+
+// trustedServer checks whether a DVID URL is on a server of the backends, aliases, or allowlist or on a
+// discovered server (servers that callers name are not trusted otherwise)
+func trustedServer(rawurl string) bool {
+	parsed, err := url.Parse(rawurl)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	server := parsed.Scheme + "://" + parsed.Host
+	if isAllowed(parsed) || isAliasTarget(server) || isBackendServer(server) {
+		return true
+	}
+
+	discoveredMutex.Lock()
+	defer discoveredMutex.Unlock()
+	return discoveredServers[server]
+}
+
+// dvidServerError keeps a rejected server or unknown backend error and otherwise reports that the server
+// could not be located
+func dvidServerError(err error) error {
+	switch err.(type) {
+	case *forbiddenServerError, *unknownBackendError:
+		return err
+	}
+	return fmt.Errorf("DVID server could not be located: %v", err)
+}
+
+// serverError writes the response for a DVID server that could not be used (403 for servers that are
+// not allowed, which are logged along with the caller)
+func serverError(ctx context.Context, w http.ResponseWriter, err error) {
+	if forbidden, found := err.(*forbiddenServerError); found {
+		caller, _ := ctx.Value(remoteAddrKey{}).(string)
+		fmt.Printf("Rejected request from %s for DVID server %q\n", caller, forbidden.server)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	badRequest(w, err.Error())
+}
@@ -0,0 +1,78 @@
+package overlap
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// useDiscovery sets the discovery until the test ends
+func useDiscovery(t *testing.T, replacement Discovery) {
+	saved := discovery
+	discovery = replacement
+	t.Cleanup(func() { discovery = saved })
+}
+
+func TestAllowlist(t *testing.T) {
+	defer setAllowlist(nil)
+	setAllowlist([]string{"emdata1:8000", "https://secure:443/", " ", "prod=https://prod.org/"})
+
+	allowed := map[string]string{
+		"prod":                 "https://prod.org",
+		"emdata1:8000":         "http://emdata1:8000",
+		"https://emdata1:8000": "https://emdata1:8000",
+		"https://secure:443":   "https://secure:443",
+		"https://prod.org":     "https://prod.org",
+	}
+	for name, expected := range allowed {
+		if server, err := resolveServer(name); err != nil || server != expected {
+			t.Fatalf("Server %s resolved to %s (%v) instead of %s", name, server, err, expected)
+		}
+	}
+
+	// only a bare scheme and host can match an entry
+	rejected := []string{"http://secure:443", "evil:80", "emdata1:8000/path", "user@emdata1:8000", "http://emdata1:8000?x", "169.254.169.254"}
+	for _, name := range rejected {
+		if server, err := resolveServer(name); err == nil {
+			t.Fatalf("Server %s was allowed as %s", name, server)
+		}
+	}
+
+}
+
+func TestAllowlistDefaults(t *testing.T) {
+	defer setAllowlist(nil)
+
+	// no server is allowed without an allowlist
+	setAllowlist(nil)
+	if _, err := resolveServer("evil:80"); err == nil {
+		t.Fatalf("Server was allowed without an allowlist")
+	}
+	setAllowlist([]string{"*"})
+	if server, err := resolveServer("evil:80"); err != nil || server != "http://evil:80" {
+		t.Fatalf("Server was not allowed by * (%s, %v)", server, err)
+	}
+
+	// the discovered server is allowed and trusted
+	setAllowlist(nil)
+	useDiscovery(t, NewStaticDiscovery(map[string]string{dvidService: "found:8000"}))
+	if trustedServer("http://found:8000/api") {
+		t.Fatalf("Server was trusted before it was discovered")
+	}
+	if server, err := resolveServer("found:8000"); err != nil || server != "http://found:8000" {
+		t.Fatalf("Discovered server was not allowed (%s, %v)", server, err)
+	}
+	if !trustedServer("http://found:8000/api") || trustedServer("http://other:8000/api") {
+		t.Fatalf("Only the discovered server should be trusted")
+	}
+}
+
+func TestRejectedServer(t *testing.T) {
+	defer setAllowlist(nil)
+	setAllowlist([]string{"emdata1:8000"})
+
+	status, body := callHandler(overlapPath, `{"dvid-server":"evil:80","uuid":"abc","bodies":[1,2]}`)
+	if status != http.StatusForbidden || !strings.Contains(body, "evil:80") {
+		t.Fatalf("Request for a server that is not allowed returned %d %q", status, body)
+	}
+}
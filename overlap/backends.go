@@ -0,0 +1,168 @@
+package overlap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendCooldown is the time a server that failed is tried after the other servers of its backend
+const backendCooldown = 30 * time.Second
+
+// backend is a named DVID server with its read replicas
+type backend struct {
+	name string
+	// URLs of the primary server followed by its replicas
+	servers []string
+	// uuid prefixes of the nodes routed to the backend (none for the default backend)
+	uuids []string
+}
+
+// backendConfig is the description of a backend in the backends file
+type backendConfig struct {
+	Name    string   `json:"name"`
+	Servers []string `json:"servers"`
+	UUIDs   []string `json:"uuids"`
+}
+
+// unknownBackendError reports a backend that is not configured
+type unknownBackendError struct {
+	name string
+}
+
+func (e *unknownBackendError) Error() string {
+	return fmt.Sprintf("DVID backend %s is not configured", e.name)
+}
+
+// dvidBackends are the configured backends (in the order of the backends file)
+var dvidBackends []*backend
+
+// serverHealth remembers the servers that recently failed so that their replicas are tried first
+type serverHealth struct {
+	mutex     sync.Mutex
+	downUntil map[string]time.Time
+}
+
+// health tracks the servers of all backends
+var health = &serverHealth{downUntil: make(map[string]time.Time)}
+
+// loadBackends reads the backends from a JSON file holding a list of {"name", "servers", "uuids"}
+func loadBackends(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var configs []backendConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("Backends in %s could not be decoded: %v", filename, err)
+	}
+
+	var backends []*backend
+	names := make(map[string]bool)
+	for _, config := range configs {
+		if config.Name == "" || names[config.Name] {
+			return fmt.Errorf("Each backend in %s must have a unique name", filename)
+		}
+		if len(config.Servers) == 0 {
+			return fmt.Errorf("Backend %s has no servers", config.Name)
+		}
+		names[config.Name] = true
+
+		dvidbackend := &backend{name: config.Name, uuids: config.UUIDs}
+		for _, server := range config.Servers {
+			dvidbackend.servers = append(dvidbackend.servers, serverURL(server))
+		}
+		backends = append(backends, dvidbackend)
+	}
+	dvidBackends = backends
+	return nil
+}
+
+// findBackend returns the backend with the name
+func findBackend(name string) (*backend, error) {
+	for _, dvidbackend := range dvidBackends {
+		if dvidbackend.name == name {
+			return dvidbackend, nil
+		}
+	}
+	return nil, &unknownBackendError{name}
+}
+
+// routeBackend returns the first backend with a prefix of the uuid or else the first backend without
+// uuid prefixes (nil if there is neither)
+func routeBackend(uuid string) *backend {
+	var fallback *backend
+	for _, dvidbackend := range dvidBackends {
+		if len(dvidbackend.uuids) == 0 {
+			if fallback == nil {
+				fallback = dvidbackend
+			}
+			continue
+		}
+		for _, prefix := range dvidbackend.uuids {
+			if uuid != "" && strings.HasPrefix(uuid, prefix) {
+				return dvidbackend
+			}
+		}
+	}
+	return fallback
+}
+
+// isBackendServer checks whether the URL is one of the servers of a backend
+func isBackendServer(server string) bool {
+	for _, dvidbackend := range dvidBackends {
+		for _, backendserver := range dvidbackend.servers {
+			if backendserver == server {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// failoverServers returns the servers to try for a DVID URL (servers that recently failed last) and the
+// rest of the URL, or nil if the URL is not on a backend
+func failoverServers(url string) ([]string, string) {
+	for _, dvidbackend := range dvidBackends {
+		for _, server := range dvidbackend.servers {
+			if url == server || strings.HasPrefix(url, server+"/") {
+				return health.order(dvidbackend.servers), url[len(server):]
+			}
+		}
+	}
+	return nil, ""
+}
+
+// order puts the servers that recently failed after the others (keeping the configured order otherwise)
+func (sh *serverHealth) order(servers []string) []string {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	now := time.Now()
+	var healthy, down []string
+	for _, server := range servers {
+		if until, found := sh.downUntil[server]; found && now.Before(until) {
+			down = append(down, server)
+		} else {
+			healthy = append(healthy, server)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// failed marks a server as down for the cooldown
+func (sh *serverHealth) failed(server string) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	sh.downUntil[server] = time.Now().Add(backendCooldown)
+}
+
+// recovered clears a server that responded
+func (sh *serverHealth) recovered(server string) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	delete(sh.downUntil, server)
+}
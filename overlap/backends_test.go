@@ -0,0 +1,166 @@
+package overlap
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useBackends loads the backends file content until the test ends
+func useBackends(t *testing.T, content string) {
+	filename := filepath.Join(t.TempDir(), "backends.json")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadBackends(filename); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dvidBackends = nil
+		health = &serverHealth{downUntil: make(map[string]time.Time)}
+	})
+}
+
+// hitCounter counts the requests to a server
+type hitCounter struct {
+	mutex sync.Mutex
+	hits  int
+}
+
+func (counter *hitCounter) count() int {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.hits
+}
+
+// hitServer counts its requests and passes them to the handler
+func hitServer(handler http.HandlerFunc) (*httptest.Server, *hitCounter) {
+	counter := &hitCounter{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter.mutex.Lock()
+		counter.hits += 1
+		counter.mutex.Unlock()
+		handler(w, r)
+	}))
+	return server, counter
+}
+
+func TestLoadBackends(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "backends.json")
+	invalid := []string{
+		`{"name":"prod"}`,
+		`[{"name":"prod","servers":[]}]`,
+		`[{"servers":["a:1"]}]`,
+		`[{"name":"prod","servers":["a:1"]},{"name":"prod","servers":["b:1"]}]`,
+	}
+	for _, content := range invalid {
+		os.WriteFile(filename, []byte(content), 0644)
+		if err := loadBackends(filename); err == nil {
+			t.Fatalf("Backends %s were accepted", content)
+		}
+	}
+	if err := loadBackends(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatalf("Missing backends file was accepted")
+	}
+}
+
+func TestBackendRouting(t *testing.T) {
+	useBackends(t, `[{"name":"prod","servers":["prod1:8000","https://prod2/"],"uuids":["ab","cd"]},{"name":"dev","servers":["dev:1"]}]`)
+	defer setAllowlist(nil)
+	setAllowlist(nil)
+
+	routes := []struct {
+		request map[string]interface{}
+		server  string
+	}{
+		{map[string]interface{}{"uuid": "abcd"}, "http://prod1:8000"},
+		{map[string]interface{}{"uuid": "cd12"}, "http://prod1:8000"},
+		{map[string]interface{}{"uuid": "ffff"}, "http://dev:1"},
+		{map[string]interface{}{"uuid": "abcd", "backend": "dev"}, "http://dev:1"},
+		{map[string]interface{}{"uuid": "ffff", "dvid-server": "https://prod2"}, "https://prod2"},
+	}
+	for _, route := range routes {
+		if server, err := getDVIDserver(route.request); err != nil || server != route.server {
+			t.Fatalf("Request %v was routed to %s (%v) instead of %s", route.request, server, err, route.server)
+		}
+	}
+	if _, err := getDVIDserver(map[string]interface{}{"backend": "missing"}); err == nil || dvidServerError(err) != err {
+		t.Fatalf("Unknown backend returned %v", err)
+	}
+	if !trustedServer("https://prod2/api") || trustedServer("http://prod2/api") {
+		t.Fatalf("Only the backend servers should be trusted")
+	}
+}
+
+func TestBackendFailover(t *testing.T) {
+	primary, primaryhits := hitServer(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	defer primary.Close()
+	replica, replicahits := hitServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	})
+	defer replica.Close()
+	useBackends(t, `[{"name":"prod","servers":["`+primary.URL+`","`+replica.URL+`/"]}]`)
+	useClient(t, testClient(2))
+
+	// the replica is tried after the first failure of the primary
+	var value map[string]interface{}
+	if err := dvid.getJSON(context.Background(), primary.URL+"/api", &value); err != nil || value["ok"] != true {
+		t.Fatalf("Request did not fail over: %v %v", err, value)
+	}
+	if primaryhits.count() != 1 || replicahits.count() != 1 {
+		t.Fatalf("Primary was read %d times and the replica %d times", primaryhits.count(), replicahits.count())
+	}
+
+	// the failed primary is tried last until it recovers
+	if err := dvid.getJSON(context.Background(), primary.URL+"/api", &value); err != nil {
+		t.Fatal(err)
+	}
+	if primaryhits.count() != 1 || replicahits.count() != 2 {
+		t.Fatalf("Failed primary was not skipped (%d primary reads)", primaryhits.count())
+	}
+
+	// 4xx responses do not fail over
+	if _, err := dvid.get(context.Background(), primary.URL+"/missing"); err == nil || replicahits.count() != 3 {
+		t.Fatalf("Missing resource returned %v", err)
+	}
+}
+
+func TestBackendStalledPrimary(t *testing.T) {
+	stall := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}))
+	defer primary.Close()
+	defer close(stall)
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer replica.Close()
+	useBackends(t, `[{"name":"prod","servers":["`+primary.URL+`","`+replica.URL+`"]}]`)
+	useClient(t, testClient(2))
+
+	// the primary has half of the deadline before the replica is tried
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	var value map[string]interface{}
+	if err := dvid.getJSON(ctx, primary.URL+"/api", &value); err != nil || value["ok"] != true {
+		t.Fatalf("Request did not fail over from a stalled primary: %v %v", err, value)
+	}
+	if order := health.order([]string{primary.URL, replica.URL}); order[0] != replica.URL {
+		t.Fatalf("Stalled primary was not marked as failed")
+	}
+}
@@ -0,0 +1,83 @@
+package overlap
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// boundNames are the request fields (and DVID sparsevol query parameters) for the bounding box
+var boundNames = []string{"minx", "maxx", "miny", "maxy", "minz", "maxz"}
+
+// bodyBounds is an inclusive bounding box used to restrict the bodies (unset bounds are unlimited)
+type bodyBounds struct {
+	values [6]int32
+	set    [6]bool
+}
+
+// getBounds retrieves the bounding box from the JSON (nil if no bounds are given)
+func getBounds(json_data map[string]interface{}) (*bodyBounds, error) {
+	var bounds *bodyBounds
+	for i, name := range boundNames {
+		if val, found := jsonFloat(json_data[name]); found {
+			if val < math.MinInt32 || val > math.MaxInt32 {
+				return nil, fmt.Errorf("Bound %s is out of range: %v", name, val)
+			}
+			if bounds == nil {
+				bounds = &bodyBounds{}
+			}
+			bounds.values[i] = int32(val)
+			bounds.set[i] = true
+		}
+	}
+	return bounds, nil
+}
+
+// queryString returns the DVID sparsevol query parameters for the bounding box
+func (bounds *bodyBounds) queryString() string {
+	var params []string
+	for i, name := range boundNames {
+		if bounds.set[i] {
+			params = append(params, name+"="+strconv.Itoa(int(bounds.values[i])))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// contains checks whether a coordinate is within the bounds for the given axis (0 = x, 1 = y, 2 = z)
+func (bounds *bodyBounds) contains(axis int, coord int32) bool {
+	if bounds.set[axis*2] && coord < bounds.values[axis*2] {
+		return false
+	}
+	if bounds.set[axis*2+1] && coord > bounds.values[axis*2+1] {
+		return false
+	}
+	return true
+}
+
+// clipBody returns the portion of the body's RLE that falls within the bounds
+func (bounds *bodyBounds) clipBody(sparse_body SparseBody) SparseBody {
+	clipped_body := SparseBody{}
+	clipped_body.bodyID = sparse_body.bodyID
+
+	for _, chunk := range sparse_body.rle {
+		if !bounds.contains(1, chunk.y) || !bounds.contains(2, chunk.z) {
+			continue
+		}
+
+		start := chunk.x
+		end := chunk.x + chunk.length
+		if bounds.set[0] && start < bounds.values[0] {
+			start = bounds.values[0]
+		}
+		if bounds.set[1] && end > bounds.values[1]+1 {
+			end = bounds.values[1] + 1
+		}
+		if start < end {
+			clipped_body.rle = append(clipped_body.rle, sparseData{start, chunk.y, chunk.z, end - start})
+		}
+	}
+
+	return clipped_body
+}
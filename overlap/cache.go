@@ -0,0 +1,176 @@
+package overlap
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// DefaultCacheSpans is the number of spans kept in the body cache if not configured (16 bytes per span)
+const DefaultCacheSpans = 1 << 24
+
+// cachePath is the URI for the cache statistics
+const cachePath = "/cache/"
+
+// bodyKey identifies a sparse volume fetched from DVID
+type bodyKey struct {
+	dvidserver string
+	uuid       string
+	instance   string
+	// sparsevol route and query string (resolution, bounds, and supervoxels)
+	query string
+	// identity of the Authorization header the body was read with (see credentialID)
+	credential string
+	bodyID     uint64
+}
+
+// cacheEntry is an element of the LRU list
+type cacheEntry struct {
+	key         bodyKey
+	sparse_body SparseBody
+}
+
+// bodyCache is an LRU cache of decoded bodies bounded by the total number of spans (safe for concurrent use)
+type bodyCache struct {
+	mutex    sync.Mutex
+	maxSpans int
+	spans    int
+	lru      *list.List
+	entries  map[bodyKey]*list.Element
+	hits     uint64
+	misses   uint64
+	// fetches in progress for each node (see startFetch)
+	fetches map[string]*nodeFetches
+}
+
+// nodeFetches counts the fetches in progress for a node and the evictions of the node since they started
+type nodeFetches struct {
+	count      int
+	generation uint64
+}
+
+// cache holds the bodies fetched from DVID (nil if caching is disabled)
+var cache = newBodyCache(DefaultCacheSpans)
+
+// newBodyCache creates an empty cache that holds up to maxSpans spans
+func newBodyCache(maxSpans int) *bodyCache {
+	return &bodyCache{maxSpans: maxSpans, lru: list.New(), entries: make(map[bodyKey]*list.Element), fetches: make(map[string]*nodeFetches)}
+}
+
+// get returns the cached body and marks it as recently used
+func (c *bodyCache) get(key bodyKey) (SparseBody, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		c.misses += 1
+		return SparseBody{}, false
+	}
+	c.hits += 1
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).sparse_body, true
+}
+
+// startFetch registers a fetch of a body of the node and returns the generation to pass to put, so that
+// a body read before the node is evicted is not put back afterward (finishFetch must be called once the
+// body is put)
+func (c *bodyCache) startFetch(uuid string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fetches, found := c.fetches[uuid]
+	if !found {
+		fetches = &nodeFetches{}
+		c.fetches[uuid] = fetches
+	}
+	fetches.count += 1
+	return fetches.generation
+}
+
+// finishFetch ends a fetch registered by startFetch
+func (c *bodyCache) finishFetch(uuid string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if fetches, found := c.fetches[uuid]; found {
+		fetches.count -= 1
+		if fetches.count <= 0 {
+			delete(c.fetches, uuid)
+		}
+	}
+}
+
+// put adds the body unless its node was evicted since the generation was returned by startFetch, and
+// evicts the least recently used bodies until the cache is within its bound (bodies larger than the whole
+// cache are not kept)
+func (c *bodyCache) put(key bodyKey, sparse_body SparseBody, generation uint64) {
+	numspans := len(sparse_body.rle)
+	if numspans > c.maxSpans {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if fetches, found := c.fetches[key.uuid]; found && fetches.generation != generation {
+		return
+	}
+
+	if elem, found := c.entries[key]; found {
+		c.spans -= len(elem.Value.(*cacheEntry).sparse_body.rle)
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, sparse_body})
+	c.spans += numspans
+
+	for c.spans > c.maxSpans {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removeElement drops an entry from the cache (the caller must hold the lock)
+func (c *bodyCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.spans -= len(entry.sparse_body.rle)
+}
+
+// cacheStats reports the use of the body cache
+type cacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Bodies   int    `json:"bodies"`
+	Spans    int    `json:"spans"`
+	MaxSpans int    `json:"max-spans"`
+}
+
+// stats returns the current hit and miss counts and the size of the cache
+func (c *bodyCache) stats() cacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return cacheStats{c.hits, c.misses, len(c.entries), c.spans, c.maxSpans}
+}
+
+// cacheHandler returns the statistics of the body cache
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	pathlist, requestType, err := parseURI(r, cachePath)
+	if err != nil || len(pathlist) != 0 {
+		badRequest(w, "Error: incorrectly formatted request")
+		return
+	}
+	if requestType != "get" {
+		badRequest(w, "only supports gets")
+		return
+	}
+
+	var stats cacheStats
+	if cache != nil {
+		stats = cache.stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsondata, _ := json.Marshal(stats)
+	w.Write(jsondata)
+}
@@ -0,0 +1,119 @@
+package overlap
+
+import (
+	"sync"
+	"testing"
+)
+
+// testKey is the cache key of a body at a node of a test server
+func testKey(uuid string, bodyid uint64) bodyKey {
+	return bodyKey{"http://dvid", uuid, "segmentation", "sparsevol", "", bodyid}
+}
+
+// spansBody is a body with the number of (empty) spans
+func spansBody(bodyid uint64, numspans int) SparseBody {
+	return SparseBody{bodyid, make([]sparseData, numspans)}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := newBodyCache(10)
+	c.put(testKey("abc", 1), spansBody(1, 4), 0)
+	c.put(testKey("abc", 2), spansBody(2, 4), 0)
+	c.get(testKey("abc", 1))
+
+	// body 2 is the least recently used
+	c.put(testKey("abc", 3), spansBody(3, 4), 0)
+	if _, found := c.get(testKey("abc", 2)); found {
+		t.Fatalf("Least recently used body was not evicted")
+	}
+	if sparse_body, found := c.get(testKey("abc", 1)); !found || sparse_body.bodyID != 1 {
+		t.Fatalf("Recently used body was evicted")
+	}
+
+	// bodies larger than the cache are not kept
+	c.put(testKey("abc", 4), spansBody(4, 11), 0)
+	if _, found := c.get(testKey("abc", 4)); found {
+		t.Fatalf("Body larger than the cache was kept")
+	}
+	stats := c.stats()
+	if stats.Spans != 8 || stats.Bodies != 2 || stats.Hits != 2 || stats.Misses != 2 {
+		t.Fatalf("Cache stats are %+v", stats)
+	}
+
+	// other routes and instances are cached separately
+	other := testKey("abc", 1)
+	other.query = "sparsevol-coarse"
+	if _, found := c.get(other); found {
+		t.Fatalf("Body read from another route was returned")
+	}
+}
+
+func TestCacheConcurrency(t *testing.T) {
+	c := newBodyCache(10)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker += 1 {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i += 1 {
+				bodyid := uint64((i * worker) % 20)
+				if _, found := c.get(testKey("abc", bodyid)); !found {
+					c.put(testKey("abc", bodyid), spansBody(bodyid, 1+int(bodyid)%3), 0)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if stats := c.stats(); stats.Spans > 10 || stats.Hits+stats.Misses != 8000 {
+		t.Fatalf("Cache stats are %+v", stats)
+	}
+}
+
+func TestCacheGeneration(t *testing.T) {
+	c := newBodyCache(100)
+
+	// a body read while its node is evicted is not cached
+	generation := c.startFetch("abcdef")
+	c.evict("abc", map[uint64]bool{7: true})
+	c.put(testKey("abcdef", 1), spansBody(1, 1), generation)
+	c.finishFetch("abcdef")
+	if _, found := c.get(testKey("abcdef", 1)); found {
+		t.Fatalf("Body read before its node was evicted was cached")
+	}
+
+	// fetches of other nodes are unaffected
+	generation = c.startFetch("abcdef")
+	c.evict("123", map[uint64]bool{7: true})
+	c.put(testKey("abcdef", 1), spansBody(1, 1), generation)
+	c.finishFetch("abcdef")
+	if _, found := c.get(testKey("abcdef", 1)); !found {
+		t.Fatalf("Body was not cached after another node was evicted")
+	}
+	if len(c.fetches) != 0 {
+		t.Fatalf("Finished fetches are still registered: %v", c.fetches)
+	}
+}
+
+func TestServiceCache(t *testing.T) {
+	dvidserver := newFakeDVID()
+	address := dvidserver.start(t)
+	useCache(t, newBodyCache(100))
+
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", ""), 200, `{"overlap-list":[[1,2,1]]}`)
+	checkHandler(t, bodystatsPath, dvidRequest(address, "[1,2]", ""), 200, `{"body-stats":[[2,3,14],[1,2,10]]}`)
+	if fetched := len(dvidserver.requested("/sparsevol/")); fetched != 2 {
+		t.Fatalf("Cached bodies were fetched again (%d fetches)", fetched)
+	}
+
+	// bodies at other resolutions are fetched separately
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"scale":1`), 200)
+	if fetched := len(dvidserver.requested("/sparsevol/")); fetched != 4 {
+		t.Fatalf("Bodies cached at full resolution were used at scale 1 (%d fetches)", fetched)
+	}
+
+	// bodies read with one Authorization header are not returned to callers with another
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"authorization":"Bearer other"`), 200)
+	if fetched := len(dvidserver.requested("/sparsevol/")); fetched != 6 {
+		t.Fatalf("Bodies cached for another credential were used (%d fetches)", fetched)
+	}
+}
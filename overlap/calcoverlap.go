@@ -13,21 +13,23 @@ type yzPair struct {
 
 // bodyPair contains two bodies, smallest id first
 type bodyPair struct {
-	body1 uint32
-	body2 uint32
+	body1 uint64
+	body2 uint64
 }
 
-func newBodyPair(body1, body2 uint32) *bodyPair {
+func newBodyPair(body1, body2 uint64) *bodyPair {
 	if body2 < body1 {
 		body1, body2 = body2, body1
 	}
 	return &bodyPair{body1, body2}
 }
 
+// xIndex is a run for a given yz (region is only used for the per-ROI breakdown)
 type xIndex struct {
-	bodyID uint32
+	bodyID uint64
 	x      int32
 	length int32
+	region int32
 }
 
 type xIndices []xIndex
@@ -70,8 +72,8 @@ func findEqual(xval int32, xindices xIndices) (index int, found bool) {
 }
 
 // loadSparseBodyYZs indexes the RLE into a YZ map for easy analysis and returns the size of the body
-func loadSparseBodyYZs(sparse_body sparseBody, yzmaplist map[yzPair]xIndices) (uint32) {
-        var bodysize uint32
+func loadSparseBodyYZs(sparse_body SparseBody, yzmaplist map[yzPair]xIndices) (uint64) {
+        var bodysize uint64
         bodysize = 0
 
         // slice of x's
@@ -82,7 +84,7 @@ func loadSparseBodyYZs(sparse_body sparseBody, yzmaplist map[yzPair]xIndices) (u
                 y := chunk.y
                 z := chunk.z
                 yzpair := yzPair{y, z}
-                bodysize += uint32(chunk.length)
+                bodysize += uint64(chunk.length)
 
                 if y != ycurr || z != zcurr {
                         if len(xindices) > 0 {
@@ -98,7 +100,7 @@ func loadSparseBodyYZs(sparse_body sparseBody, yzmaplist map[yzPair]xIndices) (u
                         xindices = xIndices{}
 
                 }
-                xindices = append(xindices, xIndex{sparse_body.bodyID, chunk.x, chunk.length})
+                xindices = append(xindices, xIndex{sparse_body.bodyID, chunk.x, chunk.length, 0})
         }
         if len(xindices) > 0 {
                 yzpairold := yzPair{ycurr, zcurr}
@@ -108,83 +110,74 @@ func loadSparseBodyYZs(sparse_body sparseBody, yzmaplist map[yzPair]xIndices) (u
         return bodysize
 }
 
-// computeStats finds the volume and surface area for each body
-func computeStats(sparse_bodies sparseBodies) resultList {
+// computeStats finds the volume and surface area for each body (and of the part of each body within each
+// ROI if regions are provided, nil otherwise)
+func computeStats(sparse_bodies sparseBodies, regions *roiRegions) (resultList, map[string]resultList) {
 	stats_slice := resultList{}
+	stats_lists := newRegionLists(regions)
 
-        for _, sparse_body := range sparse_bodies {
-                // hash of yz value to sorted slice of xIndices
-                var yzmaplist = make(map[yzPair]xIndices)
-                
-                bodyid := sparse_body.bodyID
-                // grab volume
-                bodyvolume := loadSparseBodyYZs(sparse_body, yzmaplist)
-
-                // sort all xindices
-                for _, xindices := range yzmaplist {
-                        sort.Sort(xindices)
-                }
+	for _, sparse_body := range sparse_bodies {
+		bodyid := sparse_body.bodyID
+		region_runs := splitByRegion(sparse_body, regions)
+
+		// hash of yz value to sorted slice of xIndices
+		var yzmaplist = make(map[yzPair]xIndices)
+		loadRegionRunYZs(bodyid, region_runs, yzmaplist)
 
-                // maximum number of adjacencies possible
-                var totaladjacencies uint32
-                totaladjacencies = 0
-	
-                // contains overlap results for each body pair
-	        body_pairs := make(map[bodyPair]uint32)
+		// sort all xindices
+		for _, xindices := range yzmaplist {
+			sort.Sort(xindices)
+		}
 
- 		for _, chunk := range sparse_body.rle {
-			y := chunk.y
-			z := chunk.z
-			xmin := chunk.x
-			xmax := xmin + chunk.length
+		// volume and maximum number of adjacencies possible in each region
+		volumes := make(map[int32]uint64)
+		totaladjacencies := make(map[int32]uint64)
 
-                        // maximum possible adjacency for this run
-                        totaladjacencies += uint32(chunk.length * 4 + 2)
+		// contains the adjacencies of the body to itself in each region
+		region_pairs := make(map[regionPair]uint64)
+
+		for _, region_run := range region_runs {
+			volumes[region_run.region] += uint64(region_run.chunk.length)
+			totaladjacencies[region_run.region] += uint64(region_run.chunk.length*4 + 2)
 
 			// find total number of adjancencies to itself (use 0 body id since there are no such body ids)
-			if xlist, found := yzmaplist[yzPair{y + 1, z}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, 0)
-			}
-			if xlist, found := yzmaplist[yzPair{y - 1, z}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, 0)
-			}
-			if xlist, found := yzmaplist[yzPair{y, z + 1}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, 0)
-			}
-			if xlist, found := yzmaplist[yzPair{y, z - 1}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, 0)
-			}
+			adjacencies(region_pairs, yzmaplist, region_run, 0)
+		}
 
-			if xlist, found := yzmaplist[yzPair{y, z}]; found {
-				// check if there is a pixel with a smaller x in the same body
-				if index, found := findLowerBound(xmin-1, xlist); found {
-					xval := xlist[index]
-					if (xval.length+xval.x-1) == (xmin-1) {
-						body_pairs[*newBodyPair(0, xval.bodyID)] += 1
-					}
-				}
-
-				// check if there is a pixel greater in x in the same body
-				if index, found := findEqual(xmax, xlist); found {
-					body_pairs[*newBodyPair(0, xlist[index].bodyID)] += 1
-				}
+		var bodyvolume, bodyarea uint64
+		for region, volume := range volumes {
+			area := totaladjacencies[region] - region_pairs[regionPair{*newBodyPair(0, bodyid), region}]
+			bodyvolume += volume
+			bodyarea += area
+			if region >= 0 {
+				name := regions.names[region]
+				stats_lists[name] = append(stats_lists[name], []uint64{bodyid, volume, area})
 			}
 		}
-                
-                bodyarea := totaladjacencies - body_pairs[*newBodyPair(0, bodyid)]
- 
-		tempslice := []uint32{bodyid, bodyvolume, bodyarea}
+
+		tempslice := []uint64{bodyid, bodyvolume, bodyarea}
 		stats_slice = append(stats_slice, tempslice)
 	}
 
 	// put body pairs with the largest surface area first
 	sort.Sort(sort.Reverse(stats_slice))
+	for _, stats_list := range stats_lists {
+		sort.Sort(sort.Reverse(stats_list))
+	}
 
-	return stats_slice
+	return stats_slice, stats_lists
 }
 
 // computeOverlap finds the overlap between the list of bodies using the RLE, only bodies with overlap are returned
-func computeOverlap(sparse_bodies sparseBodies) resultList {
+// (the overlap within each ROI is also found if regions are provided, nil otherwise)
+func computeOverlap(sparse_bodies sparseBodies, regions *roiRegions) (resultList, map[string]resultList) {
+	overlap_lists := newRegionLists(regions)
+
+	// no overlap is possible without at least two bodies
+	if len(sparse_bodies) < 2 {
+		return resultList{}, overlap_lists
+	}
+
 	// smallest rle first -- more memory use (or largest first for more computation)
 	sort.Sort(sparse_bodies)
 
@@ -197,7 +190,7 @@ func computeOverlap(sparse_bodies sparseBodies) resultList {
 
 	// preprocess rles -- do not load the first body
 	for _, sparse_body := range sparse_bodies[1:] {
-                loadSparseBodyYZs(sparse_body, yzmaplist)
+		loadRegionRunYZs(sparse_body.bodyID, splitByRegion(sparse_body, regions), yzmaplist)
 	}
 
 	// sort all xindices
@@ -205,73 +198,93 @@ func computeOverlap(sparse_bodies sparseBodies) resultList {
 		sort.Sort(xindices)
 	}
 
-	// contains overlap results for each body pair
-	body_pairs := make(map[bodyPair]uint32)
+	// contains overlap results for each body pair in each region
+	region_pairs := make(map[regionPair]uint64)
 
 	// iterate one body at a time to calculate overlap, do not need to examine the last body
 	for _, sparse_body := range sparse_bodies[0 : len(sparse_bodies)-1] {
-		bodyid1 := sparse_body.bodyID
-		for _, chunk := range sparse_body.rle {
-			y := chunk.y
-			z := chunk.z
-			xmin := chunk.x
-			xmax := xmin + chunk.length
-
-			// examine adjacencies
-			if xlist, found := yzmaplist[yzPair{y + 1, z}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, bodyid1)
-			}
-			if xlist, found := yzmaplist[yzPair{y - 1, z}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, bodyid1)
-			}
-			if xlist, found := yzmaplist[yzPair{y, z + 1}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, bodyid1)
-			}
-			if xlist, found := yzmaplist[yzPair{y, z - 1}]; found {
-				overlap(body_pairs, xlist, xmin, xmax, bodyid1)
-			}
-
-			if xlist, found := yzmaplist[yzPair{y, z}]; found {
-				// check if there is a pixel with a smaller x
-				// the pixel could be of the same body so check
-				if index, found := findLowerBound(xmin-1, xlist); found {
-					xval := xlist[index]
-					if (bodyid1 != xval.bodyID) && (xval.length+xval.x-1) == (xmin-1) {
-						body_pairs[*newBodyPair(bodyid1, xval.bodyID)] += 1
-					}
-				}
-
-				// check if there is a pixel greater in x
-				// the pixel could be of the same body so check
-				if index, found := findEqual(xmax, xlist); found {
-					if bodyid1 != xlist[index].bodyID {
-						body_pairs[*newBodyPair(bodyid1, xlist[index].bodyID)] += 1
-					}
-				}
-			}
+		for _, region_run := range splitByRegion(sparse_body, regions) {
+			adjacencies(region_pairs, yzmaplist, region_run, sparse_body.bodyID)
 		}
 	}
 
-	for pair, val := range body_pairs {
+	body_pairs := make(map[bodyPair]uint64)
+	for key, val := range region_pairs {
+		pair := key.pair
 		if pair.body1 != first_sparse_body.bodyID && pair.body1 != last_sparse_body.bodyID && pair.body2 != first_sparse_body.bodyID && pair.body2 != last_sparse_body.bodyID {
-			body_pairs[pair] = val / 2
+			val = val / 2
+		}
+		body_pairs[pair] += val
+		if key.region >= 0 {
+			name := regions.names[key.region]
+			overlap_lists[name] = append(overlap_lists[name], []uint64{pair.body1, pair.body2, val})
 		}
 	}
 
 	overlap_slice := resultList{}
 	for pair, val := range body_pairs {
-		tempslice := []uint32{pair.body1, pair.body2, val}
+		tempslice := []uint64{pair.body1, pair.body2, val}
 		overlap_slice = append(overlap_slice, tempslice)
 	}
 
 	// put body pairs with the largest overlap first
 	sort.Sort(sort.Reverse(overlap_slice)) // by size of overlap
+	for _, overlap_list := range overlap_lists {
+		sort.Sort(sort.Reverse(overlap_list))
+	}
+
+	return overlap_slice, overlap_lists
+}
+
+// adjacencies examines the neighbors of a run of bodyid1 (in the four neighboring rows and at either end of
+// the run) and adds the overlap with different bodies to region_pairs
+func adjacencies(region_pairs map[regionPair]uint64, yzmaplist map[yzPair]xIndices, region_run regionRun, bodyid1 uint64) {
+	chunk := region_run.chunk
+	region1 := region_run.region
+	y := chunk.y
+	z := chunk.z
+	xmin := chunk.x
+	xmax := xmin + chunk.length
+
+	// examine adjacencies
+	if xlist, found := yzmaplist[yzPair{y + 1, z}]; found {
+		overlap(region_pairs, xlist, xmin, xmax, bodyid1, region1)
+	}
+	if xlist, found := yzmaplist[yzPair{y - 1, z}]; found {
+		overlap(region_pairs, xlist, xmin, xmax, bodyid1, region1)
+	}
+	if xlist, found := yzmaplist[yzPair{y, z + 1}]; found {
+		overlap(region_pairs, xlist, xmin, xmax, bodyid1, region1)
+	}
+	if xlist, found := yzmaplist[yzPair{y, z - 1}]; found {
+		overlap(region_pairs, xlist, xmin, xmax, bodyid1, region1)
+	}
 
-	return overlap_slice
+	if xlist, found := yzmaplist[yzPair{y, z}]; found {
+		// check if there is a pixel with a smaller x
+		// the pixel could be of the same body so check
+		if index, found := findLowerBound(xmin-1, xlist); found {
+			xval := xlist[index]
+			if (bodyid1 != xval.bodyID) && (xval.length+xval.x-1) == (xmin-1) {
+				region_pairs[regionPair{*newBodyPair(bodyid1, xval.bodyID), pickRegion(bodyid1, region1, xval)}] += 1
+			}
+		}
+
+		// check if there is a pixel greater in x
+		// the pixel could be of the same body so check
+		if index, found := findEqual(xmax, xlist); found {
+			xval := xlist[index]
+			if bodyid1 != xval.bodyID {
+				region_pairs[regionPair{*newBodyPair(bodyid1, xval.bodyID), pickRegion(bodyid1, region1, xval)}] += 1
+			}
+		}
+	}
 }
 
-// overlap calculates the overlap between bodyid1 and different bodies and puts the value in body_pairs
-func overlap(body_pairs map[bodyPair]uint32, xlist xIndices, xmin int32, xmax int32, bodyid1 uint32) {
+// overlap calculates the overlap between bodyid1 and different bodies and puts the value in region_pairs
+// (attributed to the region of the voxel belonging to the smaller body id, so either direction of the
+// search gives the same region)
+func overlap(region_pairs map[regionPair]uint64, xlist xIndices, xmin int32, xmax int32, bodyid1 uint64, region1 int32) {
 	var maxindex int
 	var minindex int
 	var found bool
@@ -295,7 +308,7 @@ func overlap(body_pairs map[bodyPair]uint32, xlist xIndices, xmin int32, xmax in
 			}
 
 			if length > 0 {
-				body_pairs[*(newBodyPair(bodyid1, xlist[i].bodyID))] += uint32(math.Min(float64(length), float64(xmax-start)))
+				region_pairs[regionPair{*newBodyPair(bodyid1, xlist[i].bodyID), pickRegion(bodyid1, region1, xlist[i])}] += uint64(math.Min(float64(length), float64(xmax-start)))
 			}
 		}
 	}
@@ -0,0 +1,337 @@
+package overlap
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// voxel is a voxel coordinate of a test volume
+type voxel struct {
+	x, y, z int32
+}
+
+// faceSteps are the steps to the next voxel along x, y, and z (each contact is counted once)
+var faceSteps = []voxel{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+// neighborSteps are the steps to the six face neighbors of a voxel
+var neighborSteps = []voxel{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}, {-1, 0, 0}, {0, -1, 0}, {0, 0, -1}}
+
+func (v voxel) step(d voxel) voxel {
+	return voxel{v.x + d.x, v.y + d.y, v.z + d.z}
+}
+
+// randomVolume labels random voxels of a dim^3 cube with bodies 1 to numbodies and grows them so
+// that the bodies touch
+func randomVolume(rng *rand.Rand, numbodies int, dim int32) map[voxel]uint64 {
+	volume := make(map[voxel]uint64)
+	for i := 0; i < 400; i += 1 {
+		volume[voxel{rng.Int31n(dim), rng.Int31n(dim), rng.Int31n(dim)}] = uint64(rng.Intn(numbodies) + 1)
+	}
+	for iter := 0; iter < 3; iter += 1 {
+		for v, bodyid := range volume {
+			next := v.step(voxel{rng.Int31n(3) - 1, rng.Int31n(3) - 1, rng.Int31n(3) - 1})
+			if _, found := volume[next]; !found && next.x >= 0 && next.y >= 0 && next.z >= 0 && next.x < dim && next.y < dim && next.z < dim {
+				volume[next] = bodyid
+			}
+		}
+	}
+	return volume
+}
+
+// volumeBodies encodes the bodies of a test volume as runs along x
+func volumeBodies(volume map[voxel]uint64, numbodies int, dim int32) sparseBodies {
+	var sparse_bodies sparseBodies
+	for bodyid := uint64(1); bodyid <= uint64(numbodies); bodyid += 1 {
+		sparse_body := SparseBody{bodyID: bodyid}
+		for z := int32(0); z < dim; z += 1 {
+			for y := int32(0); y < dim; y += 1 {
+				start := int32(-1)
+				for x := int32(0); x <= dim; x += 1 {
+					inside := x < dim && volume[voxel{x, y, z}] == bodyid
+					if inside && start < 0 {
+						start = x
+					} else if !inside && start >= 0 {
+						sparse_body.rle = append(sparse_body.rle, sparseData{start, y, z, x - start})
+						start = -1
+					}
+				}
+			}
+		}
+		sparse_bodies = append(sparse_bodies, sparse_body)
+	}
+	return sparse_bodies
+}
+
+// countOverlap counts the faces shared by each pair of bodies voxel by voxel (a contact belongs to the
+// region of the voxel of the lower body id if region is given)
+func countOverlap(volume map[voxel]uint64, region func(voxel) int) []map[[2]uint64]uint64 {
+	counts := []map[[2]uint64]uint64{make(map[[2]uint64]uint64)}
+	for v, bodyid := range volume {
+		for _, d := range faceSteps {
+			next := v.step(d)
+			bodyid2, found := volume[next]
+			if !found || bodyid2 == bodyid {
+				continue
+			}
+			pair := [2]uint64{bodyid, bodyid2}
+			owner := v
+			if bodyid2 < bodyid {
+				pair = [2]uint64{bodyid2, bodyid}
+				owner = next
+			}
+			index := 0
+			if region != nil {
+				index = region(owner)
+				if index < 0 {
+					continue
+				}
+				for len(counts) <= index {
+					counts = append(counts, make(map[[2]uint64]uint64))
+				}
+			}
+			counts[index][pair] += 1
+		}
+	}
+	return counts
+}
+
+// countStats counts the voxels ([body, 0]) and surface faces ([body, 1]) of each body voxel by voxel
+// (only the voxels in the region if given)
+func countStats(volume map[voxel]uint64, inside func(voxel) bool) map[[2]uint64]uint64 {
+	counts := make(map[[2]uint64]uint64)
+	for v, bodyid := range volume {
+		if inside != nil && !inside(v) {
+			continue
+		}
+		counts[[2]uint64{bodyid, 0}] += 1
+		for _, d := range neighborSteps {
+			if bodyid2, found := volume[v.step(d)]; !found || bodyid2 != bodyid {
+				counts[[2]uint64{bodyid, 1}] += 1
+			}
+		}
+	}
+	return counts
+}
+
+// overlapCounts indexes the rows of an overlap list by body pair
+func overlapCounts(overlap_list resultList) map[[2]uint64]uint64 {
+	counts := make(map[[2]uint64]uint64)
+	for _, row := range overlap_list {
+		counts[[2]uint64{row[0], row[1]}] = row[2]
+	}
+	return counts
+}
+
+// statsCounts indexes the volume and surface area of each body in a stats list (bodies without voxels
+// are skipped)
+func statsCounts(stat_list resultList) map[[2]uint64]uint64 {
+	counts := make(map[[2]uint64]uint64)
+	for _, row := range stat_list {
+		if row[1] == 0 {
+			continue
+		}
+		counts[[2]uint64{row[0], 0}] = row[1]
+		counts[[2]uint64{row[0], 1}] = row[2]
+	}
+	return counts
+}
+
+// compareCounts fails the test if the counts differ
+func compareCounts(t *testing.T, name string, counts, expected map[[2]uint64]uint64) {
+	t.Helper()
+	if len(counts) != len(expected) {
+		t.Fatalf("%s has %d entries instead of %d: %v (expected %v)", name, len(counts), len(expected), counts, expected)
+	}
+	for key, val := range expected {
+		if counts[key] != val {
+			t.Fatalf("%s of %v is %d instead of %d", name, key, counts[key], val)
+		}
+	}
+}
+
+// randomROI selects random ROI blocks of a dim^3 cube and returns the ROI and a test for its voxels
+func randomROI(rng *rand.Rand, dim int32) (roiSpans, func(voxel) bool) {
+	numblocks := (dim + roiBlockSize - 1) / roiBlockSize
+	blocks := make(map[voxel]bool)
+	roi := make(roiSpans)
+	for z := int32(0); z < numblocks; z += 1 {
+		for y := int32(0); y < numblocks; y += 1 {
+			for x := int32(0); x < numblocks; x += 1 {
+				if rng.Intn(2) == 0 {
+					blocks[voxel{x, y, z}] = true
+					roi[yzPair{y, z}] = append(roi[yzPair{y, z}], blockSpan{x, x})
+				}
+			}
+		}
+	}
+	for _, spans := range roi {
+		sort.Sort(spans)
+	}
+	return roi, func(v voxel) bool {
+		return blocks[voxel{blockCoord(v.x), blockCoord(v.y), blockCoord(v.z)}]
+	}
+}
+
+func TestComputeOverlapAndStats(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 30; trial += 1 {
+		volume := randomVolume(rng, 5, 40)
+		sparse_bodies := volumeBodies(volume, 5, 40)
+
+		overlap_list, region_lists := computeOverlap(sparse_bodies, nil)
+		if region_lists != nil {
+			t.Fatalf("Overlap without regions returned region lists %v", region_lists)
+		}
+		compareCounts(t, "Overlap", overlapCounts(overlap_list), countOverlap(volume, nil)[0])
+
+		stat_list, _ := computeStats(sparse_bodies, nil)
+		compareCounts(t, "Stats", statsCounts(stat_list), countStats(volume, nil))
+	}
+}
+
+func TestClipBody(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for trial := 0; trial < 20; trial += 1 {
+		volume := randomVolume(rng, 5, 70)
+		sparse_bodies := volumeBodies(volume, 5, 70)
+		roi, inside := randomROI(rng, 70)
+
+		// bodies clipped to the ROI only touch inside it and keep the surface of the whole body
+		clipped_volume := make(map[voxel]uint64)
+		for v, bodyid := range volume {
+			if inside(v) {
+				clipped_volume[v] = bodyid
+			}
+		}
+		var clipped_bodies sparseBodies
+		for _, sparse_body := range sparse_bodies {
+			clipped_bodies = append(clipped_bodies, clipBody(sparse_body, roi))
+		}
+		clipped_list, _ := computeOverlap(clipped_bodies, nil)
+		compareCounts(t, "Clipped overlap", overlapCounts(clipped_list), countOverlap(clipped_volume, nil)[0])
+		compareCounts(t, "Clipped stats", statsCounts(computeROIStats(sparse_bodies, clipped_bodies, nil)), countStats(volume, inside))
+	}
+}
+
+func TestComputeByRegion(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for trial := 0; trial < 20; trial += 1 {
+		volume := randomVolume(rng, 5, 70)
+		sparse_bodies := volumeBodies(volume, 5, 70)
+		roi1, inside1 := randomROI(rng, 70)
+		roi2, inside2 := randomROI(rng, 70)
+		regions := &roiRegions{[]string{"a", "b"}, []roiSpans{roi1, roi2}}
+
+		// voxels in both ROIs belong to the first
+		region := func(v voxel) int {
+			if inside1(v) {
+				return 0
+			} else if inside2(v) {
+				return 1
+			}
+			return -1
+		}
+		expected := countOverlap(volume, region)
+		for len(expected) < 2 {
+			expected = append(expected, make(map[[2]uint64]uint64))
+		}
+
+		overlap_list, overlap_lists := computeOverlap(sparse_bodies, regions)
+		stat_list, stat_lists := computeStats(sparse_bodies, regions)
+		compareCounts(t, "Overlap", overlapCounts(overlap_list), countOverlap(volume, nil)[0])
+		compareCounts(t, "Stats", statsCounts(stat_list), countStats(volume, nil))
+		for i, name := range regions.names {
+			compareCounts(t, "Overlap in "+name, overlapCounts(overlap_lists[name]), expected[i])
+			inside := func(v voxel) bool { return region(v) == i }
+			compareCounts(t, "Stats in "+name, statsCounts(stat_lists[name]), countStats(volume, inside))
+		}
+	}
+}
+
+func TestCandidateBodies(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	for trial := 0; trial < 20; trial += 1 {
+		volume := randomVolume(rng, 8, 80)
+
+		// each coarse voxel is an 8^3 block holding any voxel of the body
+		const blocksize = 8
+		blocks := make(map[voxel]map[uint64]bool)
+		for v, bodyid := range volume {
+			block := voxel{v.x / blocksize, v.y / blocksize, v.z / blocksize}
+			if blocks[block] == nil {
+				blocks[block] = make(map[uint64]bool)
+			}
+			blocks[block][bodyid] = true
+		}
+		var coarse_bodies sparseBodies
+		for bodyid := uint64(1); bodyid <= 8; bodyid += 1 {
+			sparse_body := SparseBody{bodyID: bodyid}
+			for block, bodies := range blocks {
+				if bodies[bodyid] {
+					sparse_body.rle = append(sparse_body.rle, sparseData{block.x, block.y, block.z, 1})
+				}
+			}
+			coarse_bodies = append(coarse_bodies, sparse_body)
+		}
+
+		candidates := make(map[uint64]bool)
+		for _, bodyid := range candidateBodies(coarse_bodies) {
+			candidates[uint64(bodyid)] = true
+		}
+		for pair := range countOverlap(volume, nil)[0] {
+			if !candidates[pair[0]] || !candidates[pair[1]] {
+				t.Fatalf("Touching bodies %v are not both candidates", pair)
+			}
+		}
+	}
+}
+
+func TestSupervoxelAggregation(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for trial := 0; trial < 20; trial += 1 {
+		// supervoxels 1 to 12 belong to bodies 100 to 103
+		sv_volume := randomVolume(rng, 12, 70)
+		svmap := make(supervoxelMap)
+		for svid := uint64(1); svid <= 12; svid += 1 {
+			svmap[svid] = 100 + (svid-1)%4
+		}
+		volume := make(map[voxel]uint64)
+		for v, svid := range sv_volume {
+			volume[v] = svmap[svid]
+		}
+
+		sv_bodies := volumeBodies(sv_volume, 12, 70)
+		sv_overlap, _ := computeOverlap(sv_bodies, nil)
+		sv_stats, _ := computeStats(sv_bodies, nil)
+		compareCounts(t, "Body overlap", overlapCounts(svmap.aggregateOverlap(sv_overlap)), countOverlap(volume, nil)[0])
+		compareCounts(t, "Body stats", statsCounts(svmap.aggregateStats(sv_stats, sv_overlap)), countStats(volume, nil))
+
+		// the surface within an ROI does not include faces shared with other supervoxels of the body
+		roi, inside := randomROI(rng, 70)
+		var clipped_bodies sparseBodies
+		for _, sparse_body := range sv_bodies {
+			clipped_bodies = append(clipped_bodies, clipBody(sparse_body, roi))
+		}
+		roi_stats := svmap.aggregateStats(computeROIStats(sv_bodies, clipped_bodies, svmap), resultList{})
+		compareCounts(t, "Clipped body stats", statsCounts(roi_stats), countStats(volume, inside))
+	}
+}
+
+func TestRelabelBodies(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	for trial := 0; trial < 20; trial += 1 {
+		volume := randomVolume(rng, 8, 40)
+		mapping := bodyMapping{1: 2, 3: 2, 5: 50}
+		mapped_volume := make(map[voxel]uint64)
+		for v, bodyid := range volume {
+			mapped_volume[v] = mapping.mapID(bodyid)
+		}
+
+		merged_bodies := mapping.relabelBodies(volumeBodies(volume, 8, 40))
+		overlap_list, _ := computeOverlap(merged_bodies, nil)
+		stat_list, _ := computeStats(merged_bodies, nil)
+		compareCounts(t, "Merged overlap", overlapCounts(overlap_list), countOverlap(mapped_volume, nil)[0])
+		compareCounts(t, "Merged stats", statsCounts(stat_list), countStats(mapped_volume, nil))
+	}
+}
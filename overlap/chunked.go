@@ -0,0 +1,306 @@
+package overlap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// chunkedVolume is a label volume stored as separate chunk files (N5 or zarr)
+type chunkedVolume struct {
+	path  string
+	size  [3]int
+	chunk [3]int
+	// readChunk returns the labels of the chunk at the chunk coordinate with the chunk's own size
+	// (x varies fastest, nil if the chunk is missing)
+	readChunk func(coord [3]int) ([]uint64, [3]int, error)
+}
+
+func (volume *chunkedVolume) dims() [3]int {
+	return volume.size
+}
+
+// scan reads one layer of chunks at a time along z and visits its slices
+func (volume *chunkedVolume) scan(ctx context.Context, visit func(z int32, labels []uint64) error) error {
+	slicelen := volume.size[0] * volume.size[1]
+	slab := make([]uint64, slicelen*volume.chunk[2])
+	for z0 := 0; z0 < volume.size[2]; z0 += volume.chunk[2] {
+		for i := range slab {
+			slab[i] = 0
+		}
+		numz := volume.chunk[2]
+		if z0+numz > volume.size[2] {
+			numz = volume.size[2] - z0
+		}
+
+		for y0 := 0; y0 < volume.size[1]; y0 += volume.chunk[1] {
+			for x0 := 0; x0 < volume.size[0]; x0 += volume.chunk[0] {
+				coord := [3]int{x0 / volume.chunk[0], y0 / volume.chunk[1], z0 / volume.chunk[2]}
+				labels, chunksize, err := volume.readChunk(coord)
+				if err != nil {
+					return fmt.Errorf("Chunk %v of %s could not be read: %v", coord, volume.path, err)
+				}
+				if labels == nil {
+					continue
+				}
+				if len(labels) < chunksize[0]*chunksize[1]*chunksize[2] {
+					return fmt.Errorf("Chunk %v of %s is truncated", coord, volume.path)
+				}
+
+				// copy the part of the chunk inside the volume into the slab
+				for z := 0; z < chunksize[2] && z < numz; z += 1 {
+					for y := 0; y < chunksize[1] && y0+y < volume.size[1]; y += 1 {
+						width := chunksize[0]
+						if x0+width > volume.size[0] {
+							width = volume.size[0] - x0
+						}
+						src := labels[(z*chunksize[1]+y)*chunksize[0]:]
+						dst := slab[z*slicelen+(y0+y)*volume.size[0]+x0:]
+						copy(dst[:width], src[:width])
+					}
+				}
+			}
+		}
+
+		for z := 0; z < numz; z += 1 {
+			if err := visit(int32(z0+z), slab[z*slicelen:(z+1)*slicelen]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decompress wraps the chunk data in a reader for the compression ("raw", "gzip", or "zlib")
+func decompress(data io.Reader, compression string) (io.Reader, error) {
+	switch compression {
+	case "", "raw":
+		return data, nil
+	case "gzip":
+		return gzip.NewReader(data)
+	case "zlib":
+		return zlib.NewReader(data)
+	}
+	return nil, fmt.Errorf("compression %s is not supported", compression)
+}
+
+// checkCompression verifies that the chunks of the volume can be decompressed (so that an unsupported
+// compression such as blosc is reported when the volume is opened)
+func checkCompression(path, compression string) error {
+	switch compression {
+	case "", "raw", "gzip", "zlib":
+		return nil
+	}
+	return fmt.Errorf("compression %s of %s is not supported (only raw, gzip, and zlib)", compression, path)
+}
+
+// readLabels decodes count labels from the reader
+func readLabels(reader io.Reader, count int, dtype labelType) ([]uint64, error) {
+	buf := make([]byte, count*dtype.size)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, fmt.Errorf("chunk holds fewer than %d labels", count)
+	}
+	labels := make([]uint64, count)
+	dtype.decode(buf, labels)
+	return labels, nil
+}
+
+// n5Attributes is the part of the N5 dataset attributes needed to read the blocks
+type n5Attributes struct {
+	Dimensions  []int
+	BlockSize   []int
+	DataType    string
+	Compression struct {
+		Type    string
+		UseZlib bool
+	}
+	// older N5 versions only provide the compression type
+	CompressionType string
+}
+
+// openN5 reads the attributes of an N5 dataset (dimensions are listed as x, y, z)
+func openN5(path string) (*chunkedVolume, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, "attributes.json"))
+	if err != nil {
+		return nil, fmt.Errorf("N5 attributes could not be read: %v", err)
+	}
+	var attrs n5Attributes
+	if err = json.Unmarshal(data, &attrs); err != nil {
+		return nil, fmt.Errorf("N5 attributes for %s could not be decoded", path)
+	}
+	if len(attrs.Dimensions) != 3 || len(attrs.BlockSize) != 3 {
+		return nil, fmt.Errorf("N5 dataset %s must be 3D", path)
+	}
+	dtype, err := getLabelType(attrs.DataType, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := attrs.Compression.Type
+	if compression == "" {
+		compression = attrs.CompressionType
+	}
+	if compression == "gzip" && attrs.Compression.UseZlib {
+		compression = "zlib"
+	}
+	if err = checkCompression(path, compression); err != nil {
+		return nil, err
+	}
+
+	volume := &chunkedVolume{path: path}
+	copy(volume.size[:], attrs.Dimensions)
+	copy(volume.chunk[:], attrs.BlockSize)
+	if err = checkChunking(volume); err != nil {
+		return nil, err
+	}
+
+	volume.readChunk = func(coord [3]int) ([]uint64, [3]int, error) {
+		var chunksize [3]int
+		file, err := os.Open(filepath.Join(path, strconv.Itoa(coord[0]), strconv.Itoa(coord[1]), strconv.Itoa(coord[2])))
+		if os.IsNotExist(err) {
+			return nil, chunksize, nil
+		} else if err != nil {
+			return nil, chunksize, err
+		}
+		defer file.Close()
+
+		// the header holds the mode, number of dimensions, and the size of this block
+		var header [16]byte
+		if _, err = io.ReadFull(file, header[:]); err != nil {
+			return nil, chunksize, fmt.Errorf("block header is truncated")
+		}
+		mode, ndims := binary.BigEndian.Uint16(header[0:2]), binary.BigEndian.Uint16(header[2:4])
+		if ndims != 3 {
+			return nil, chunksize, fmt.Errorf("block has %d dimensions", ndims)
+		}
+		for i := range chunksize {
+			chunksize[i] = int(binary.BigEndian.Uint32(header[4+i*4:]))
+			if chunksize[i] > volume.chunk[i] {
+				return nil, chunksize, fmt.Errorf("block is larger than the block size")
+			}
+		}
+		if mode == 1 {
+			var numelements [4]byte
+			if _, err = io.ReadFull(file, numelements[:]); err != nil {
+				return nil, chunksize, fmt.Errorf("block header is truncated")
+			}
+		}
+
+		reader, err := decompress(file, compression)
+		if err != nil {
+			return nil, chunksize, err
+		}
+		labels, err := readLabels(reader, chunksize[0]*chunksize[1]*chunksize[2], dtype)
+		return labels, chunksize, err
+	}
+	return volume, nil
+}
+
+// zarrArray is the part of the zarr array metadata needed to read the chunks
+type zarrArray struct {
+	Shape      []int
+	Chunks     []int
+	Dtype      string
+	Order      string
+	FillValue  *json.Number `json:"fill_value"`
+	Compressor *struct {
+		ID string
+	}
+	DimensionSeparator string `json:"dimension_separator"`
+}
+
+// openZarr reads the metadata of a zarr (v2) array (C order arrays are indexed [z][y][x])
+func openZarr(path string) (*chunkedVolume, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, ".zarray"))
+	if err != nil {
+		return nil, fmt.Errorf("zarr metadata could not be read: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var array zarrArray
+	if err = decoder.Decode(&array); err != nil {
+		return nil, fmt.Errorf("zarr metadata for %s could not be decoded", path)
+	}
+	if len(array.Shape) != 3 || len(array.Chunks) != 3 {
+		return nil, fmt.Errorf("zarr array %s must be 3D", path)
+	}
+	if array.Order != "C" {
+		return nil, fmt.Errorf("zarr array %s must be in C order", path)
+	}
+	dtype, err := npyLabelType(array.Dtype)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := ""
+	if array.Compressor != nil {
+		compression = array.Compressor.ID
+	}
+	if err = checkCompression(path, compression); err != nil {
+		return nil, err
+	}
+	var fill uint64
+	if array.FillValue != nil {
+		if fill, err = strconv.ParseUint(string(*array.FillValue), 10, 64); err != nil {
+			return nil, fmt.Errorf("zarr array %s has an invalid fill value", path)
+		}
+	}
+	separator := array.DimensionSeparator
+	if separator == "" {
+		separator = "."
+	}
+
+	volume := &chunkedVolume{path: path}
+	volume.size = [3]int{array.Shape[2], array.Shape[1], array.Shape[0]}
+	volume.chunk = [3]int{array.Chunks[2], array.Chunks[1], array.Chunks[0]}
+	if err = checkChunking(volume); err != nil {
+		return nil, err
+	}
+
+	// zarr chunks always have the full chunk size (edge chunks are padded)
+	volume.readChunk = func(coord [3]int) ([]uint64, [3]int, error) {
+		chunksize := volume.chunk
+		key := strconv.Itoa(coord[2]) + separator + strconv.Itoa(coord[1]) + separator + strconv.Itoa(coord[0])
+		file, err := os.Open(filepath.Join(path, filepath.FromSlash(key)))
+		if os.IsNotExist(err) {
+			if fill == 0 {
+				return nil, chunksize, nil
+			}
+			labels := make([]uint64, chunksize[0]*chunksize[1]*chunksize[2])
+			for i := range labels {
+				labels[i] = fill
+			}
+			return labels, chunksize, nil
+		} else if err != nil {
+			return nil, chunksize, err
+		}
+		defer file.Close()
+
+		reader, err := decompress(file, compression)
+		if err != nil {
+			return nil, chunksize, err
+		}
+		labels, err := readLabels(reader, chunksize[0]*chunksize[1]*chunksize[2], dtype)
+		return labels, chunksize, err
+	}
+	return volume, nil
+}
+
+// checkChunking verifies the volume and chunk sizes
+func checkChunking(volume *chunkedVolume) error {
+	for i := range volume.size {
+		if volume.size[i] <= 0 || volume.chunk[i] <= 0 {
+			return fmt.Errorf("Chunked volume %s has invalid dimensions %v or chunk size %v", volume.path, volume.size, volume.chunk)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package overlap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/janelia-flyem/serviceproxy/register"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDiscoveryTTL is the time a looked up location is reused if not configured
+	DefaultDiscoveryTTL = 30 * time.Second
+	// dvidService is the name DVID is discovered under
+	dvidService = "dvid"
+	// serviceName is the name the service registers under
+	serviceName = "calcoverlap"
+	// discoveryTimeout bounds each lookup
+	discoveryTimeout = 10 * time.Second
+)
+
+// Discovery locates other services (such as DVID) and announces this service
+type Discovery interface {
+	// Lookup returns the location (host:port or URL) of a service
+	Lookup(service string) (string, error)
+	// Register announces the service at the address (host:port)
+	Register(service, address string) error
+	// Deregister withdraws the registered services
+	Deregister() error
+}
+
+// discovery finds DVID if a request does not name a server or backend (nil if not configured)
+var discovery Discovery
+
+// registration announces the service at startup and withdraws it on shutdown (nil if not configured)
+var registration Discovery
+
+// StaticDiscovery returns configured locations and registers nothing
+type StaticDiscovery struct {
+	locations map[string]string
+}
+
+// NewStaticDiscovery creates a discovery for the locations of each service
+func NewStaticDiscovery(locations map[string]string) *StaticDiscovery {
+	return &StaticDiscovery{locations}
+}
+
+// Lookup returns the configured location
+func (sd *StaticDiscovery) Lookup(service string) (string, error) {
+	location, found := sd.locations[service]
+	if !found {
+		return "", fmt.Errorf("No location configured for %s", service)
+	}
+	return location, nil
+}
+
+// Register does nothing since the locations are static
+func (sd *StaticDiscovery) Register(service, address string) error {
+	return nil
+}
+
+// Deregister does nothing since the locations are static
+func (sd *StaticDiscovery) Deregister() error {
+	return nil
+}
+
+// SRVDiscovery looks up the DNS SRV records _<service>._tcp.<domain> (the records are managed by the
+// cluster, so registering does nothing)
+type SRVDiscovery struct {
+	domain string
+}
+
+// NewSRVDiscovery creates a discovery for the SRV records of the domain
+func NewSRVDiscovery(domain string) *SRVDiscovery {
+	return &SRVDiscovery{domain}
+}
+
+// Lookup returns the target of the SRV record with the lowest priority (chosen by weight among equals)
+func (sd *SRVDiscovery) Lookup(service string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, service, "tcp", sd.domain)
+	if err != nil {
+		return "", fmt.Errorf("SRV record for %s could not be found: %v", service, err)
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("No SRV record for %s in %s", service, sd.domain)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(records[0].Target, "."), strconv.Itoa(int(records[0].Port))), nil
+}
+
+// Register does nothing since SRV records are managed by the DNS
+func (sd *SRVDiscovery) Register(service, address string) error {
+	return nil
+}
+
+// Deregister does nothing since SRV records are managed by the DNS
+func (sd *SRVDiscovery) Deregister() error {
+	return nil
+}
+
+// FileDiscovery reads the locations from a JSON file mapping each service to a list of addresses, which
+// is reread whenever it changes.  Registering adds the address of the service to the file.
+type FileDiscovery struct {
+	filename string
+	mutex    sync.Mutex
+	modtime  time.Time
+	size     int64
+	services map[string][]string
+	// addresses added by Register
+	registered map[string]string
+}
+
+// NewFileDiscovery creates a discovery for the file (which is created when the service registers)
+func NewFileDiscovery(filename string) *FileDiscovery {
+	return &FileDiscovery{filename: filename, registered: make(map[string]string)}
+}
+
+// reload rereads the file if it changed since it was last read (the caller must hold the lock)
+func (fd *FileDiscovery) reload() error {
+	info, err := os.Stat(fd.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fd.services = nil
+			return nil
+		}
+		return err
+	}
+	if fd.services != nil && info.ModTime().Equal(fd.modtime) && info.Size() == fd.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fd.filename)
+	if err != nil {
+		return err
+	}
+	var services map[string][]string
+	if err = json.Unmarshal(data, &services); err != nil {
+		return fmt.Errorf("Services in %s could not be decoded: %v", fd.filename, err)
+	}
+	fd.services = services
+	fd.modtime = info.ModTime()
+	fd.size = info.Size()
+	return nil
+}
+
+// Lookup returns the first address listed for the service
+func (fd *FileDiscovery) Lookup(service string) (string, error) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	if err := fd.reload(); err != nil {
+		return "", err
+	}
+	if len(fd.services[service]) == 0 {
+		return "", fmt.Errorf("No address for %s in %s", service, fd.filename)
+	}
+	return fd.services[service][0], nil
+}
+
+// update applies a change to the services and rewrites the file (replaced atomically so that readers
+// never see a partial file)
+func (fd *FileDiscovery) update(change func(services map[string][]string)) error {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	if err := fd.reload(); err != nil {
+		return err
+	}
+	services := make(map[string][]string)
+	for service, addresses := range fd.services {
+		services[service] = addresses
+	}
+	change(services)
+
+	data, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(filepath.Dir(fd.filename), filepath.Base(fd.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(data)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), fd.filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	fd.services = nil
+	return nil
+}
+
+// Register adds the address to the service in the file
+func (fd *FileDiscovery) Register(service, address string) error {
+	err := fd.update(func(services map[string][]string) {
+		services[service] = append(removeAddress(services[service], address), address)
+	})
+	if err == nil {
+		fd.mutex.Lock()
+		fd.registered[service] = address
+		fd.mutex.Unlock()
+	}
+	return err
+}
+
+// Deregister removes the registered addresses from the file
+func (fd *FileDiscovery) Deregister() error {
+	fd.mutex.Lock()
+	registered := fd.registered
+	fd.registered = make(map[string]string)
+	fd.mutex.Unlock()
+	if len(registered) == 0 {
+		return nil
+	}
+
+	return fd.update(func(services map[string][]string) {
+		for service, address := range registered {
+			services[service] = removeAddress(services[service], address)
+			if len(services[service]) == 0 {
+				delete(services, service)
+			}
+		}
+	})
+}
+
+// removeAddress returns the addresses without the given address
+func removeAddress(addresses []string, address string) []string {
+	var remaining []string
+	for _, val := range addresses {
+		if val != address {
+			remaining = append(remaining, val)
+		}
+	}
+	return remaining
+}
+
+// registryAgent announces a service to the serviceproxy registry and withdraws it
+type registryAgent interface {
+	RegisterService(registry string) error
+	Leave() error
+}
+
+// newRegistryAgent creates the agent of a service at a port (replaced in tests)
+var newRegistryAgent = func(service string, port int) registryAgent {
+	return serfAgent{register.NewAgent(service, port)}
+}
+
+// serfAgent is the serf agent of the serviceproxy, which has no way to leave the registry (the registry
+// drops the service once the agent stops responding after the process exits)
+type serfAgent struct {
+	*register.SerfAgent
+}
+
+// Leave reports that the serf agent cannot deregister
+func (agent serfAgent) Leave() error {
+	return fmt.Errorf("deregistration not supported by the serviceproxy serf agent")
+}
+
+// ProxyDiscovery finds services through the serviceproxy http server and registers with its serf registry
+type ProxyDiscovery struct {
+	proxy    string
+	registry string
+	client   *http.Client
+	// agent of the registered service (nil until registered)
+	mutex sync.Mutex
+	agent registryAgent
+}
+
+// NewProxyDiscovery creates a discovery for the serviceproxy server and registry (either may be empty)
+func NewProxyDiscovery(proxy, registry string) *ProxyDiscovery {
+	return &ProxyDiscovery{proxy: proxy, registry: registry, client: &http.Client{Timeout: discoveryTimeout}}
+}
+
+// Lookup returns the service location reported by the proxy
+func (pd *ProxyDiscovery) Lookup(service string) (string, error) {
+	if pd.proxy == "" {
+		return "", fmt.Errorf("No proxy server location exists")
+	}
+	resp, err := pd.client.Get("http://" + pd.proxy + "/services/" + service + "/node")
+	if err != nil {
+		return "", fmt.Errorf("%s server not found at proxy", service)
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	node := make(map[string]interface{})
+	if err = decoder.Decode(&node); err != nil {
+		return "", fmt.Errorf("Error decoding JSON from proxy server")
+	}
+	location, found := node["service-location"].(string)
+	if !found {
+		return "", fmt.Errorf("No service location found for %s", service)
+	}
+	return location, nil
+}
+
+// Register starts an agent for the service that joins the registry
+func (pd *ProxyDiscovery) Register(service, address string) error {
+	if pd.registry == "" {
+		return nil
+	}
+	_, portstr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return err
+	}
+	agent := newRegistryAgent(service, port)
+	if err = agent.RegisterService(pd.registry); err != nil {
+		return err
+	}
+	pd.mutex.Lock()
+	pd.agent = agent
+	pd.mutex.Unlock()
+	return nil
+}
+
+// Deregister makes the agent of the registered service leave the registry
+func (pd *ProxyDiscovery) Deregister() error {
+	pd.mutex.Lock()
+	agent := pd.agent
+	pd.agent = nil
+	pd.mutex.Unlock()
+	if agent == nil {
+		return nil
+	}
+	return agent.Leave()
+}
+
+// cachedDiscovery reuses looked up locations for a time (and the last location if a lookup fails)
+type cachedDiscovery struct {
+	Discovery
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]discoveryEntry
+}
+
+// discoveryEntry is a looked up location
+type discoveryEntry struct {
+	location string
+	expires  time.Time
+}
+
+// newCachedDiscovery wraps a discovery with a cache of its lookups
+func newCachedDiscovery(inner Discovery, ttl time.Duration) *cachedDiscovery {
+	return &cachedDiscovery{Discovery: inner, ttl: ttl, entries: make(map[string]discoveryEntry)}
+}
+
+// Lookup returns the cached location until it expires
+func (cd *cachedDiscovery) Lookup(service string) (string, error) {
+	cd.mutex.Lock()
+	entry, found := cd.entries[service]
+	cd.mutex.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		return entry.location, nil
+	}
+
+	location, err := cd.Discovery.Lookup(service)
+	if err != nil {
+		if found {
+			fmt.Printf("Lookup of %s failed, using %s: %v\n", service, entry.location, err)
+			return entry.location, nil
+		}
+		return "", err
+	}
+	cd.mutex.Lock()
+	cd.entries[service] = discoveryEntry{location, time.Now().Add(cd.ttl)}
+	cd.mutex.Unlock()
+	return location, nil
+}
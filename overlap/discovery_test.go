@@ -0,0 +1,156 @@
+package overlap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readServices decodes the services of a discovery file
+func readServices(t *testing.T, filename string) map[string][]string {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services map[string][]string
+	if err = json.Unmarshal(data, &services); err != nil {
+		t.Fatalf("Services could not be decoded: %s", data)
+	}
+	return services
+}
+
+func TestFileDiscovery(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "services.json")
+	fd := NewFileDiscovery(filename)
+	if _, err := fd.Lookup(dvidService); err == nil {
+		t.Fatalf("Lookup succeeded without the file")
+	}
+
+	os.WriteFile(filename, []byte(`{"dvid": ["emdata1:8000", "emdata2:8000"]}`), 0644)
+	if location, err := fd.Lookup(dvidService); err != nil || location != "emdata1:8000" {
+		t.Fatalf("Lookup returned %s (%v)", location, err)
+	}
+	if err := fd.Register("calcoverlap", "host:25123"); err != nil {
+		t.Fatal(err)
+	}
+	if services := readServices(t, filename); len(services["dvid"]) != 2 || len(services["calcoverlap"]) != 1 {
+		t.Fatalf("Registration changed the services to %v", services)
+	}
+
+	// the file is reread once it changes
+	os.WriteFile(filename, []byte(`{"dvid": ["emdata3:8000"], "calcoverlap": ["host:25123", "other:25123"]}`), 0644)
+	if location, _ := fd.Lookup(dvidService); location != "emdata3:8000" {
+		t.Fatalf("Changed file was not reread (%s)", location)
+	}
+
+	// only the registered address is removed
+	if err := fd.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	services := readServices(t, filename)
+	if len(services["calcoverlap"]) != 1 || services["calcoverlap"][0] != "other:25123" || len(services["dvid"]) != 1 {
+		t.Fatalf("Deregistration changed the services to %v", services)
+	}
+}
+
+func TestProxyDiscovery(t *testing.T) {
+	var mutex sync.Mutex
+	calls := 0
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls += 1
+		call := calls
+		mutex.Unlock()
+		if r.URL.Path != "/services/dvid/node" || call > 1 {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"service-location": "located:9000"}`))
+	}))
+	defer proxy.Close()
+
+	// the last location is used while the proxy fails
+	cd := newCachedDiscovery(NewProxyDiscovery(strings.TrimPrefix(proxy.URL, "http://"), ""), time.Millisecond)
+	useDiscovery(t, cd)
+	if server, err := getDVIDserver(map[string]interface{}{}); err != nil || server != "http://located:9000" {
+		t.Fatalf("Discovered server is %s (%v)", server, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if server, err := getDVIDserver(map[string]interface{}{}); err != nil || server != "http://located:9000" || calls != 2 {
+		t.Fatalf("Last location was not used after a failed lookup (%s, %v, %d lookups)", server, err, calls)
+	}
+	if !trustedServer("http://located:9000/api") {
+		t.Fatalf("Discovered server is not trusted")
+	}
+
+	if _, err := NewProxyDiscovery("", "").Lookup(dvidService); err == nil {
+		t.Fatalf("Lookup succeeded without a proxy")
+	}
+	useDiscovery(t, NewStaticDiscovery(map[string]string{}))
+	if _, err := getDVIDserver(map[string]interface{}{}); err == nil {
+		t.Fatalf("Server was located without a location")
+	}
+}
+
+func TestProxyRegistration(t *testing.T) {
+	// registration is skipped without a registry and leaving is skipped without a registration
+	pd := NewProxyDiscovery("proxy:80", "")
+	if err := pd.Register("calcoverlap", "host:25123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pd.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProxyDiscovery("", "registry:7946").Register("calcoverlap", "no port"); err == nil {
+		t.Fatalf("Address without a port was registered")
+	}
+}
+
+// fakeAgent records the registration and departure of a service
+type fakeAgent struct {
+	registry string
+	left     bool
+}
+
+func (agent *fakeAgent) RegisterService(registry string) error {
+	agent.registry = registry
+	return nil
+}
+
+func (agent *fakeAgent) Leave() error {
+	agent.left = true
+	return nil
+}
+
+func TestProxyDeregistration(t *testing.T) {
+	agent := &fakeAgent{}
+	defer func(saved func(string, int) registryAgent) { newRegistryAgent = saved }(newRegistryAgent)
+	newRegistryAgent = func(service string, port int) registryAgent {
+		return agent
+	}
+
+	// the registered agent leaves the registry once
+	pd := NewProxyDiscovery("", "registry:7946")
+	if err := pd.Register("calcoverlap", "host:25123"); err != nil || agent.registry != "registry:7946" {
+		t.Fatalf("Service was not registered (%v)", err)
+	}
+	if err := pd.Deregister(); err != nil || !agent.left {
+		t.Fatalf("Service did not leave the registry (%v)", err)
+	}
+	agent.left = false
+	if err := pd.Deregister(); err != nil || agent.left {
+		t.Fatalf("Service left the registry again (%v)", err)
+	}
+
+	// the serf agent cannot leave
+	if err := (serfAgent{}).Leave(); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatalf("Serf agent deregistration returned %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package overlap
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCachePath is the URI to inspect and purge the disk cache
+const diskCachePath = "/diskcache/"
+
+// buckets of the disk cache (keys start with the uuid so that a node can be purged by prefix)
+var (
+	bodiesBucket  = []byte("bodies")
+	resultsBucket = []byte("results")
+	lockedBucket  = []byte("locked")
+)
+
+// diskCache persists bodies (and optionally results) from locked DVID nodes, which never change
+type diskCache struct {
+	db *bolt.DB
+	// cache the overlap and stats results in addition to the bodies
+	results bool
+	// locked nodes already checked (by uuid and server)
+	mutex  sync.Mutex
+	locked map[string]bool
+}
+
+// diskcache holds bodies from locked nodes across restarts (nil if not configured)
+var diskcache *diskCache
+
+// adminAuthorization is the Authorization header that purges of the disk cache must carry (purges are
+// refused if empty)
+var adminAuthorization string
+
+// openDiskCache opens (or creates) the cache database
+func openDiskCache(filename string, results bool) (*diskCache, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bodiesBucket, resultsBucket, lockedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &diskCache{db: db, results: results, locked: make(map[string]bool)}, nil
+}
+
+// cacheKey joins the parts of a key (the uuid first)
+func cacheKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\x00") + "\x00")
+}
+
+// isLocked checks whether the node is locked in DVID (locked nodes are remembered in the cache)
+func (dc *diskCache) isLocked(ctx context.Context, dvidserver, uuid string) bool {
+	key := cacheKey(uuid, dvidserver)
+	dc.mutex.Lock()
+	locked := dc.locked[string(key)]
+	dc.mutex.Unlock()
+	if locked {
+		return true
+	}
+
+	dc.db.View(func(tx *bolt.Tx) error {
+		locked = tx.Bucket(lockedBucket).Get(key) != nil
+		return nil
+	})
+	if !locked {
+		var status struct {
+			Locked bool
+		}
+		if err := dvid.getJSON(ctx, dvidserver+"/api/node/"+uuid+"/commit", &status); err != nil || !status.Locked {
+			return false
+		}
+		dc.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(lockedBucket).Put(key, []byte{1})
+		})
+	}
+
+	dc.mutex.Lock()
+	dc.locked[string(key)] = true
+	dc.mutex.Unlock()
+	return true
+}
+
+// diskKey returns the disk key of a body (the body id is big endian so the bodies of a query are adjacent)
+func (key bodyKey) diskKey() []byte {
+	var idbuf [8]byte
+	binary.BigEndian.PutUint64(idbuf[:], key.bodyID)
+	return append(cacheKey(key.uuid, key.dvidserver, key.instance, key.query, key.credential), idbuf[:]...)
+}
+
+// getBody reads a stored body
+func (dc *diskCache) getBody(key bodyKey) (sparse_body SparseBody, found bool) {
+	dc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bodiesBucket).Get(key.diskKey())
+		if data == nil {
+			return nil
+		}
+		var err error
+		sparse_body, err = decodeSparsevol(bytes.NewReader(data), key.bodyID)
+		found = err == nil
+		return nil
+	})
+	return
+}
+
+// putBody stores a body as a DVID sparse volume (the bodies stored by concurrent fetches are written
+// in one transaction)
+func (dc *diskCache) putBody(key bodyKey, sparse_body SparseBody) {
+	data := encodeSparsevol(sparse_body)
+	dc.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(bodiesBucket).Put(key.diskKey(), data)
+	})
+}
+
+// encodeSparsevol writes the RLE of a body in the DVID sparse volume format
+func encodeSparsevol(sparse_body SparseBody) []byte {
+	data := make([]byte, sparsevolHeaderSize+len(sparse_body.rle)*spanSize)
+	data[1] = 3
+	binary.LittleEndian.PutUint32(data[8:12], uint32(len(sparse_body.rle)))
+	pos := sparsevolHeaderSize
+	for _, chunk := range sparse_body.rle {
+		binary.LittleEndian.PutUint32(data[pos:], uint32(chunk.x))
+		binary.LittleEndian.PutUint32(data[pos+4:], uint32(chunk.y))
+		binary.LittleEndian.PutUint32(data[pos+8:], uint32(chunk.z))
+		binary.LittleEndian.PutUint32(data[pos+12:], uint32(chunk.length))
+		pos += spanSize
+	}
+	return data
+}
+
+// resultRecorder keeps a copy of a successful response so that it can be stored
+type resultRecorder struct {
+	http.ResponseWriter
+	status int
+	data   bytes.Buffer
+}
+
+func (rec *resultRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *resultRecorder) Write(data []byte) (int, error) {
+	rec.data.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+// lockedNode checks whether the request reads its bodies from a locked DVID node (always false without
+// the disk cache)
+func lockedNode(ctx context.Context, json_data map[string]interface{}) bool {
+	if diskcache == nil || bodySource != nil {
+		return false
+	}
+	uuid, found := json_data["uuid"].(string)
+	if !found {
+		return false
+	}
+	dvidserver, err := getDVIDserver(json_data)
+	return err == nil && diskcache.isLocked(ctx, dvidserver, uuid)
+}
+
+// cachedResponse writes the stored result of a request for bodies from a locked DVID node and returns true
+// if there is one.  Otherwise it returns the writer for the response and a function that stores the result.
+func cachedResponse(ctx context.Context, w http.ResponseWriter, path string, json_data map[string]interface{}) (http.ResponseWriter, func(), bool) {
+	nostore := func() {}
+	if !diskcache.results {
+		return w, nostore, false
+	}
+	uuid := json_data["uuid"].(string)
+	dvidserver, err := getDVIDserver(json_data)
+	if err != nil {
+		return w, nostore, false
+	}
+
+	// the request (with sorted keys), the default instance, and the credential identify the result (credentials
+	// are not stored)
+	keydata := make(map[string]interface{})
+	for field, val := range json_data {
+		if field != "authorization" {
+			keydata[field] = val
+		}
+	}
+	request, err := json.Marshal(keydata)
+	if err != nil {
+		return w, nostore, false
+	}
+	key := cacheKey(uuid, dvidserver, path, defaultInstance, credentialID(ctx), string(request))
+
+	var result []byte
+	diskcache.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(resultsBucket).Get(key); data != nil {
+			result = append([]byte{}, data...)
+		}
+		return nil
+	})
+	if result != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+		return w, nostore, true
+	}
+
+	rec := &resultRecorder{ResponseWriter: w, status: http.StatusOK}
+	store := func() {
+		if rec.status != http.StatusOK || rec.data.Len() == 0 {
+			return
+		}
+		// partial results (missing the bodies that could not be fetched) are computed again
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(rec.data.Bytes(), &fields) != nil {
+			return
+		}
+		if _, partial := fields["failed-bodies"]; partial {
+			return
+		}
+		diskcache.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(resultsBucket).Put(key, rec.data.Bytes())
+		})
+	}
+	return rec, store, false
+}
+
+// diskCacheStats reports the contents of the disk cache
+type diskCacheStats struct {
+	Bodies      int   `json:"bodies"`
+	Results     int   `json:"results"`
+	LockedNodes int   `json:"locked-nodes"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// stats counts the entries (for keys starting with the prefix if given)
+func (dc *diskCache) stats(prefix []byte) (stats diskCacheStats) {
+	dc.db.View(func(tx *bolt.Tx) error {
+		counts := []*int{&stats.Bodies, &stats.Results, &stats.LockedNodes}
+		for i, name := range [][]byte{bodiesBucket, resultsBucket, lockedBucket} {
+			cursor := tx.Bucket(name).Cursor()
+			for key, val := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, val = cursor.Next() {
+				*counts[i] += 1
+				stats.Bytes += int64(len(key) + len(val))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// purge deletes the entries (for keys starting with the prefix if given)
+func (dc *diskCache) purge(prefix []byte) error {
+	err := dc.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bodiesBucket, resultsBucket, lockedBucket} {
+			cursor := tx.Bucket(name).Cursor()
+			for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Seek(prefix) {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	dc.mutex.Lock()
+	for key := range dc.locked {
+		if strings.HasPrefix(key, string(prefix)) {
+			delete(dc.locked, key)
+		}
+	}
+	dc.mutex.Unlock()
+	return err
+}
+
+// diskCacheHandler reports the contents of the disk cache (GET) or purges it (DELETE) for all nodes
+// or for the uuid given as /diskcache/<uuid>.  A purge must carry the configured admin Authorization header.
+func diskCacheHandler(w http.ResponseWriter, r *http.Request) {
+	pathlist, requestType, err := parseURI(r, diskCachePath)
+	if err != nil || len(pathlist) > 1 {
+		badRequest(w, "Error: incorrectly formatted request")
+		return
+	}
+	if diskcache == nil {
+		badRequest(w, "Disk cache is not enabled")
+		return
+	}
+
+	var prefix []byte
+	if len(pathlist) == 1 {
+		prefix = cacheKey(pathlist[0])
+	}
+
+	switch requestType {
+	case "get":
+		w.Header().Set("Content-Type", "application/json")
+		jsondata, _ := json.Marshal(diskcache.stats(prefix))
+		w.Write(jsondata)
+	case "delete":
+		if !checkAuthorization(w, r, adminAuthorization) {
+			return
+		}
+		if err = diskcache.purge(prefix); err != nil {
+			http.Error(w, fmt.Sprintf("Disk cache could not be purged: %v", err), http.StatusInternalServerError)
+		}
+	default:
+		badRequest(w, "only supports gets and deletes")
+	}
+}
+
+// checkAuthorization writes 401 if the request has no Authorization header or 403 if it is not the
+// configured header (or none is configured) and returns whether the request may proceed
+func checkAuthorization(w http.ResponseWriter, r *http.Request, authorization string) bool {
+	if !requireAuthorization(w, r) {
+		return false
+	}
+	header := r.Header.Get("Authorization")
+	if authorization == "" || subtle.ConstantTimeCompare([]byte(header), []byte(authorization)) != 1 {
+		fmt.Printf("Rejected %s %s with the wrong authorization from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "Authorization header is not accepted", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireAuthorization writes 401 if the request has no Authorization header and returns whether it has one
+func requireAuthorization(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") == "" {
+		fmt.Printf("Rejected %s %s without authorization from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "Authorization header is required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package overlap
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useDiskCache opens a disk cache in a temporary directory (without the memory cache) until the test ends
+// and returns its filename
+func useDiskCache(t *testing.T, results bool) string {
+	filename := filepath.Join(t.TempDir(), "cache.db")
+	var err error
+	if diskcache, err = openDiskCache(filename, results); err != nil {
+		t.Fatal(err)
+	}
+	useCache(t, nil)
+	t.Cleanup(func() {
+		diskcache.db.Close()
+		diskcache = nil
+	})
+	return filename
+}
+
+// reopenDiskCache closes and opens the disk cache as a restart would
+func reopenDiskCache(t *testing.T, filename string, results bool) {
+	diskcache.db.Close()
+	var err error
+	if diskcache, err = openDiskCache(filename, results); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// diskCacheContents returns the stats of the disk cache handler for the path
+func diskCacheContents(t *testing.T, path string) diskCacheStats {
+	t.Helper()
+	w := httptest.NewRecorder()
+	diskCacheHandler(w, httptest.NewRequest("GET", path, nil))
+	var stats diskCacheStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Disk cache stats could not be decoded: %s", w.Body.String())
+	}
+	return stats
+}
+
+func TestDiskCacheBodies(t *testing.T) {
+	dvidserver := newFakeDVID()
+	dvidserver.locked = true
+	address := dvidserver.start(t)
+	filename := useDiskCache(t, false)
+
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", ""), 200, `{"overlap-list":[[1,2,1]]}`)
+	reopenDiskCache(t, filename, false)
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", ""), 200, `{"overlap-list":[[1,2,1]]}`)
+	checkHandler(t, bodystatsPath, dvidRequest(address, "[1,2]", ""), 200, `{"body-stats":[[2,3,14],[1,2,10]]}`)
+	if fetched := len(dvidserver.requested("/sparsevol/")); fetched != 2 {
+		t.Fatalf("Stored bodies were fetched again (%d fetches)", fetched)
+	}
+	if commits := len(dvidserver.requested("/commit")); commits != 1 {
+		t.Fatalf("Lock of the node was checked %d times", commits)
+	}
+	if stats := diskCacheContents(t, diskCachePath); stats.Bodies != 2 || stats.Results != 0 || stats.LockedNodes != 1 {
+		t.Fatalf("Disk cache holds %+v", stats)
+	}
+
+	// bodies from unlocked nodes are not stored
+	dvidserver.locked = false
+	checkHandlerStatus(t, overlapPath, strings.Replace(dvidRequest(address, "[1,2]", ""), "abc", "def", 1), 200)
+	if stats := diskCacheContents(t, diskCachePath+"def"); stats.Bodies != 0 || stats.LockedNodes != 0 {
+		t.Fatalf("Disk cache holds %+v for an unlocked node", stats)
+	}
+}
+
+func TestDiskCacheResults(t *testing.T) {
+	dvidserver := newFakeDVID()
+	dvidserver.locked = true
+	address := dvidserver.start(t)
+	useDiskCache(t, true)
+
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", ""), 200, `{"overlap-list":[[1,2,1]]}`)
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", ""), 200, `{"overlap-list":[[1,2,1]]}`)
+	if fetched := len(dvidserver.requested("/sparsevol/")); fetched != 2 {
+		t.Fatalf("Stored result was not used (%d fetches)", fetched)
+	}
+	// results with failed bodies are computed again
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2,3]", ""), 200)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2,3]", ""), 200)
+	if fetched := len(dvidserver.requested("/sparsevol/3")); fetched != 2 {
+		t.Fatalf("Result with a failed body was stored (%d fetches)", fetched)
+	}
+	// the lock of an unlocked node is checked once for each request
+	dvidserver.locked = false
+	checkHandlerStatus(t, overlapPath, strings.Replace(dvidRequest(address, "[1,2]", ""), "abc", "def", 1), 200)
+	if commits := len(dvidserver.requested("/def/commit")); commits != 1 {
+		t.Fatalf("Lock of an unlocked node was checked %d times", commits)
+	}
+	// results are stored for each credential
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", `"authorization":"Bearer other"`), 200, `{"overlap-list":[[1,2,1]]}`)
+	if stats := diskCacheContents(t, diskCachePath+"abc"); stats.Results != 2 || stats.Bodies != 4 {
+		t.Fatalf("Disk cache holds %+v", stats)
+	}
+
+	// mutations evict the bodies and the results that use them
+	evictLabels("abc", []uint64{2})
+	if stats := diskCacheContents(t, diskCachePath+"abc"); stats.Results != 0 || stats.Bodies != 2 {
+		t.Fatalf("Disk cache holds %+v after eviction", stats)
+	}
+
+	// purges need the admin authorization
+	defer func(saved string) { adminAuthorization = saved }(adminAuthorization)
+	adminAuthorization = "Bearer admin"
+	purges := []struct {
+		header string
+		status int
+	}{{"", 401}, {"Bearer admin2", 403}, {"Bearer admin", 200}}
+	for _, purge := range purges {
+		r := httptest.NewRequest("DELETE", diskCachePath+"abc", nil)
+		if purge.header != "" {
+			r.Header.Set("Authorization", purge.header)
+		}
+		w := httptest.NewRecorder()
+		diskCacheHandler(w, r)
+		if w.Code != purge.status {
+			t.Fatalf("Purge with authorization %q returned %d", purge.header, w.Code)
+		}
+		if stats := diskCacheContents(t, diskCachePath); purge.status != 200 && stats.Bodies != 2 {
+			t.Fatalf("Disk cache holds %+v after a rejected purge", stats)
+		}
+	}
+	if stats := diskCacheContents(t, diskCachePath); stats != (diskCacheStats{}) {
+		t.Fatalf("Disk cache holds %+v after purge", stats)
+	}
+}
+
+func TestDiskCacheConcurrentPuts(t *testing.T) {
+	useDiskCache(t, false)
+	body := func(bodyid uint64) SparseBody {
+		return NewSparseBody(bodyid, []Span{{X: int32(bodyid), Y: 1, Z: 2, Length: 3}})
+	}
+
+	// bodies stored at once by the fetch workers are all kept
+	var wg sync.WaitGroup
+	for bodyid := uint64(1); bodyid <= 20; bodyid += 1 {
+		wg.Add(1)
+		go func(bodyid uint64) {
+			defer wg.Done()
+			diskcache.putBody(testKey("abc", bodyid), body(bodyid))
+		}(bodyid)
+	}
+	wg.Wait()
+
+	if stats := diskCacheContents(t, diskCachePath+"abc"); stats.Bodies != 20 {
+		t.Fatalf("Disk cache holds %+v after concurrent puts", stats)
+	}
+	for bodyid := uint64(1); bodyid <= 20; bodyid += 1 {
+		sparse_body, found := diskcache.getBody(testKey("abc", bodyid))
+		if !found || !reflect.DeepEqual(sparse_body, body(bodyid)) {
+			t.Fatalf("Body %d was not stored", bodyid)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package overlap
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultDVIDTimeout is the time allowed for each request to DVID (including reading the response)
+	DefaultDVIDTimeout = 2 * time.Minute
+	// DefaultDVIDRetries is the number of times a failed request to DVID is retried
+	DefaultDVIDRetries = 3
+	// DefaultRequestDeadline is the time allowed for all of the DVID requests made for a service call
+	DefaultRequestDeadline = 10 * time.Minute
+	// dvidBackoff is the delay before the first retry (doubled for each later retry)
+	dvidBackoff = 500 * time.Millisecond
+)
+
+// dvidClient issues requests to DVID with timeouts and retries
+type dvidClient struct {
+	httpclient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+// dvidStatusError reports a response from DVID other than 200 OK or 204 No Content
+type dvidStatusError struct {
+	url    string
+	status int
+}
+
+func (e *dvidStatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.url, e.status)
+}
+
+// dvid is the client used for all requests to DVID
+var dvid = &dvidClient{&http.Client{Timeout: DefaultDVIDTimeout}, DefaultDVIDRetries, dvidBackoff}
+
+// requestDeadline bounds the time spent fetching data from DVID for a service call
+var requestDeadline = DefaultRequestDeadline
+
+// dvidAuthorization is the Authorization header sent to DVID if a request does not provide one
+var dvidAuthorization string
+
+// forwardAuthorization sends the caller's Authorization header to DVID
+var forwardAuthorization bool
+
+// authorizationKey is the context key for the Authorization header of a service call
+type authorizationKey struct{}
+
+// requestContext returns the context for the DVID requests of a service call along with the Authorization
+// header to send
+func requestContext(r *http.Request, json_data map[string]interface{}) (context.Context, context.CancelFunc) {
+	return serviceContext(r.Context(), callAuthorization(r, json_data), r.RemoteAddr, requestDeadline)
+}
+
+// callAuthorization returns the Authorization header to send to DVID for a service call (from "authorization"
+// in the request, the caller's header if forwarded, or the configured header)
+func callAuthorization(r *http.Request, json_data map[string]interface{}) string {
+	authorization := dvidAuthorization
+	if forwardAuthorization && r.Header.Get("Authorization") != "" {
+		authorization = r.Header.Get("Authorization")
+	}
+	if val, found := json_data["authorization"].(string); found {
+		authorization = val
+	}
+	return authorization
+}
+
+// serviceContext bounds the DVID requests of a service call by the deadline (none if 0) and keeps the
+// Authorization header and the address of the caller
+func serviceContext(parent context.Context, authorization, caller string, deadline time.Duration) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(parent, authorizationKey{}, authorization)
+	ctx = context.WithValue(ctx, remoteAddrKey{}, caller)
+	if deadline <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, deadline)
+}
+
+// contextAuthorization returns the Authorization header of the service call (the configured header if the
+// context has none)
+func contextAuthorization(ctx context.Context) string {
+	authorization, found := ctx.Value(authorizationKey{}).(string)
+	if !found {
+		authorization = dvidAuthorization
+	}
+	return authorization
+}
+
+// credentialID identifies the Authorization header of the service call so that the cached bodies and results
+// read with one credential are not returned to callers with another (the header itself is not kept, and
+// the id is empty without a header)
+func credentialID(ctx context.Context) string {
+	return hashAuthorization(contextAuthorization(ctx))
+}
+
+// hashAuthorization returns the hex SHA-256 of an Authorization header (empty for an empty header)
+func hashAuthorization(authorization string) string {
+	if authorization == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:])
+}
+
+// setCABundle trusts the certificates in a PEM file (in place of the system roots) for https DVID servers
+func (client *dvidClient) setCABundle(filename string) error {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No certificates found in %s", filename)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	client.httpclient.Transport = transport
+	return nil
+}
+
+// cancelBody releases the context of a response when its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// get issues a GET to DVID and, if the server cannot be read, fails over to the other servers of its
+// backend (the caller must close the body of the response, which is empty for 204 No Content)
+func (client *dvidClient) get(ctx context.Context, url string) (*http.Response, error) {
+	servers, path := failoverServers(url)
+	if servers == nil {
+		resp, _, err := client.getServer(ctx, url, client.retries)
+		return resp, err
+	}
+
+	// each server has an equal share of the time left and only the last server is retried, so the next
+	// server is tried after the first timeout or 5xx response
+	var lasterr error
+	for i, server := range servers {
+		if ctx.Err() != nil && lasterr != nil {
+			break
+		}
+		serverctx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, found := ctx.Deadline(); found {
+			serverctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(servers)-i))
+		}
+		retries := 0
+		if i == len(servers)-1 {
+			retries = client.retries
+		}
+
+		resp, failed, err := client.getServer(serverctx, server+path, retries)
+		if !failed {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			health.recovered(server)
+			resp.Body = &cancelBody{resp.Body, cancel}
+			return resp, nil
+		}
+		cancel()
+		fmt.Printf("DVID server %s failed: %v\n", server, err)
+		health.failed(server)
+		lasterr = err
+	}
+	return nil, lasterr
+}
+
+// getServer issues a GET to one DVID server and retries with exponential backoff after connection errors
+// and 5xx responses (failed is set if the server kept failing or could not be read before the deadline)
+func (client *dvidClient) getServer(ctx context.Context, url string, retries int) (*http.Response, bool, error) {
+	var lasterr error
+	for attempt := 0; attempt <= retries; attempt += 1 {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, true, fmt.Errorf("Request deadline exceeded before %s could be read (%v)", url, lasterr)
+			case <-time.After(client.backoff << uint(attempt-1)):
+			}
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, false, fmt.Errorf("Invalid DVID request %s", url)
+		}
+		// the configured header is only sent to the configured and discovered servers
+		authorization := contextAuthorization(ctx)
+		if authorization == dvidAuthorization && !trustedServer(url) {
+			authorization = ""
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := client.httpclient.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, true, fmt.Errorf("Request deadline exceeded reading %s", url)
+			}
+			lasterr = fmt.Errorf("%s could not be read: %v", url, err)
+			continue
+		}
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
+			return resp, false, nil
+		}
+
+		resp.Body.Close()
+		lasterr = &dvidStatusError{url, resp.StatusCode}
+		if resp.StatusCode < 500 {
+			return nil, false, lasterr
+		}
+	}
+	return nil, true, lasterr
+}
+
+// getJSON issues a GET to DVID and decodes the JSON response into value
+func (client *dvidClient) getJSON(ctx context.Context, url string, value interface{}) error {
+	resp, err := client.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// value is left unchanged if DVID has no content
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	decoder := json.NewDecoder(resp.Body)
+	if err = decoder.Decode(value); err != nil {
+		return fmt.Errorf("JSON from %s could not be decoded", url)
+	}
+	return nil
+}
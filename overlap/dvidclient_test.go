@@ -0,0 +1,241 @@
+package overlap
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient is a DVID client without a timeout that retries quickly
+func testClient(retries int) *dvidClient {
+	return &dvidClient{&http.Client{}, retries, time.Millisecond}
+}
+
+// useClient sets the DVID client and the authorization settings until the test ends
+func useClient(t *testing.T, client *dvidClient) {
+	saved := dvid
+	dvid = client
+	t.Cleanup(func() {
+		dvid = saved
+		dvidAuthorization = ""
+		forwardAuthorization = false
+	})
+}
+
+// headerRecorder is a DVID server that records the Authorization header of each request and answers {}
+type headerRecorder struct {
+	mutex   sync.Mutex
+	headers []string
+}
+
+func (recorder *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recorder.mutex.Lock()
+	recorder.headers = append(recorder.headers, r.Header.Get("Authorization"))
+	recorder.mutex.Unlock()
+	w.Write([]byte(`{}`))
+}
+
+// last returns the Authorization header of the last request
+func (recorder *headerRecorder) last() string {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if len(recorder.headers) == 0 {
+		return "(none)"
+	}
+	return recorder.headers[len(recorder.headers)-1]
+}
+
+// failingServer fails the first requests with 503 and then answers [1,2]
+func failingServer(failures int) (*httptest.Server, *int) {
+	var mutex sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls += 1
+		call := calls
+		mutex.Unlock()
+		if call <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[1,2]`))
+	}))
+	return server, &calls
+}
+
+func TestGetRetries(t *testing.T) {
+	server, calls := failingServer(2)
+	defer server.Close()
+
+	var values []int
+	if err := testClient(3).getJSON(context.Background(), server.URL, &values); err != nil || len(values) != 2 {
+		t.Fatalf("Request failed after retries: %v %v", err, values)
+	}
+	if *calls != 3 {
+		t.Fatalf("Server was called %d times instead of 3", *calls)
+	}
+
+	// without retries the first 5xx response fails the request
+	server2, calls2 := failingServer(1)
+	defer server2.Close()
+	if err := testClient(0).getJSON(context.Background(), server2.URL, &values); err == nil || *calls2 != 1 {
+		t.Fatalf("Request without retries returned %v after %d calls", err, *calls2)
+	}
+
+	// 4xx responses are not retried
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	if err := testClient(3).getJSON(context.Background(), missing.URL, &values); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Missing resource returned %v", err)
+	}
+}
+
+func TestGetDeadline(t *testing.T) {
+	server, _ := failingServer(100)
+	defer server.Close()
+
+	client := testClient(5)
+	client.backoff = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var values []int
+	err := client.getJSON(ctx, server.URL, &values)
+	if err == nil || !strings.Contains(err.Error(), "deadline") {
+		t.Fatalf("Request past its deadline returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Request past its deadline took %v", elapsed)
+	}
+}
+
+func TestGetNoContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	values := []int{3}
+	if err := testClient(0).getJSON(context.Background(), server.URL, &values); err != nil || len(values) != 1 {
+		t.Fatalf("No content returned %v %v", err, values)
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	recorder := &headerRecorder{}
+	server := httptest.NewTLSServer(recorder)
+	defer server.Close()
+	useClient(t, testClient(0))
+
+	var value map[string]interface{}
+	if err := dvid.getJSON(context.Background(), server.URL, &value); err == nil {
+		t.Fatalf("Certificate of the server was trusted without the CA bundle")
+	}
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dvid.setCABundle(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if err := dvid.getJSON(context.Background(), server.URL, &value); err != nil {
+		t.Fatalf("Certificate of the server was not trusted with the CA bundle: %v", err)
+	}
+
+	if err := os.WriteFile(bundle, []byte("no certificates"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dvid.setCABundle(bundle); err == nil {
+		t.Fatalf("CA bundle without certificates was accepted")
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	recorder := &headerRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	useClient(t, testClient(0))
+
+	// fetch uses the Authorization header of a service call with the caller's header and request
+	fetch := func(header string, json_data map[string]interface{}) string {
+		r := httptest.NewRequest("POST", overlapPath, nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		ctx, cancel := requestContext(r, json_data)
+		defer cancel()
+		var value map[string]interface{}
+		if err := dvid.getJSON(ctx, server.URL+"/api", &value); err != nil {
+			t.Fatal(err)
+		}
+		return recorder.last()
+	}
+
+	if header := fetch("Bearer caller", map[string]interface{}{}); header != "" {
+		t.Fatalf("Header was sent without one configured: %q", header)
+	}
+	dvidAuthorization = "Bearer configured"
+	if header := fetch("Bearer caller", map[string]interface{}{}); header != "" {
+		t.Fatalf("Configured header was sent to a server named by the caller: %q", header)
+	}
+	defer setAllowlist(nil)
+	setAllowlist([]string{server.URL})
+	if header := fetch("Bearer caller", map[string]interface{}{}); header != "Bearer configured" {
+		t.Fatalf("Configured header was not sent to an allowed server: %q", header)
+	}
+	setAllowlist(nil)
+	addDiscoveredServer(server.URL)
+	defer func() {
+		discoveredMutex.Lock()
+		delete(discoveredServers, server.URL)
+		discoveredMutex.Unlock()
+	}()
+	if header := fetch("Bearer caller", map[string]interface{}{}); header != "Bearer configured" {
+		t.Fatalf("Configured header was not sent: %q", header)
+	}
+
+	forwardAuthorization = true
+	if header := fetch("Bearer caller", map[string]interface{}{}); header != "Bearer caller" {
+		t.Fatalf("Caller's header was not forwarded: %q", header)
+	}
+	if header := fetch("", map[string]interface{}{}); header != "Bearer configured" {
+		t.Fatalf("Configured header was not sent without the caller's header: %q", header)
+	}
+	json_data := map[string]interface{}{"authorization": "Bearer request"}
+	if header := fetch("Bearer caller", json_data); header != "Bearer request" {
+		t.Fatalf("Header of the request was not sent: %q", header)
+	}
+}
+
+func TestCredentialID(t *testing.T) {
+	// credentialID returns the id of a service call with the Authorization header of a request
+	credentialOf := func(authorization string) string {
+		r := httptest.NewRequest("POST", overlapPath, nil)
+		ctx, cancel := requestContext(r, map[string]interface{}{"authorization": authorization})
+		defer cancel()
+		return credentialID(ctx)
+	}
+
+	if credentialOf("Bearer one") == credentialOf("Bearer two") {
+		t.Fatalf("Different headers have the same credential id")
+	}
+	if credentialOf("Bearer one") != credentialOf("Bearer one") {
+		t.Fatalf("Same header has different credential ids")
+	}
+	if id := credentialOf("Bearer one"); strings.Contains(id, "one") {
+		t.Fatalf("Credential id %s holds the header", id)
+	}
+	if id := credentialOf(""); id != "" {
+		t.Fatalf("Call without a header has credential id %s", id)
+	}
+}
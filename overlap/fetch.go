@@ -0,0 +1,115 @@
+package overlap
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultFetchParallelism is the number of bodies fetched at once if not configured
+const DefaultFetchParallelism = 8
+
+// fetchParallelism is the maximum number of bodies fetched at once for a request
+var fetchParallelism = DefaultFetchParallelism
+
+// bodyFailure reports a body that could not be fetched (the remaining bodies are still computed)
+type bodyFailure struct {
+	Body  uint64 `json:"body"`
+	Error string `json:"error"`
+}
+
+// fetchProgress counts the bodies requested and fetched (or failed) for a job
+type fetchProgress struct {
+	total   int64
+	fetched int64
+}
+
+// progressKey is the context key for the progress of a job
+type progressKey struct{}
+
+// jobProgress returns the progress of the job running with the context (nil for service calls)
+func jobProgress(ctx context.Context) *fetchProgress {
+	progress, _ := ctx.Value(progressKey{}).(*fetchProgress)
+	return progress
+}
+
+// addTotal counts bodies to be fetched
+func (progress *fetchProgress) addTotal(numbodies int) {
+	if progress != nil {
+		atomic.AddInt64(&progress.total, int64(numbodies))
+	}
+}
+
+// addFetched counts bodies that were fetched (or failed)
+func (progress *fetchProgress) addFetched(numbodies int) {
+	if progress != nil {
+		atomic.AddInt64(&progress.fetched, int64(numbodies))
+	}
+}
+
+// fetchResult holds the decoded body (or the failure) for one body
+type fetchResult struct {
+	sparse_body SparseBody
+	err         error
+}
+
+// fetchBodies reads each body from the source using a bounded number of concurrent fetches, or in
+// one pass for sources that read bodies in batches (the bodies are clipped to the bounds and returned
+// in the order requested along with any bodies that failed)
+func fetchBodies(ctx context.Context, source BodySource, uuid string, bodyids []uint64, bounds *bodyBounds) (sparse_bodies sparseBodies, failures []bodyFailure) {
+	progress := jobProgress(ctx)
+	progress.addTotal(len(bodyids))
+
+	var results []fetchResult
+	if batch, found := source.(batchSource); found {
+		results = batch.fetchBodies(ctx, uuid, bodyids)
+		progress.addFetched(len(bodyids))
+	} else {
+		results = make([]fetchResult, len(bodyids))
+		fetchConcurrently(len(bodyids), func(index int) {
+			sparse_body, err := source.FetchBody(ctx, uuid, bodyids[index])
+			results[index] = fetchResult{sparse_body, err}
+			progress.addFetched(1)
+		})
+	}
+
+	for index, result := range results {
+		if result.err != nil {
+			failures = append(failures, bodyFailure{bodyids[index], result.err.Error()})
+			continue
+		}
+
+		// DVID returns any span intersecting the bounds so clip them exactly
+		sparse_body := result.sparse_body
+		if bounds != nil {
+			sparse_body = bounds.clipBody(sparse_body)
+		}
+		sparse_bodies = append(sparse_bodies, sparse_body)
+	}
+
+	return
+}
+
+// fetchConcurrently calls fetch for each index below count with at most fetchParallelism calls at once
+func fetchConcurrently(count int, fetch func(index int)) {
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	numworkers := fetchParallelism
+	if numworkers > count {
+		numworkers = count
+	}
+	for worker := 0; worker < numworkers; worker += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				fetch(index)
+			}
+		}()
+	}
+	for index := 0; index < count; index += 1 {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+}
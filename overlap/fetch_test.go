@@ -0,0 +1,137 @@
+package overlap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyCounter records the most calls running at once
+type concurrencyCounter struct {
+	mutex   sync.Mutex
+	running int
+	most    int
+}
+
+// call counts a call that lasts 2ms
+func (counter *concurrencyCounter) call() {
+	counter.mutex.Lock()
+	counter.running += 1
+	if counter.running > counter.most {
+		counter.most = counter.running
+	}
+	counter.mutex.Unlock()
+
+	time.Sleep(2 * time.Millisecond)
+
+	counter.mutex.Lock()
+	counter.running -= 1
+	counter.mutex.Unlock()
+}
+
+// countingSource returns a one voxel body for each id (failing odd ids above 100) and records the most
+// fetches running at once
+type countingSource struct {
+	concurrencyCounter
+}
+
+func (source *countingSource) FetchBody(ctx context.Context, uuid string, bodyid uint64) (SparseBody, error) {
+	source.call()
+	if bodyid > 100 && bodyid%2 == 1 {
+		return SparseBody{}, fmt.Errorf("Body %d failed", bodyid)
+	}
+	return NewSparseBody(bodyid, []Span{{int32(bodyid), 0, 0, 1}}), nil
+}
+
+// countingServer returns two supervoxels for each body and records the most requests running at once
+type countingServer struct {
+	concurrencyCounter
+}
+
+func (server *countingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.call()
+	bodyid, _ := strconv.ParseUint(path.Base(r.URL.Path), 10, 64)
+	fmt.Fprintf(w, "[%d,%d]", bodyid*10, bodyid*10+1)
+}
+
+func TestFetchParallelism(t *testing.T) {
+	defer func(saved int) { fetchParallelism = saved }(fetchParallelism)
+
+	var bodyids []uint64
+	for bodyid := uint64(1); bodyid <= 40; bodyid += 1 {
+		bodyids = append(bodyids, bodyid)
+	}
+	for _, parallelism := range []int{1, 3, 8} {
+		fetchParallelism = parallelism
+		source := &countingSource{}
+		sparse_bodies, failures := fetchBodies(context.Background(), source, "abc", bodyids, nil)
+
+		if source.most > parallelism {
+			t.Fatalf("%d fetches ran at once with a parallelism of %d", source.most, parallelism)
+		}
+		if parallelism > 1 && source.most < 2 {
+			t.Fatalf("Bodies were fetched one at a time with a parallelism of %d", parallelism)
+		}
+		if len(failures) != 0 || len(sparse_bodies) != len(bodyids) {
+			t.Fatalf("Fetch returned %d bodies and %d failures", len(sparse_bodies), len(failures))
+		}
+		for i, sparse_body := range sparse_bodies {
+			if sparse_body.bodyID != bodyids[i] {
+				t.Fatalf("Body %d was returned in place of %d", sparse_body.bodyID, bodyids[i])
+			}
+		}
+	}
+}
+
+func TestSupervoxelParallelism(t *testing.T) {
+	defer func(saved int) { fetchParallelism = saved }(fetchParallelism)
+
+	var bodyids []uint64
+	for bodyid := uint64(1); bodyid <= 40; bodyid += 1 {
+		bodyids = append(bodyids, bodyid)
+	}
+	for _, parallelism := range []int{1, 3, 8} {
+		fetchParallelism = parallelism
+		server := &countingServer{}
+		ts := httptest.NewServer(server)
+		svmap, svids, failures := expandSupervoxels(context.Background(), ts.URL+"/", bodyids)
+		ts.Close()
+		if len(failures) != 0 {
+			t.Fatalf("Supervoxel expansion failed: %v", failures)
+		}
+
+		if server.most > parallelism {
+			t.Fatalf("%d supervoxel fetches ran at once with a parallelism of %d", server.most, parallelism)
+		}
+		if parallelism > 1 && server.most < 2 {
+			t.Fatalf("Supervoxels were fetched one at a time with a parallelism of %d", parallelism)
+		}
+		if len(svids) != 2*len(bodyids) {
+			t.Fatalf("Expansion returned %d supervoxels", len(svids))
+		}
+		for i, bodyid := range bodyids {
+			if svids[2*i] != bodyid*10 || svids[2*i+1] != bodyid*10+1 || svmap[bodyid*10+1] != bodyid {
+				t.Fatalf("Supervoxels of body %d were not returned in order", bodyid)
+			}
+		}
+	}
+}
+
+func TestFetchFailures(t *testing.T) {
+	bounds, _ := getBounds(map[string]interface{}{"maxx": 102.0})
+	sparse_bodies, failures := fetchBodies(context.Background(), &countingSource{}, "abc", []uint64{101, 102, 103, 104}, bounds)
+	if len(failures) != 2 || failures[0].Body != 101 || failures[1].Body != 103 {
+		t.Fatalf("Failures were not reported in order: %v", failures)
+	}
+
+	// body 104 is outside the bounds
+	if len(sparse_bodies) != 2 || len(sparse_bodies[0].rle) != 1 || len(sparse_bodies[1].rle) != 0 {
+		t.Fatalf("Bodies were not clipped to the bounds: %v", sparse_bodies)
+	}
+}
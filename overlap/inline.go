@@ -0,0 +1,209 @@
+package overlap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	// inlineUUID is the version of the uploaded bodies if the request does not provide a uuid
+	inlineUUID = "inline"
+	// DefaultMaxUploadBytes is the largest request (including any uploaded bodies) accepted
+	DefaultMaxUploadBytes = 1 << 30
+)
+
+// maxUploadBytes bounds the size of a request and the memory used by the bodies decoded from it
+var maxUploadBytes int64 = DefaultMaxUploadBytes
+
+// uploadError returns the error for a request that could not be read, which is reported as too large
+// if the body was cut off at maxUploadBytes (the limit is hit again on the next read)
+func uploadError(r *http.Request, err error) error {
+	if _, err2 := r.Body.Read(make([]byte, 1)); err2 != nil {
+		if _, toolarge := err2.(*http.MaxBytesError); toolarge {
+			return fmt.Errorf("Request exceeds the limit of %d bytes", maxUploadBytes)
+		}
+	}
+	return err
+}
+
+// readRequest decodes the JSON request along with any bodies uploaded with it.  Bodies are uploaded
+// either as "rles" in the JSON or as a multipart form with the JSON in the "request" part and a
+// DVID-format sparse volume in a part named by each body id.  The source is nil if no bodies are uploaded.
+func readRequest(w http.ResponseWriter, r *http.Request) (json_data map[string]interface{}, source BodySource, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype == "multipart/form-data" {
+		return readMultipartRequest(r)
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err = decoder.Decode(&json_data); err != nil {
+		return nil, nil, uploadError(r, fmt.Errorf("JSON could not be decoded"))
+	}
+
+	rleinter, found := json_data["rles"].(map[string]interface{})
+	if !found {
+		return
+	}
+	var inline_bodies sparseBodies
+	for bodystr, spansinter := range rleinter {
+		bodyid, err2 := strconv.ParseUint(bodystr, 10, 64)
+		if err2 != nil || bodyid < 1 {
+			return nil, nil, fmt.Errorf("RLEs contain an invalid body id %s", bodystr)
+		}
+		sparse_body, err2 := decodeSpanList(bodyid, spansinter)
+		if err2 != nil {
+			return nil, nil, err2
+		}
+		inline_bodies = append(inline_bodies, sparse_body)
+	}
+	delete(json_data, "rles")
+
+	source = inlineSource(json_data, inline_bodies)
+	return
+}
+
+// readMultipartRequest decodes a multipart request with uploaded sparse volumes
+func readMultipartRequest(r *http.Request) (json_data map[string]interface{}, source BodySource, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Multipart request could not be read")
+	}
+
+	// decoded runs along y or z take more memory than their sparse volume so the spans are also bounded
+	var inline_bodies sparseBodies
+	uploaded := make(map[uint64]bool)
+	spanlimit := maxUploadBytes / spanSize
+	for {
+		part, err2 := reader.NextPart()
+		if err2 == io.EOF {
+			break
+		}
+		if err2 != nil {
+			return nil, nil, uploadError(r, fmt.Errorf("Multipart request could not be read: %v", err2))
+		}
+
+		name := part.FormName()
+		if name == "request" {
+			decoder := json.NewDecoder(part)
+			decoder.UseNumber()
+			if err = decoder.Decode(&json_data); err != nil {
+				return nil, nil, uploadError(r, fmt.Errorf("JSON could not be decoded"))
+			}
+			continue
+		}
+
+		bodyid, err2 := strconv.ParseUint(name, 10, 64)
+		if err2 != nil || bodyid < 1 {
+			return nil, nil, fmt.Errorf("Uploaded sparse volume %s is not named by a body id", name)
+		}
+		if uploaded[bodyid] {
+			return nil, nil, fmt.Errorf("Sparse volume for body %d is uploaded more than once", bodyid)
+		}
+		uploaded[bodyid] = true
+		sparse_body, err2 := decodeSparsevolLimit(part, bodyid, spanlimit)
+		if err2 != nil {
+			return nil, nil, uploadError(r, err2)
+		}
+		spanlimit -= int64(len(sparse_body.rle))
+		if err2 = checkSpans(sparse_body); err2 != nil {
+			return nil, nil, err2
+		}
+		inline_bodies = append(inline_bodies, sparse_body)
+	}
+
+	if json_data == nil {
+		json_data = make(map[string]interface{})
+	}
+	source = inlineSource(json_data, inline_bodies)
+	return
+}
+
+// decodeSpanList converts a JSON list of [x, y, z, length] spans into the RLE of a body
+func decodeSpanList(bodyid uint64, spansinter interface{}) (sparse_body SparseBody, err error) {
+	spans, found := spansinter.([]interface{})
+	if !found {
+		err = fmt.Errorf("RLE for body %d must be a list of spans", bodyid)
+		return
+	}
+
+	sparse_body.bodyID = bodyid
+	sparse_body.rle = make([]sparseData, 0, len(spans))
+	for _, spaninter := range spans {
+		span, found := spaninter.([]interface{})
+		if !found || len(span) != 4 {
+			err = fmt.Errorf("RLE for body %d contains a span that is not [x, y, z, length]", bodyid)
+			return
+		}
+		var coords [4]int32
+		for i, val := range span {
+			fval, found := jsonFloat(val)
+			if !found || fval != float64(int32(fval)) {
+				err = fmt.Errorf("RLE for body %d contains a span with invalid coordinates", bodyid)
+				return
+			}
+			coords[i] = int32(fval)
+		}
+		if coords[3] <= 0 {
+			err = fmt.Errorf("RLE for body %d contains a span with length %d", bodyid, coords[3])
+			return
+		}
+		sparse_body.rle = append(sparse_body.rle, sparseData{coords[0], coords[1], coords[2], coords[3]})
+	}
+	err = checkSpans(sparse_body)
+	return
+}
+
+// checkSpans rejects a body with spans that repeat or overlap each other (the spans are sorted by z, y, and x)
+func checkSpans(sparse_body SparseBody) error {
+	rle := sparse_body.rle
+	sort.Slice(rle, func(i, j int) bool {
+		if rle[i].z != rle[j].z {
+			return rle[i].z < rle[j].z
+		}
+		if rle[i].y != rle[j].y {
+			return rle[i].y < rle[j].y
+		}
+		return rle[i].x < rle[j].x
+	})
+	for i := 1; i < len(rle); i += 1 {
+		prev, span := rle[i-1], rle[i]
+		if span.z == prev.z && span.y == prev.y && int64(prev.x)+int64(prev.length) > int64(span.x) {
+			return fmt.Errorf("RLE for body %d contains overlapping spans at (%d, %d, %d)", sparse_body.bodyID, span.x, span.y, span.z)
+		}
+	}
+	return nil
+}
+
+// inlineSource stores the uploaded bodies in a source for the request (the uuid and the body list
+// default to the uploaded bodies if they are not provided)
+func inlineSource(json_data map[string]interface{}, inline_bodies sparseBodies) BodySource {
+	if len(inline_bodies) == 0 {
+		return nil
+	}
+
+	uuid, found := json_data["uuid"].(string)
+	if !found {
+		uuid = inlineUUID
+		json_data["uuid"] = uuid
+	}
+
+	source := NewMemorySource()
+	var body_list []interface{}
+	sort.Slice(inline_bodies, func(i, j int) bool { return inline_bodies[i].bodyID < inline_bodies[j].bodyID })
+	for _, sparse_body := range inline_bodies {
+		source.addBody(uuid, sparse_body)
+		body_list = append(body_list, json.Number(strconv.FormatUint(sparse_body.bodyID, 10)))
+	}
+	if _, found := json_data["bodies"]; !found {
+		json_data["bodies"] = body_list
+	}
+	return source
+}
@@ -0,0 +1,84 @@
+package overlap
+
+import (
+	"context"
+	"fmt"
+)
+
+// DefaultLabelInstance is the data instance used if neither the request nor the server specifies one
+const DefaultLabelInstance = "sp2body"
+
+// defaultInstance is the data instance used if the request does not specify one
+var defaultInstance = DefaultLabelInstance
+
+// labelInstance is a DVID data instance that serves sparse volumes
+type labelInstance struct {
+	// name of the instance queried for sparse volumes
+	name string
+	// DVID datatype of the instance ("labelvol", "labelarray", or "labelmap")
+	typename string
+}
+
+// instanceInfo is the part of the DVID instance info needed to locate sparse volumes
+type instanceInfo struct {
+	Base struct {
+		TypeName string
+		Syncs    []string
+	}
+}
+
+// fetchInstanceInfo retrieves the datatype information for a data instance from DVID
+func fetchInstanceInfo(ctx context.Context, dvidserver, uuid, name string) (*instanceInfo, error) {
+	url := dvidserver + "/api/node/" + uuid + "/" + name + "/info"
+
+	info := &instanceInfo{}
+	if err := dvid.getJSON(ctx, url, info); err != nil {
+		return nil, fmt.Errorf("Instance info for %s could not be read: %v", name, err)
+	}
+	return info, nil
+}
+
+// getLabelInstance finds the instance that serves sparse volumes for the requested label data
+// (labelblk instances do not serve sparse volumes so their synced labelvol is used)
+func getLabelInstance(ctx context.Context, dvidserver, uuid string, json_data map[string]interface{}) (labelInstance, error) {
+	name := defaultInstance
+	if val, found := json_data["label-instance"].(string); found {
+		name = val
+	}
+
+	info, err := fetchInstanceInfo(ctx, dvidserver, uuid, name)
+	if err != nil {
+		return labelInstance{}, err
+	}
+
+	switch info.Base.TypeName {
+	case "labelvol", "labelarray", "labelmap":
+		return labelInstance{name, info.Base.TypeName}, nil
+	case "labelblk":
+		for _, syncname := range info.Base.Syncs {
+			syncinfo, err := fetchInstanceInfo(ctx, dvidserver, uuid, syncname)
+			if err != nil {
+				return labelInstance{}, err
+			}
+			if syncinfo.Base.TypeName == "labelvol" {
+				return labelInstance{syncname, syncinfo.Base.TypeName}, nil
+			}
+		}
+		return labelInstance{}, fmt.Errorf("labelblk instance %s is not synced to a labelvol instance", name)
+	}
+
+	return labelInstance{}, fmt.Errorf("Instance %s of type %s does not support sparse volumes", name, info.Base.TypeName)
+}
+
+// baseURL returns the URL prefix for the sparse volume queries of the instance
+func (instance labelInstance) baseURL(dvidserver, uuid string) string {
+	return dvidserver + "/api/node/" + uuid + "/" + instance.name + "/"
+}
+
+// checkResolution verifies that the instance can return bodies at the resolution
+func (instance labelInstance) checkResolution(res bodyResolution) error {
+	if res.scale > 0 && instance.typename != "labelmap" {
+		return fmt.Errorf("Scale can only be requested for labelmap instances (%s is %s)", instance.name, instance.typename)
+	}
+	return nil
+}
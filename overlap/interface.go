@@ -14,20 +14,60 @@ title: Overlap Service
             "type": "object",
             "properties": {
               "dvid-server": { 
-                "description": "location of DVID server (will try to find on service proxy if not provided)",
+                "description": "location of DVID server, optionally starting with http:// or https://, or a configured alias (must be allowed by the server; will try to find on service proxy if not provided)",
                 "type": "string" 
               },
               "uuid": { "type": "string" },
+              "authorization": { "description": "Authorization header sent to DVID for this request (e.g., \"Bearer TOKEN\")", "type": "string" },
+              "backend": { "description": "name of a configured DVID backend (in place of dvid-server; by default the uuid is routed to a backend)", "type": "string" },
+              "label-instance": { "description": "name of the DVID label instance (labelblk, labelvol, labelarray, or labelmap) holding the bodies (server default if not provided)", "type": "string" },
+              "roi": {
+                "description": "name of DVID roi instance used to clip the bodies (clipped results are reported in addition to the full results)",
+                "type": "string"
+              },
+              "rois": {
+                "description": "names of DVID roi instances used to break down the results by ROI (voxels are assigned to the first ROI containing them)",
+                "type": "array",
+                "items": {"type": "string"}
+              },
+              "minx": { "description": "minimum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "maxx": { "description": "maximum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "miny": { "description": "minimum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "maxy": { "description": "maximum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "minz": { "description": "minimum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "maxz": { "description": "maximum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "scale": { "description": "fetch the bodies at this downsampling level of a labelmap instance (results are rescaled to full resolution units)", "type": "integer", "minimum": 0, "maximum": 10 },
+              "coarse": { "description": "fetch the blocks intersecting each body with sparsevol-coarse (results are rescaled to full resolution units)", "type": "boolean" },
+              "block-size": { "description": "size of the blocks returned by sparsevol-coarse (default 32)", "type": "integer", "minimum": 1, "maximum": 1024 },
+              "two-stage": { "description": "only fetch bodies at the requested resolution if they touch another body at coarse resolution", "type": "boolean" },
+              "supervoxels": { "description": "compute at the supervoxel level (labelmap only) and aggregate the results to the bodies", "type": "boolean" },
+              "mapping": {
+                "description": "map of body id to a new body id applied before computing (e.g., to preview merges), bodies mapped to the same id are merged",
+                "type": "object",
+                "additionalProperties": {"type": "integer", "minimum": 1}
+              },
+              "rles": {
+                "description": "map of body id to the list of [x, y, z, length] spans of the body, used instead of fetching the bodies from DVID (bodies defaults to these body ids)",
+                "type": "object",
+                "additionalProperties": {"type": "array", "items": {"type": "array", "items": {"type": "integer"}, "minItems": 4, "maxItems": 4}}
+              },
               "bodies": { 
                 "description": "Array of body ids",
                 "type": "array",
                 "minItems": 2,
-                "items": {"type": "integer", "minimum": 1},
-                "uniqueItems": true
+                "items": {"type": "integer", "minimum": 1}
               }
             },
             "required" : ["uuid", "bodies"]
           }
+      multipart/form-data:
+        formParameters:
+          request:
+            description: "JSON request as above (uuid and bodies default to the uploaded bodies)"
+            type: string
+          BODYID:
+            description: "DVID-format sparse volume for a body, in a part named by the body id (one part per body)"
+            type: file
     responses:
       200:
         body:
@@ -48,9 +88,47 @@ title: Overlap Service
                       "items": {"type": "integer", "minimum": 1}
                     }
                   },
+                  "roi-overlap-list": {
+                    "description" : "List of body pairs and their overlap within the roi (only provided if an roi is requested)",
+                    "type": "array",
+                    "minItems": 0,
+                    "items": {
+                      "type": "array",
+                      "minItems": 3,
+                      "maxItems": 3,
+                      "items": {"type": "integer", "minimum": 1}
+                    }
+                  },
+                  "supervoxel-overlap-list": {
+                    "description" : "List of supervoxel contacts (body 1, body 2, supervoxel 1, supervoxel 2, overlap) including contacts within a body (only provided for supervoxels)",
+                    "type": "array",
+                    "items": {
+                      "type": "array",
+                      "minItems": 5,
+                      "maxItems": 5,
+                      "items": {"type": "integer", "minimum": 1}
+                    }
+                  },
+                  "overlap-by-roi": {
+                    "description" : "Map of roi name to the list of body pairs and their overlap (only provided if rois are requested).  The contact is assigned to the ROI of the voxel in the smaller body id",
+                    "type": "object"
+                  },
+                  "failed-bodies": {
+                    "description" : "Bodies that could not be fetched from DVID and are missing from the results (only provided if there are failures)",
+                    "type": "array",
+                    "items": {
+                      "type": "object",
+                      "properties": {
+                        "body": {"type": "integer"},
+                        "error": {"type": "string"}
+                      }
+                    }
+                  },
                 "required" : ["overlap-list"]
                 }
               }
+      403:
+        description: "The DVID server is not in the server's allowlist"
 /bodystats:
   post:
     description: "Call service to calculate statistics over a set of bodies"
@@ -62,20 +140,59 @@ title: Overlap Service
             "type": "object",
             "properties": {
               "dvid-server": { 
-                "description": "location of DVID server (will try to find on service proxy if not provided)",
+                "description": "location of DVID server, optionally starting with http:// or https://, or a configured alias (must be allowed by the server; will try to find on service proxy if not provided)",
                 "type": "string" 
               },
               "uuid": { "type": "string" },
+              "authorization": { "description": "Authorization header sent to DVID for this request (e.g., \"Bearer TOKEN\")", "type": "string" },
+              "backend": { "description": "name of a configured DVID backend (in place of dvid-server; by default the uuid is routed to a backend)", "type": "string" },
+              "label-instance": { "description": "name of the DVID label instance (labelblk, labelvol, labelarray, or labelmap) holding the bodies (server default if not provided)", "type": "string" },
+              "roi": {
+                "description": "name of DVID roi instance used to clip the bodies (clipped results are reported in addition to the full results)",
+                "type": "string"
+              },
+              "rois": {
+                "description": "names of DVID roi instances used to break down the results by ROI (voxels are assigned to the first ROI containing them)",
+                "type": "array",
+                "items": {"type": "string"}
+              },
+              "minx": { "description": "minimum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "maxx": { "description": "maximum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "miny": { "description": "minimum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "maxy": { "description": "maximum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "minz": { "description": "minimum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "maxz": { "description": "maximum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+              "scale": { "description": "fetch the bodies at this downsampling level of a labelmap instance (results are rescaled to full resolution units)", "type": "integer", "minimum": 0, "maximum": 10 },
+              "coarse": { "description": "fetch the blocks intersecting each body with sparsevol-coarse (results are rescaled to full resolution units)", "type": "boolean" },
+              "block-size": { "description": "size of the blocks returned by sparsevol-coarse (default 32)", "type": "integer", "minimum": 1, "maximum": 1024 },
+              "supervoxels": { "description": "compute at the supervoxel level (labelmap only) and aggregate the results to the bodies", "type": "boolean" },
+              "mapping": {
+                "description": "map of body id to a new body id applied before computing (e.g., to preview merges), bodies mapped to the same id are merged",
+                "type": "object",
+                "additionalProperties": {"type": "integer", "minimum": 1}
+              },
+              "rles": {
+                "description": "map of body id to the list of [x, y, z, length] spans of the body, used instead of fetching the bodies from DVID (bodies defaults to these body ids)",
+                "type": "object",
+                "additionalProperties": {"type": "array", "items": {"type": "array", "items": {"type": "integer"}, "minItems": 4, "maxItems": 4}}
+              },
               "bodies": { 
                 "description": "Array of body ids",
                 "type": "array",
                 "minItems": 1,
-                "items": {"type": "integer", "minimum": 1},
-                "uniqueItems": true
+                "items": {"type": "integer", "minimum": 1}
               }
             },
             "required" : ["uuid", "bodies"]
           }
+      multipart/form-data:
+        formParameters:
+          request:
+            description: "JSON request as above (uuid and bodies default to the uploaded bodies)"
+            type: string
+          BODYID:
+            description: "DVID-format sparse volume for a body, in a part named by the body id (one part per body)"
+            type: file
     responses:
       200:
         body:
@@ -96,9 +213,158 @@ title: Overlap Service
                       "items": {"type": "integer", "minimum": 1}
                     }
                   },
+                  "roi-body-stats": {
+                    "description" : "List of bodies with stats within the roi (only provided if an roi is requested).  Faces where the roi boundary cuts through a body are not counted as surface area.",
+                    "type": "array",
+                    "minItems": 0,
+                    "items": {
+                      "type": "array",
+                      "minItems": 3,
+                      "maxItems": 3,
+                      "items": {"type": "integer", "minimum": 0}
+                    }
+                  },
+                  "supervoxel-stats": {
+                    "description" : "List of supervoxels with stats (body id, supervoxel id, size, surface area) (only provided for supervoxels)",
+                    "type": "array",
+                    "items": {
+                      "type": "array",
+                      "minItems": 4,
+                      "maxItems": 4,
+                      "items": {"type": "integer", "minimum": 0}
+                    }
+                  },
+                  "body-stats-by-roi": {
+                    "description" : "Map of roi name to the list of bodies with stats within the roi (only provided if rois are requested)",
+                    "type": "object"
+                  },
+                  "failed-bodies": {
+                    "description" : "Bodies that could not be fetched from DVID and are missing from the results (only provided if there are failures)",
+                    "type": "array",
+                    "items": {
+                      "type": "object",
+                      "properties": {
+                        "body": {"type": "integer"},
+                        "error": {"type": "string"}
+                      }
+                    }
+                  },
                 "required" : ["body-stats"]
                 }
               }
+      403:
+        description: "The DVID server is not in the server's allowlist"
+/cache:
+  get:
+    description: "Get the hit and miss counts and the size of the cache of bodies fetched from DVID"
+    responses:
+      200:
+        body:
+          application/json:
+            schema: |
+              { "$schema": "http://json-schema.org/schema#",
+                "title": "Provides the statistics of the body cache",
+                "type": "object",
+                "properties": {
+                  "hits": { "description": "number of bodies read from the cache", "type": "integer" },
+                  "misses": { "description": "number of bodies not found in the cache", "type": "integer" },
+                  "bodies": { "description": "number of bodies in the cache", "type": "integer" },
+                  "spans": { "description": "number of spans in the cache", "type": "integer" },
+                  "max-spans": { "description": "maximum number of spans kept in the cache", "type": "integer" }
+                }
+              }
+/diskcache:
+  get:
+    description: "Get the number of bodies, results, and locked nodes in the disk cache"
+    responses:
+      200:
+        body:
+          application/json:
+            schema: |
+              { "$schema": "http://json-schema.org/schema#",
+                "title": "Provides the contents of the disk cache",
+                "type": "object",
+                "properties": {
+                  "bodies": { "description": "number of stored bodies", "type": "integer" },
+                  "results": { "description": "number of stored overlap and stats results", "type": "integer" },
+                  "locked-nodes": { "description": "number of nodes known to be locked", "type": "integer" },
+                  "bytes": { "description": "size of the stored keys and values", "type": "integer" }
+                }
+              }
+  delete:
+    description: "Purge the disk cache (the admin Authorization header is required)"
+  /{uuid}:
+    get:
+      description: "Get the contents of the disk cache for a node"
+    delete:
+      description: "Purge the disk cache for a node (the admin Authorization header is required)"
+/mutations:
+  post:
+    description: "Receive DVID labelmap mutation records (merge, split, cleave, split-supervoxel, renumber) and evict the affected bodies from the caches (the mutation Authorization header is required)"
+    body:
+      application/json:
+        schema: |
+          { "$schema": "http://json-schema.org/schema#",
+            "title": "A DVID mutation record (with its UUID) or a list of mutation records",
+            "type": ["object", "array"]
+          }
+  /{uuid}:
+    post:
+      description: "Receive mutation records for a node"
+/jobs:
+  post:
+    description: "Submit an overlap or bodystats request (JSON or multipart as for /overlap) to run in the background"
+    body:
+      application/json:
+        schema: |
+          { "$schema": "http://json-schema.org/schema#",
+            "title": "An overlap or bodystats request with the service to run",
+            "type": "object",
+            "properties": {
+              "service": { "description": "overlap (default) or bodystats", "type": "string" }
+            }
+          }
+    responses:
+      202:
+        body:
+          application/json:
+            schema: |
+              { "$schema": "http://json-schema.org/schema#",
+                "title": "Status of the new job (its id is also given in the Location header)",
+                "type": "object"
+              }
+      503:
+        description: "Too many jobs are waiting to run"
+  get:
+    description: "List the status of all jobs"
+  /{id}:
+    get:
+      description: "Get the status of a job"
+      responses:
+        200:
+          body:
+            application/json:
+              schema: |
+                { "$schema": "http://json-schema.org/schema#",
+                  "title": "Status and progress of a job",
+                  "type": "object",
+                  "properties": {
+                    "id": {"type": "string"},
+                    "service": {"type": "string"},
+                    "status": {"description": "queued, running, done, failed, or canceled", "type": "string"},
+                    "bodies-total": {"description": "bodies to fetch so far", "type": "integer"},
+                    "bodies-fetched": {"description": "bodies fetched (or failed) so far", "type": "integer"},
+                    "created": {"type": "string"},
+                    "started": {"type": "string"},
+                    "finished": {"type": "string"},
+                    "error": {"description": "error of a failed job", "type": "string"}
+                  }
+                }
+    delete:
+      description: "Cancel a queued or running job, or delete a finished job"
+    /result:
+      get:
+        description: "Get the result of a finished job (same as the /overlap or /bodystats response; 409 if the job has not finished)"
 /interface/interface.raml:
   get:
     description: "Get the interface for the overlap and body service"
@@ -0,0 +1,524 @@
+package overlap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultJobWorkers is the number of jobs run at once if not configured
+	DefaultJobWorkers = 2
+	// DefaultJobQueue is the number of jobs that can wait to run if not configured
+	DefaultJobQueue = 100
+	// jobsPath is the URI to submit and follow asynchronous jobs
+	jobsPath = "/jobs/"
+)
+
+// states of a job
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// job is an overlap or stats request run in the background
+type job struct {
+	id string
+	// service run for the request ("overlap" or "bodystats")
+	service   string
+	json_data map[string]interface{}
+	// uploaded bodies (nil if the bodies come from DVID or the configured source)
+	source BodySource
+	// Authorization header and address of the caller that submitted the job
+	authorization string
+	caller        string
+	// hash of the Authorization header of the submission (only callers with the same header can see the job)
+	owner string
+
+	state    string
+	created  time.Time
+	started  time.Time
+	finished time.Time
+	progress *fetchProgress
+	// response of a finished job (the error message for failed jobs)
+	status int
+	result []byte
+
+	// cancels the job when it is deleted
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobStatus reports the state and progress of a job
+type jobStatus struct {
+	ID            string     `json:"id"`
+	Service       string     `json:"service"`
+	Status        string     `json:"status"`
+	BodiesTotal   int64      `json:"bodies-total"`
+	BodiesFetched int64      `json:"bodies-fetched"`
+	Created       time.Time  `json:"created"`
+	Started       *time.Time `json:"started,omitempty"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// jobQueue holds the submitted jobs and the jobs waiting for a worker
+type jobQueue struct {
+	mutex   sync.Mutex
+	jobs    map[string]*job
+	pending chan *job
+	// keeps the jobs across restarts (nil if not configured)
+	store *jobStore
+	// set when the service shuts down so that interrupted jobs are queued again
+	stopping bool
+	workers  sync.WaitGroup
+}
+
+// jobs holds the asynchronous jobs of the service
+var jobs = newJobQueue(DefaultJobQueue)
+
+// jobWorkers is the number of jobs run at once
+var jobWorkers = DefaultJobWorkers
+
+// jobDeadline bounds the time spent fetching data from DVID for a job (no limit if 0)
+var jobDeadline time.Duration
+
+// newJobQueue creates a queue where up to maxPending jobs can wait
+func newJobQueue(maxPending int) *jobQueue {
+	return &jobQueue{jobs: make(map[string]*job), pending: make(chan *job, maxPending)}
+}
+
+// newJobID returns a random job id
+func newJobID() (string, error) {
+	var idbuf [8]byte
+	if _, err := rand.Read(idbuf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idbuf[:]), nil
+}
+
+// statusLocked reports the job (the caller must hold the lock)
+func (j *job) statusLocked() jobStatus {
+	status := jobStatus{
+		ID:            j.id,
+		Service:       j.service,
+		Status:        j.state,
+		BodiesTotal:   atomic.LoadInt64(&j.progress.total),
+		BodiesFetched: atomic.LoadInt64(&j.progress.fetched),
+		Created:       j.created,
+	}
+	if !j.started.IsZero() {
+		started := j.started
+		status.Started = &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		status.Finished = &finished
+	}
+	if j.state == jobFailed {
+		status.Error = strings.TrimSpace(string(j.result))
+	}
+	return status
+}
+
+// save stores the job if the queue is persistent (the caller must hold the lock)
+func (jq *jobQueue) save(j *job) {
+	if jq.store == nil {
+		return
+	}
+	if err := jq.store.put(j); err != nil {
+		fmt.Printf("Job %s could not be stored: %v\n", j.id, err)
+	}
+}
+
+// submit adds the job to the queue (it fails if too many jobs are waiting)
+func (jq *jobQueue) submit(j *job) error {
+	jq.mutex.Lock()
+	defer jq.mutex.Unlock()
+
+	select {
+	case jq.pending <- j:
+	default:
+		return fmt.Errorf("Too many jobs are waiting to run")
+	}
+	jq.jobs[j.id] = j
+	jq.save(j)
+	return nil
+}
+
+// restore loads the stored jobs and queues the jobs that had not finished (it must be called before
+// the workers start)
+func (jq *jobQueue) restore(store *jobStore) error {
+	loaded, err := store.load()
+	if err != nil {
+		return err
+	}
+	jq.store = store
+
+	var waiting []*job
+	now := time.Now()
+	for _, j := range loaded {
+		if j.expired(now) {
+			store.delete(j.id)
+			continue
+		}
+		jq.jobs[j.id] = j
+		if j.state == jobQueued {
+			waiting = append(waiting, j)
+		}
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].created.Before(waiting[j].created) })
+
+	if len(waiting) > 0 {
+		fmt.Printf("Resuming %d jobs\n", len(waiting))
+	}
+	jq.pending = make(chan *job, cap(jq.pending)+len(waiting))
+	for _, j := range waiting {
+		jq.pending <- j
+	}
+	return nil
+}
+
+// start runs the workers (and the expiry of finished jobs) until the context is done
+func (jq *jobQueue) start(ctx context.Context, numworkers int) {
+	for worker := 0; worker < numworkers; worker += 1 {
+		jq.workers.Add(1)
+		go func() {
+			defer jq.workers.Done()
+			jq.run(ctx)
+		}()
+	}
+	if jobExpiry >= 0 {
+		jq.workers.Add(1)
+		go func() {
+			defer jq.workers.Done()
+			jq.expire(ctx)
+		}()
+	}
+}
+
+// stop cancels the running jobs (which are queued again if the queue is persistent) and waits for
+// the workers, which must be stopped by their context
+func (jq *jobQueue) stop() {
+	jq.mutex.Lock()
+	jq.stopping = true
+	for _, j := range jq.jobs {
+		if j.state == jobRunning {
+			j.cancel()
+		}
+	}
+	jq.mutex.Unlock()
+	jq.workers.Wait()
+
+	if jq.store != nil {
+		jq.store.db.Close()
+	}
+}
+
+// expire deletes the finished jobs kept longer than the expiry until the context is done
+func (jq *jobQueue) expire(ctx context.Context) {
+	interval := time.Minute
+	if jobExpiry > 0 && jobExpiry < interval {
+		interval = jobExpiry
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		jq.mutex.Lock()
+		for id, j := range jq.jobs {
+			if j.expired(now) {
+				delete(jq.jobs, id)
+				if jq.store != nil {
+					jq.store.delete(id)
+				}
+			}
+		}
+		jq.mutex.Unlock()
+	}
+}
+
+// run executes waiting jobs until the context is done
+func (jq *jobQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-jq.pending:
+			jq.execute(j)
+		}
+	}
+}
+
+// execute runs the job and keeps its response (jobs canceled while waiting are skipped)
+func (jq *jobQueue) execute(j *job) {
+	jq.mutex.Lock()
+	if j.state != jobQueued || jq.stopping {
+		jq.mutex.Unlock()
+		return
+	}
+	j.state = jobRunning
+	j.started = time.Now()
+	jq.save(j)
+	jq.mutex.Unlock()
+
+	ctx, cancel := serviceContext(j.ctx, j.authorization, j.caller, jobDeadline)
+	defer cancel()
+	ctx = context.WithValue(ctx, progressKey{}, j.progress)
+
+	rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	if j.service == "bodystats" {
+		runStats(ctx, rec, j.json_data, j.source)
+	} else {
+		runOverlap(ctx, rec, j.json_data, j.source)
+	}
+
+	jq.mutex.Lock()
+	defer jq.mutex.Unlock()
+	if jq.stopping && j.state == jobRunning {
+		// the job was interrupted by the shutdown so it runs again after a restart
+		j.state = jobQueued
+		j.started = time.Time{}
+		jq.save(j)
+		return
+	}
+	j.finished = time.Now()
+	if j.state != jobCanceled {
+		j.status = rec.status
+		j.result = rec.data.Bytes()
+		if rec.status == http.StatusOK {
+			j.state = jobDone
+		} else {
+			j.state = jobFailed
+		}
+	}
+	j.source = nil
+	jq.save(j)
+}
+
+// find returns the job if it was submitted by the owner (the caller must hold the lock)
+func (jq *jobQueue) find(id, owner string) (*job, bool) {
+	j, found := jq.jobs[id]
+	if !found || j.owner != owner {
+		return nil, false
+	}
+	return j, true
+}
+
+// remove cancels a waiting or running job, or deletes a finished job (of the owner)
+func (jq *jobQueue) remove(id, owner string) bool {
+	jq.mutex.Lock()
+	defer jq.mutex.Unlock()
+
+	j, found := jq.find(id, owner)
+	if !found {
+		return false
+	}
+	switch j.state {
+	case jobQueued:
+		j.state = jobCanceled
+		j.finished = time.Now()
+		j.source = nil
+		jq.save(j)
+	case jobRunning:
+		j.state = jobCanceled
+	default:
+		delete(jq.jobs, id)
+		if jq.store != nil {
+			jq.store.delete(id)
+		}
+	}
+	j.cancel()
+	return true
+}
+
+// jobRecorder keeps the response of a job in place of an http connection
+type jobRecorder struct {
+	header http.Header
+	status int
+	data   bytes.Buffer
+}
+
+func (rec *jobRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *jobRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *jobRecorder) Write(data []byte) (int, error) {
+	return rec.data.Write(data)
+}
+
+// jobsHandler submits a job (POST /jobs with an overlap or bodystats request and "service"), lists the
+// caller's jobs (GET /jobs), reports a job (GET /jobs/<id>), returns its result (GET /jobs/<id>/result),
+// and cancels or deletes it (DELETE /jobs/<id>).  Callers must send an Authorization header and jobs are
+// only visible to callers with the same header as the submission.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	pathlist, requestType, err := parseURI(r, jobsPath)
+	if err != nil || len(pathlist) > 2 || (len(pathlist) == 2 && pathlist[1] != "result") {
+		badRequest(w, "Error: incorrectly formatted request")
+		return
+	}
+	if !requireAuthorization(w, r) {
+		return
+	}
+	owner := hashAuthorization(r.Header.Get("Authorization"))
+
+	switch {
+	case len(pathlist) == 0 && requestType == "post":
+		submitJob(w, r)
+	case len(pathlist) == 0 && requestType == "get":
+		jobs.mutex.Lock()
+		statuses := []jobStatus{}
+		for _, j := range jobs.jobs {
+			if j.owner == owner {
+				statuses = append(statuses, j.statusLocked())
+			}
+		}
+		jobs.mutex.Unlock()
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Created.Before(statuses[j].Created) })
+		writeJSON(w, statuses)
+	case len(pathlist) == 1 && requestType == "get":
+		jobs.mutex.Lock()
+		j, found := jobs.find(pathlist[0], owner)
+		var status jobStatus
+		if found {
+			status = j.statusLocked()
+		}
+		jobs.mutex.Unlock()
+		if !found {
+			http.Error(w, fmt.Sprintf("Job %s not found", pathlist[0]), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, status)
+	case len(pathlist) == 2 && requestType == "get":
+		jobResult(w, pathlist[0], owner)
+	case len(pathlist) == 1 && requestType == "delete":
+		if !jobs.remove(pathlist[0], owner) {
+			http.Error(w, fmt.Sprintf("Job %s not found", pathlist[0]), http.StatusNotFound)
+		}
+	default:
+		badRequest(w, "only supports posts to /jobs, gets, and deletes")
+	}
+}
+
+// submitJob validates and queues the request and returns the status of the new job
+func submitJob(w http.ResponseWriter, r *http.Request) {
+	// read json (and any bodies uploaded with it)
+	json_data, source, err := readRequest(w, r)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	service := "overlap"
+	if val, found := json_data["service"]; found {
+		service, _ = val.(string)
+		if service != "overlap" && service != "bodystats" {
+			badRequest(w, "Job service must be overlap or bodystats")
+			return
+		}
+		delete(json_data, "service")
+	}
+
+	// invalid requests are rejected now instead of failing once the job runs
+	schemaData, two_stage := statsSchema, false
+	if service == "overlap" {
+		schemaData = overlapSchema
+		two_stage, _ = json_data["two-stage"].(bool)
+	}
+	check_source := source
+	if check_source == nil {
+		check_source = bodySource
+	}
+	if _, err = checkRequest(json_data, schemaData, check_source, two_stage); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Job id could not be created: %v", err), http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:            id,
+		service:       service,
+		json_data:     json_data,
+		source:        source,
+		authorization: callAuthorization(r, json_data),
+		caller:        r.RemoteAddr,
+		owner:         hashAuthorization(r.Header.Get("Authorization")),
+		state:         jobQueued,
+		created:       time.Now(),
+		progress:      &fetchProgress{},
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	if err = jobs.submit(j); err != nil {
+		cancel()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	jobs.mutex.Lock()
+	status := j.statusLocked()
+	jobs.mutex.Unlock()
+	w.Header().Set("Location", jobsPath+id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	jsondata, _ := json.Marshal(status)
+	w.Write(jsondata)
+}
+
+// jobResult writes the result of a finished job of the owner (or the error of a failed job)
+func jobResult(w http.ResponseWriter, id, owner string) {
+	jobs.mutex.Lock()
+	j, found := jobs.find(id, owner)
+	var state string
+	var status int
+	var result []byte
+	if found {
+		state, status, result = j.state, j.status, j.result
+	}
+	jobs.mutex.Unlock()
+
+	switch {
+	case !found:
+		http.Error(w, fmt.Sprintf("Job %s not found", id), http.StatusNotFound)
+	case state == jobDone:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+	case state == jobFailed:
+		http.Error(w, strings.TrimSpace(string(result)), status)
+	default:
+		http.Error(w, fmt.Sprintf("Job %s is %s", id, state), http.StatusConflict)
+	}
+}
+
+// writeJSON writes the value as a JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	jsondata, _ := json.Marshal(value)
+	w.Write(jsondata)
+}
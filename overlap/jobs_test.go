@@ -0,0 +1,226 @@
+package overlap
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useJobQueue replaces the job queue until the test ends
+func useJobQueue(t *testing.T, maxPending int) {
+	saved := jobs
+	jobs = newJobQueue(maxPending)
+	t.Cleanup(func() { jobs = saved })
+}
+
+// jobRequest sends the request to the jobs handler with the Authorization header
+func jobRequest(method, path, authorization, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	jobsHandler(w, r)
+	return w
+}
+
+// testAuthorization is the Authorization header of the test jobs
+const testAuthorization = "Bearer test"
+
+// submitTestJob submits the request and returns the id of the job
+func submitTestJob(t *testing.T, authorization, body string) string {
+	t.Helper()
+	w := jobRequest("POST", jobsPath, authorization, body)
+	var status jobStatus
+	if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &status) != nil {
+		t.Fatalf("Job %s was not accepted: %d %q", body, w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != jobsPath+status.ID || status.Status != jobQueued {
+		t.Fatalf("Job %s was submitted at %s with status %s", status.ID, location, status.Status)
+	}
+	return status.ID
+}
+
+// testJobStatus returns the status of the job for the Authorization header
+func testJobStatus(t *testing.T, authorization, id string) jobStatus {
+	t.Helper()
+	w := jobRequest("GET", jobsPath+id, authorization, "")
+	var status jobStatus
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &status) != nil {
+		t.Fatalf("Status of job %s returned %d %q", id, w.Code, w.Body.String())
+	}
+	return status
+}
+
+// runPendingJobs executes the waiting jobs in order
+func runPendingJobs() {
+	for len(jobs.pending) > 0 {
+		jobs.execute(<-jobs.pending)
+	}
+}
+
+// checkJobResult fails the test if the result of the job does not have the status and response
+func checkJobResult(t *testing.T, id string, status int, response string) {
+	t.Helper()
+	w := jobRequest("GET", jobsPath+id+"/result", testAuthorization, "")
+	if body := strings.TrimSpace(w.Body.String()); w.Code != status || body != response {
+		t.Fatalf("Result of job %s is %d %q instead of %d %q", id, w.Code, body, status, response)
+	}
+}
+
+// blockingSource signals each fetch and then waits for the fetch to be canceled
+type blockingSource struct {
+	started chan bool
+}
+
+func (source *blockingSource) FetchBody(ctx context.Context, uuid string, bodyid uint64) (SparseBody, error) {
+	source.started <- true
+	<-ctx.Done()
+	return SparseBody{}, ctx.Err()
+}
+
+func TestJobs(t *testing.T) {
+	useJobQueue(t, 10)
+	useSource(t, testMemorySource(t, "abc"))
+
+	overlap := submitTestJob(t, testAuthorization, `{"uuid":"abc","bodies":[1,2]}`)
+	stats := submitTestJob(t, testAuthorization, `{"uuid":"abc","bodies":[1,2],"service":"bodystats"}`)
+	failed := submitTestJob(t, testAuthorization, `{"uuid":"abc","bodies":[9]}`)
+	checkJobResult(t, overlap, http.StatusConflict, "Job "+overlap+" is queued")
+	runPendingJobs()
+
+	status := testJobStatus(t, testAuthorization, overlap)
+	if status.Status != jobDone || status.BodiesTotal != 2 || status.BodiesFetched != 2 || status.Finished == nil {
+		t.Fatalf("Finished job has status %+v", status)
+	}
+	checkJobResult(t, overlap, http.StatusOK, `{"overlap-list":[[1,2,1]]}`)
+	checkJobResult(t, stats, http.StatusOK, `{"body-stats":[[2,3,14],[1,2,10]]}`)
+	checkJobResult(t, failed, http.StatusBadGateway, "No bodies could be fetched: Body 9 is not available at abc")
+
+	if w := jobRequest("POST", jobsPath, testAuthorization, `{"uuid":"abc","bodies":[1,2],"service":"other"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Job for an unknown service returned %d", w.Code)
+	}
+
+	// invalid requests are rejected instead of queued
+	for _, body := range []string{`{"uuid":"abc","bodies":[1,1]}`, `{"uuid":"abc","bodies":[1,2],"roi":"roi"}`} {
+		if w := jobRequest("POST", jobsPath, testAuthorization, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("Job %s returned %d", body, w.Code)
+		}
+	}
+	if len(jobs.pending) != 0 {
+		t.Fatalf("Invalid jobs were queued")
+	}
+
+	// callers without an Authorization header are refused
+	for _, method := range []string{"POST", "GET"} {
+		if w := jobRequest(method, jobsPath, "", `{"uuid":"abc","bodies":[1,2]}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s without authorization returned %d", method, w.Code)
+		}
+	}
+
+	// finished jobs are deleted
+	if w := jobRequest("DELETE", jobsPath+overlap, testAuthorization, ""); w.Code != http.StatusOK {
+		t.Fatalf("Delete of a finished job returned %d", w.Code)
+	}
+	checkJobResult(t, overlap, http.StatusNotFound, "Job "+overlap+" not found")
+}
+
+func TestJobQueueLimit(t *testing.T) {
+	useJobQueue(t, 1)
+	useSource(t, testMemorySource(t, "abc"))
+
+	queued := submitTestJob(t, testAuthorization, `{"uuid":"abc","bodies":[1,2]}`)
+	if w := jobRequest("POST", jobsPath, testAuthorization, `{"uuid":"abc","bodies":[1,2]}`); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Job beyond the queue limit returned %d", w.Code)
+	}
+
+	// canceled jobs are skipped and kept with their state
+	if w := jobRequest("DELETE", jobsPath+queued, testAuthorization, ""); w.Code != http.StatusOK {
+		t.Fatalf("Cancel of a waiting job returned %d", w.Code)
+	}
+	runPendingJobs()
+	if status := testJobStatus(t, testAuthorization, queued); status.Status != jobCanceled || status.BodiesFetched != 0 {
+		t.Fatalf("Canceled job has status %+v", status)
+	}
+	checkJobResult(t, queued, http.StatusConflict, "Job "+queued+" is canceled")
+}
+
+func TestJobOwner(t *testing.T) {
+	useJobQueue(t, 10)
+	useSource(t, testMemorySource(t, "abc"))
+
+	id := submitTestJob(t, "Bearer owner", `{"uuid":"abc","bodies":[1,2]}`)
+	runPendingJobs()
+
+	// jobs are only visible with the Authorization header they were submitted with
+	for _, authorization := range []string{testAuthorization, "Bearer other"} {
+		if w := jobRequest("GET", jobsPath+id, authorization, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("Status of another caller's job returned %d", w.Code)
+		}
+		if w := jobRequest("GET", jobsPath+id+"/result", authorization, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("Result of another caller's job returned %d", w.Code)
+		}
+		if w := jobRequest("DELETE", jobsPath+id, authorization, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("Delete of another caller's job returned %d", w.Code)
+		}
+		if w := jobRequest("GET", jobsPath, authorization, ""); w.Body.String() != "[]" {
+			t.Fatalf("Another caller's jobs were listed: %s", w.Body.String())
+		}
+	}
+	if w := jobRequest("GET", jobsPath, "Bearer owner", ""); !strings.Contains(w.Body.String(), id) {
+		t.Fatalf("Caller's jobs were not listed: %s", w.Body.String())
+	}
+	if w := jobRequest("DELETE", jobsPath+id, "Bearer owner", ""); w.Code != http.StatusOK {
+		t.Fatalf("Delete of the caller's job returned %d", w.Code)
+	}
+}
+
+func TestJobDeadline(t *testing.T) {
+	useJobQueue(t, 10)
+	source := &blockingSource{make(chan bool, 10)}
+	useSource(t, source)
+	defer func(saved time.Duration) { jobDeadline = saved }(jobDeadline)
+	jobDeadline = 20 * time.Millisecond
+
+	// the job fails once its own deadline passes
+	id := submitTestJob(t, testAuthorization, `{"uuid":"abc","bodies":[1,2]}`)
+	start := time.Now()
+	runPendingJobs()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Job took %v with a deadline of %v", elapsed, jobDeadline)
+	}
+	if status := testJobStatus(t, testAuthorization, id); status.Status != jobFailed {
+		t.Fatalf("Job past its deadline has status %s", status.Status)
+	}
+}
+
+func TestJobWorkers(t *testing.T) {
+	useJobQueue(t, 10)
+	source := &blockingSource{make(chan bool, 10)}
+	useSource(t, source)
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	jobs.start(ctx, 2)
+
+	// running jobs are canceled
+	id := submitTestJob(t, testAuthorization, `{"uuid":"abc","bodies":[1,2]}`)
+	<-source.started
+	if status := testJobStatus(t, testAuthorization, id); status.Status != jobRunning || status.Started == nil {
+		t.Fatalf("Running job has status %+v", status)
+	}
+	if w := jobRequest("DELETE", jobsPath+id, testAuthorization, ""); w.Code != http.StatusOK {
+		t.Fatalf("Cancel of a running job returned %d", w.Code)
+	}
+	for i := 0; i < 100 && testJobStatus(t, testAuthorization, id).Finished == nil; i += 1 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status := testJobStatus(t, testAuthorization, id); status.Status != jobCanceled || status.Finished == nil {
+		t.Fatalf("Canceled job has status %+v", status)
+	}
+
+	stopWorkers()
+	jobs.stop()
+}
@@ -0,0 +1,201 @@
+package overlap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"time"
+)
+
+// DefaultJobExpiry is the time a finished job is kept if not configured
+const DefaultJobExpiry = 24 * time.Hour
+
+// jobsBucket holds a JSON record for each job by id
+var jobsBucket = []byte("jobs")
+
+// jobExpiry is the time a finished job (and its result) is kept (negative keeps them until deleted)
+var jobExpiry = DefaultJobExpiry
+
+// jobStore persists the jobs so that waiting jobs resume and results remain available after a restart
+type jobStore struct {
+	db *bolt.DB
+}
+
+// jobRecord is the stored form of a job (the caller's credentials are not stored, so only jobs that
+// used the configured Authorization header can resume)
+type jobRecord struct {
+	ID       string                 `json:"id"`
+	Service  string                 `json:"service"`
+	Request  map[string]interface{} `json:"request"`
+	Bodies   []uploadedBody         `json:"bodies,omitempty"`
+	Caller   string                 `json:"caller"`
+	Owner    string                 `json:"owner"`
+	State    string                 `json:"state"`
+	Created  time.Time              `json:"created"`
+	Started  time.Time              `json:"started"`
+	Finished time.Time              `json:"finished"`
+	Status   int                    `json:"status"`
+	Result   []byte                 `json:"result,omitempty"`
+	// the job was submitted with the caller's own Authorization header
+	CallerAuthorization bool `json:"caller-authorization,omitempty"`
+}
+
+// uploadedBody is a body uploaded with a job, stored as a DVID sparse volume
+type uploadedBody struct {
+	UUID      string `json:"uuid"`
+	Body      uint64 `json:"body"`
+	Sparsevol []byte `json:"sparsevol"`
+}
+
+// openJobStore opens (or creates) the job database
+func openJobStore(filename string) (*jobStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &jobStore{db}, nil
+}
+
+// put stores the job without the "authorization" of its request (the caller must hold the lock of the queue)
+func (js *jobStore) put(j *job) error {
+	request := make(map[string]interface{})
+	for field, val := range j.json_data {
+		if field != "authorization" {
+			request[field] = val
+		}
+	}
+	record := jobRecord{
+		ID:       j.id,
+		Service:  j.service,
+		Request:  request,
+		Caller:   j.caller,
+		Owner:    j.owner,
+		State:    j.state,
+		Created:  j.created,
+		Started:  j.started,
+		Finished: j.finished,
+		Status:   j.status,
+		Result:   j.result,
+
+		CallerAuthorization: j.authorization != dvidAuthorization,
+	}
+	if source, found := j.source.(*MemorySource); found {
+		record.Bodies = source.uploadedBodies()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return js.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(j.id), data)
+	})
+}
+
+// delete removes the job
+func (js *jobStore) delete(id string) error {
+	return js.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+// load reads the stored jobs (jobs that were running when the service stopped are queued again, except
+// that the unfinished jobs submitted with the caller's own Authorization header fail since it was not
+// stored)
+func (js *jobStore) load() ([]*job, error) {
+	var loaded, interrupted []*job
+	err := js.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(key, data []byte) error {
+			// request values are decoded as json.Number as for service calls
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			var record jobRecord
+			if err := decoder.Decode(&record); err != nil {
+				return fmt.Errorf("Job %s could not be decoded: %v", key, err)
+			}
+
+			j := &job{
+				id:            record.ID,
+				service:       record.Service,
+				json_data:     record.Request,
+				authorization: dvidAuthorization,
+				caller:        record.Caller,
+				owner:         record.Owner,
+				state:         record.State,
+				created:       record.Created,
+				started:       record.Started,
+				finished:      record.Finished,
+				progress:      &fetchProgress{},
+				status:        record.Status,
+				result:        record.Result,
+			}
+			if len(record.Bodies) > 0 {
+				source := NewMemorySource()
+				for _, body := range record.Bodies {
+					if err := source.AddSparsevol(body.UUID, body.Body, bytes.NewReader(body.Sparsevol)); err != nil {
+						return fmt.Errorf("Bodies of job %s could not be decoded: %v", key, err)
+					}
+				}
+				j.source = source
+			}
+			// requests stored by earlier versions may still hold the caller's header
+			if _, found := record.Request["authorization"]; found {
+				delete(record.Request, "authorization")
+				record.CallerAuthorization = true
+			}
+			if (j.state == jobQueued || j.state == jobRunning) && record.CallerAuthorization {
+				j.state = jobFailed
+				j.finished = time.Now()
+				j.status = http.StatusServiceUnavailable
+				j.result = []byte("Job was interrupted by a restart and must be submitted again since the caller's Authorization header is not stored\n")
+				interrupted = append(interrupted, j)
+			} else if j.state == jobRunning {
+				j.state = jobQueued
+				j.started = time.Time{}
+			}
+			j.ctx, j.cancel = context.WithCancel(context.Background())
+			loaded = append(loaded, j)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, j := range interrupted {
+		if err = js.put(j); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// uploadedBodies returns the stored bodies as DVID sparse volumes
+func (source *MemorySource) uploadedBodies() []uploadedBody {
+	source.mutex.RLock()
+	defer source.mutex.RUnlock()
+
+	var bodies []uploadedBody
+	for uuid, uuid_bodies := range source.bodies {
+		for bodyid, sparse_body := range uuid_bodies {
+			bodies = append(bodies, uploadedBody{uuid, bodyid, encodeSparsevol(sparse_body)})
+		}
+	}
+	return bodies
+}
+
+// expired checks whether a finished job has been kept for the expiry
+func (j *job) expired(now time.Time) bool {
+	return jobExpiry >= 0 && !j.finished.IsZero() && j.state != jobQueued && j.state != jobRunning &&
+		now.Sub(j.finished) > jobExpiry
+}
@@ -0,0 +1,124 @@
+package overlap
+
+import (
+	"bytes"
+	"context"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// restartJobQueue opens the job store as a restart would and restores its jobs into a new queue
+func restartJobQueue(t *testing.T, filename string) {
+	t.Helper()
+	store, err := openJobStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs = newJobQueue(10)
+	if err = jobs.restore(store); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.db")
+	useJobQueue(t, 10)
+	defer func(saved time.Duration) { jobExpiry = saved }(jobExpiry)
+	restartJobQueue(t, filename)
+
+	// an uploaded job that waits and a job that is running when the service stops
+	source := &blockingSource{make(chan bool, 10)}
+	useSource(t, source)
+	waiting := submitTestJob(t, testAuthorization, `{"rles":{"1":[[0,0,0,2]],"2":[[2,0,0,3]]}}`)
+	running := submitTestJob(t, testAuthorization, `{"uuid":"abc","bodies":[1,2]}`)
+
+	// only the second job is run before the service stops (the first stays queued in the store)
+	<-jobs.pending
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	jobs.start(ctx, 1)
+	<-source.started
+	stopWorkers()
+	jobs.stop()
+
+	// both jobs run after the restart
+	restartJobQueue(t, filename)
+	if len(jobs.pending) != 2 {
+		t.Fatalf("%d jobs are waiting after the restart instead of 2", len(jobs.pending))
+	}
+	useSource(t, testMemorySource(t, "abc"))
+	runPendingJobs()
+	checkJobResult(t, waiting, http.StatusOK, `{"overlap-list":[[1,2,1]]}`)
+	checkJobResult(t, running, http.StatusOK, `{"overlap-list":[[1,2,1]]}`)
+	jobs.stop()
+
+	// results are kept until they expire
+	restartJobQueue(t, filename)
+	if len(jobs.jobs) != 2 || len(jobs.pending) != 0 {
+		t.Fatalf("%d jobs (%d waiting) were restored instead of 2 finished jobs", len(jobs.jobs), len(jobs.pending))
+	}
+	checkJobResult(t, waiting, http.StatusOK, `{"overlap-list":[[1,2,1]]}`)
+	jobs.stop()
+
+	jobExpiry = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	restartJobQueue(t, filename)
+	if len(jobs.jobs) != 0 {
+		t.Fatalf("%d expired jobs were restored", len(jobs.jobs))
+	}
+	jobs.stop()
+}
+
+func TestJobStoreCredentials(t *testing.T) {
+	store, err := openJobStore(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.db.Close()
+
+	// testJob is a waiting job that sends the Authorization header to DVID
+	testJob := func(id, authorization string) *job {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &job{
+			id:            id,
+			service:       "overlap",
+			json_data:     map[string]interface{}{"uuid": "abc", "authorization": "Bearer secret"},
+			authorization: authorization,
+			state:         jobQueued,
+			created:       time.Now(),
+			progress:      &fetchProgress{},
+			ctx:           ctx,
+			cancel:        cancel,
+		}
+	}
+	store.put(testJob("caller", "Bearer secret"))
+	store.put(testJob("configured", dvidAuthorization))
+
+	// credentials are never stored
+	store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(key, data []byte) error {
+			if bytes.Contains(data, []byte("secret")) {
+				t.Fatalf("Credentials of job %s were stored: %s", key, data)
+			}
+			return nil
+		})
+	})
+
+	// jobs that used the caller's credentials fail since they cannot resume, and the failure is stored
+	for restart := 0; restart < 2; restart += 1 {
+		loaded, err := store.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, j := range loaded {
+			if j.id == "caller" && (j.state != jobFailed || j.status != http.StatusServiceUnavailable) {
+				t.Fatalf("Job with the caller's credentials is %s (%d) after a restart", j.state, j.status)
+			}
+			if j.id == "configured" && j.state != jobQueued {
+				t.Fatalf("Job with the configured credentials is %s after a restart", j.state)
+			}
+		}
+	}
+}
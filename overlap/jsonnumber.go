@@ -0,0 +1,58 @@
+package overlap
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// Requests are decoded with json.Number so that body ids above 2^53 are not rounded
+
+// jsonUint64 converts a decoded JSON number to an unsigned integer
+func jsonUint64(val interface{}) (uint64, bool) {
+	switch num := val.(type) {
+	case json.Number:
+		id, err := strconv.ParseUint(string(num), 10, 64)
+		return id, err == nil
+	case float64:
+		if num < 0 || num != math.Trunc(num) {
+			return 0, false
+		}
+		return uint64(num), true
+	}
+	return 0, false
+}
+
+// jsonFloat converts a decoded JSON number to a float64
+func jsonFloat(val interface{}) (float64, bool) {
+	switch num := val.(type) {
+	case json.Number:
+		fval, err := num.Float64()
+		return fval, err == nil
+	case float64:
+		return num, true
+	}
+	return 0, false
+}
+
+// validationData returns a copy of the JSON with float64 numbers for the schema validator
+func validationData(val interface{}) interface{} {
+	switch data := val.(type) {
+	case json.Number:
+		fval, _ := data.Float64()
+		return fval
+	case map[string]interface{}:
+		data_copy := make(map[string]interface{})
+		for key, elem := range data {
+			data_copy[key] = validationData(elem)
+		}
+		return data_copy
+	case []interface{}:
+		data_copy := make([]interface{}, len(data))
+		for i, elem := range data {
+			data_copy[i] = validationData(elem)
+		}
+		return data_copy
+	}
+	return val
+}
@@ -0,0 +1,66 @@
+package overlap
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// bodyMapping relabels bodies before computing (e.g., to preview merges that are not in DVID)
+type bodyMapping map[uint64]uint64
+
+// getMapping retrieves the body mapping from the JSON (nil if no mapping is given)
+func getMapping(json_data map[string]interface{}) (bodyMapping, error) {
+	mapinter, found := json_data["mapping"].(map[string]interface{})
+	if !found {
+		return nil, nil
+	}
+
+	mapping := make(bodyMapping)
+	for bodystr, newinter := range mapinter {
+		bodyid, err := strconv.ParseUint(bodystr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Mapping contains an invalid body id %s", bodystr)
+		}
+		newid, found := jsonUint64(newinter)
+		if !found || newid < 1 {
+			return nil, fmt.Errorf("Mapping for body %s is not a valid body id", bodystr)
+		}
+		mapping[bodyid] = newid
+	}
+	return mapping, nil
+}
+
+// mapID returns the new id for the body
+func (mapping bodyMapping) mapID(bodyid uint64) uint64 {
+	if newid, found := mapping[bodyid]; found {
+		return newid
+	}
+	return bodyid
+}
+
+// relabelBodies merges the RLEs of the bodies that are mapped to the same id
+func (mapping bodyMapping) relabelBodies(sparse_bodies sparseBodies) sparseBodies {
+	var merged_bodies sparseBodies
+	positions := make(map[uint64]int)
+	for _, sparse_body := range sparse_bodies {
+		newid := mapping.mapID(sparse_body.bodyID)
+		if pos, found := positions[newid]; found {
+			merged_bodies[pos].rle = append(merged_bodies[pos].rle, sparse_body.rle...)
+			continue
+		}
+
+		positions[newid] = len(merged_bodies)
+		merged_body := SparseBody{}
+		merged_body.bodyID = newid
+		merged_body.rle = append(merged_body.rle, sparse_body.rle...)
+		merged_bodies = append(merged_bodies, merged_body)
+	}
+	return merged_bodies
+}
+
+// relabelSupervoxels maps the body of each supervoxel to its new id
+func (mapping bodyMapping) relabelSupervoxels(svmap supervoxelMap) {
+	for svid, bodyid := range svmap {
+		svmap[svid] = mapping.mapID(bodyid)
+	}
+}
@@ -0,0 +1,397 @@
+package overlap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMutationPoll is the interval between checks for new mutations if not configured
+const DefaultMutationPoll = 30 * time.Second
+
+// watchExpiry is the time a node is polled after its bodies were last requested (its cached bodies are
+// then evicted since they are no longer kept up to date)
+const watchExpiry = time.Hour
+
+// mutationsPath is the URI that receives DVID mutation records
+const mutationsPath = "/mutations/"
+
+// mutationAuthorization is the Authorization header that pushed mutations must carry (pushes are refused
+// if empty)
+var mutationAuthorization string
+
+// mutationLabels are the fields of the DVID labelmap mutation records (merge, split, cleave,
+// split-supervoxel, and renumber) that hold affected body or supervoxel ids
+var mutationLabels = []string{"Target", "Labels", "NewLabel", "OrigLabel", "CleavedLabel", "Body", "Supervoxel", "SplitSupervoxel", "RemainSupervoxel"}
+
+// mutationRecord is a decoded DVID mutation record
+type mutationRecord map[string]interface{}
+
+// mutationID returns the id of the mutation (0 if missing)
+func (record mutationRecord) mutationID() uint64 {
+	id, _ := jsonUint64(record["MutationID"])
+	return id
+}
+
+// affectedLabels returns the bodies and supervoxels changed by the mutation
+func (record mutationRecord) affectedLabels() []uint64 {
+	var labels []uint64
+	for _, field := range mutationLabels {
+		switch val := record[field].(type) {
+		case []interface{}:
+			for _, elem := range val {
+				if label, found := jsonUint64(elem); found {
+					labels = append(labels, label)
+				}
+			}
+		default:
+			if label, found := jsonUint64(val); found {
+				labels = append(labels, label)
+			}
+		}
+	}
+	return labels
+}
+
+// sameNode checks whether two (possibly abbreviated) uuids refer to the same node
+func sameNode(uuid1, uuid2 string) bool {
+	return uuid1 != "" && uuid2 != "" && (strings.HasPrefix(uuid1, uuid2) || strings.HasPrefix(uuid2, uuid1))
+}
+
+// evictLabels removes the bodies (and the results that use them) of a node from the caches
+func evictLabels(uuid string, labels []uint64) {
+	if len(labels) == 0 {
+		return
+	}
+	affected := make(map[uint64]bool)
+	for _, label := range labels {
+		affected[label] = true
+	}
+
+	if cache != nil {
+		cache.evict(uuid, affected)
+	}
+	if diskcache != nil {
+		diskcache.evict(uuid, affected)
+	}
+}
+
+// evict removes the bodies of the node that are affected (and stops the fetches in progress for the node
+// from caching what they read)
+func (c *bodyCache) evict(uuid string, affected map[uint64]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, elem := range c.entries {
+		if affected[key.bodyID] && sameNode(key.uuid, uuid) {
+			c.removeElement(elem)
+		}
+	}
+	for fetchuuid, fetches := range c.fetches {
+		if sameNode(fetchuuid, uuid) {
+			fetches.generation += 1
+		}
+	}
+}
+
+// evictNode removes all of the bodies of a label instance at the node
+func (c *bodyCache) evictNode(node watchedNode) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, elem := range c.entries {
+		if key.dvidserver == node.dvidserver && key.uuid == node.uuid && key.instance == node.instance {
+			c.removeElement(elem)
+		}
+	}
+	for fetchuuid, fetches := range c.fetches {
+		if fetchuuid == node.uuid {
+			fetches.generation += 1
+		}
+	}
+}
+
+// evict removes the stored bodies of the node that are affected and the results whose request names
+// an affected body
+func (dc *diskCache) evict(uuid string, affected map[uint64]bool) {
+	dc.db.Update(func(tx *bolt.Tx) error {
+		var bodykeys, resultkeys [][]byte
+		tx.Bucket(bodiesBucket).ForEach(func(key, _ []byte) error {
+			parts := bytes.SplitN(key, []byte{0}, 2)
+			if len(key) >= 8 && sameNode(string(parts[0]), uuid) && affected[binary.BigEndian.Uint64(key[len(key)-8:])] {
+				bodykeys = append(bodykeys, append([]byte{}, key...))
+			}
+			return nil
+		})
+		tx.Bucket(resultsBucket).ForEach(func(key, _ []byte) error {
+			parts := bytes.Split(key, []byte{0})
+			if len(parts) >= 6 && sameNode(string(parts[0]), uuid) && requestUsesLabels(parts[len(parts)-2], affected) {
+				resultkeys = append(resultkeys, append([]byte{}, key...))
+			}
+			return nil
+		})
+
+		for _, key := range bodykeys {
+			tx.Bucket(bodiesBucket).Delete(key)
+		}
+		for _, key := range resultkeys {
+			tx.Bucket(resultsBucket).Delete(key)
+		}
+		return nil
+	})
+}
+
+// requestUsesLabels checks whether a stored request names an affected body (in its bodies or mapping)
+func requestUsesLabels(request []byte, affected map[uint64]bool) bool {
+	decoder := json.NewDecoder(bytes.NewReader(request))
+	decoder.UseNumber()
+	var json_data map[string]interface{}
+	if err := decoder.Decode(&json_data); err != nil {
+		return true
+	}
+
+	bodies, _ := json_data["bodies"].([]interface{})
+	for _, bodyinter := range bodies {
+		if bodyid, found := jsonUint64(bodyinter); found && affected[bodyid] {
+			return true
+		}
+	}
+	mapping, _ := json_data["mapping"].(map[string]interface{})
+	for _, newinter := range mapping {
+		if newid, found := jsonUint64(newinter); found && affected[newid] {
+			return true
+		}
+	}
+	return false
+}
+
+// watchedNode is an unlocked label instance whose mutations are polled
+type watchedNode struct {
+	dvidserver string
+	uuid       string
+	instance   string
+}
+
+// watchState is the polling state of a watched node
+type watchState struct {
+	// last mutation id processed (nil until the node is first polled)
+	last *uint64
+	// number of records of the mutation log already processed
+	offset int
+	// last time bodies of the node were requested
+	used time.Time
+}
+
+// mutationWatcher polls the mutations of the unlocked nodes that bodies were cached from
+type mutationWatcher struct {
+	mutex sync.Mutex
+	nodes map[watchedNode]*watchState
+}
+
+// watcher polls the nodes with cached bodies (nil if polling is disabled)
+var watcher = &mutationWatcher{nodes: make(map[watchedNode]*watchState)}
+
+// mutationPoll is the interval between polls of the watched nodes
+var mutationPoll = DefaultMutationPoll
+
+// watch adds a node to be polled (or renews the watch of a polled node)
+func (mw *mutationWatcher) watch(node watchedNode) {
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+	if state, found := mw.nodes[node]; found {
+		state.used = time.Now()
+	} else {
+		mw.nodes[node] = &watchState{used: time.Now()}
+	}
+}
+
+// expire stops polling the nodes whose bodies have not been requested within watchExpiry and returns them
+func (mw *mutationWatcher) expire(now time.Time) []watchedNode {
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+
+	var expired []watchedNode
+	for node, state := range mw.nodes {
+		if now.Sub(state.used) > watchExpiry {
+			expired = append(expired, node)
+			delete(mw.nodes, node)
+		}
+	}
+	return expired
+}
+
+// run polls the watched nodes until the context is done
+func (mw *mutationWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(mutationPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// the bodies of nodes no longer polled would go stale
+		for _, node := range mw.expire(time.Now()) {
+			if cache != nil {
+				cache.evictNode(node)
+			}
+		}
+
+		mw.mutex.Lock()
+		var nodes []watchedNode
+		for node := range mw.nodes {
+			nodes = append(nodes, node)
+		}
+		mw.mutex.Unlock()
+
+		for _, node := range nodes {
+			if err := mw.poll(ctx, node); err != nil {
+				fmt.Printf("Mutations could not be polled: %v\n", err)
+			}
+		}
+	}
+}
+
+// poll evicts the labels of the mutations not yet processed (every mutation is applied the first time
+// a node is polled since bodies may have been cached before the watch started)
+func (mw *mutationWatcher) poll(ctx context.Context, node watchedNode) error {
+	ctx, cancel := context.WithTimeout(ctx, requestDeadline)
+	defer cancel()
+
+	mw.mutex.Lock()
+	state, found := mw.nodes[node]
+	var last *uint64
+	var offset int
+	if found {
+		last = state.last
+		offset = state.offset
+	}
+	mw.mutex.Unlock()
+
+	url := node.dvidserver + "/api/node/" + node.uuid + "/" + node.instance + "/mutations"
+	resp, err := dvid.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var records []mutationRecord
+	count := 0
+	if resp.StatusCode != http.StatusNoContent {
+		records, count, err = decodeMutations(resp.Body, offset)
+		if err != nil {
+			return fmt.Errorf("JSON from %s could not be decoded", url)
+		}
+	}
+
+	var labels []uint64
+	var maxid uint64
+	for _, record := range records {
+		id := record.mutationID()
+		if last != nil && id <= *last {
+			continue
+		}
+		labels = append(labels, record.affectedLabels()...)
+		if id > maxid {
+			maxid = id
+		}
+	}
+	if last != nil && maxid < *last {
+		maxid = *last
+	}
+	evictLabels(node.uuid, labels)
+
+	// the node may have expired while it was polled
+	mw.mutex.Lock()
+	if state, found := mw.nodes[node]; found {
+		state.last = &maxid
+		state.offset = count
+	}
+	mw.mutex.Unlock()
+	return nil
+}
+
+// decodeMutations decodes the records of a mutation log after the first offset records, which are
+// skipped without being decoded since the log only grows, and returns them with the length of the log
+// (every record is decoded if the log is shorter than the offset)
+func decodeMutations(reader io.Reader, offset int) ([]mutationRecord, int, error) {
+	var log []json.RawMessage
+	if err := json.NewDecoder(reader).Decode(&log); err != nil {
+		return nil, 0, err
+	}
+	if offset > len(log) {
+		offset = 0
+	}
+
+	// labels are decoded as json.Number so that ids above 2^53 are not rounded
+	records := make([]mutationRecord, 0, len(log)-offset)
+	for _, raw := range log[offset:] {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		var record mutationRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+	}
+	return records, len(log), nil
+}
+
+// mutationsHandler receives DVID mutation records (a single record or a list) pushed for a node
+// as /mutations/<uuid> (the uuid may instead be given in each record's "UUID").  The push must carry
+// the configured mutation Authorization header.
+func mutationsHandler(w http.ResponseWriter, r *http.Request) {
+	pathlist, requestType, err := parseURI(r, mutationsPath)
+	if err != nil || len(pathlist) > 1 {
+		badRequest(w, "Error: incorrectly formatted request")
+		return
+	}
+	if requestType != "post" {
+		badRequest(w, "only supports posts")
+		return
+	}
+	if !checkAuthorization(w, r, mutationAuthorization) {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	var data interface{}
+	if err = decoder.Decode(&data); err != nil {
+		badRequest(w, "Mutation records could not be decoded")
+		return
+	}
+
+	var records []mutationRecord
+	switch val := data.(type) {
+	case map[string]interface{}:
+		records = append(records, mutationRecord(val))
+	case []interface{}:
+		for _, elem := range val {
+			if record, found := elem.(map[string]interface{}); found {
+				records = append(records, mutationRecord(record))
+			}
+		}
+	}
+
+	for _, record := range records {
+		uuid, _ := record["UUID"].(string)
+		if len(pathlist) == 1 {
+			uuid = pathlist[0]
+		}
+		if uuid == "" {
+			badRequest(w, "Mutation records must give the uuid")
+			return
+		}
+		evictLabels(uuid, record.affectedLabels())
+	}
+}
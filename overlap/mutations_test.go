@@ -0,0 +1,197 @@
+package overlap
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cachedBodies returns the ids of the bodies in the cache at the node
+func cachedBodies(c *bodyCache, uuid string) map[uint64]bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	bodyids := make(map[uint64]bool)
+	for key := range c.entries {
+		if key.uuid == uuid {
+			bodyids[key.bodyID] = true
+		}
+	}
+	return bodyids
+}
+
+// pushMutations posts the mutation records with the Authorization header and returns the status
+func pushMutations(path, records, authorization string) int {
+	r := httptest.NewRequest("POST", path, strings.NewReader(records))
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	mutationsHandler(w, r)
+	return w.Code
+}
+
+func TestMutationAuthorization(t *testing.T) {
+	defer func(saved string) { mutationAuthorization = saved }(mutationAuthorization)
+	useCache(t, newBodyCache(100))
+	cache.put(testKey("abcdef", 5), spansBody(5, 1), 0)
+
+	// pushes are rejected unless the authorization is configured and matches
+	mutationAuthorization = ""
+	if status := pushMutations("/mutations/abc", `{"Target":5}`, "Bearer any"); status != http.StatusForbidden {
+		t.Fatalf("Push without a configured authorization returned %d", status)
+	}
+	mutationAuthorization = "Bearer secret"
+	if status := pushMutations("/mutations/abc", `{"Target":5}`, ""); status != http.StatusUnauthorized {
+		t.Fatalf("Push without authorization returned %d", status)
+	}
+	for _, authorization := range []string{"Bearer wrong", "Bearer secret2"} {
+		if status := pushMutations("/mutations/abc", `{"Target":5}`, authorization); status != http.StatusForbidden {
+			t.Fatalf("Push with authorization %q returned %d", authorization, status)
+		}
+	}
+	if !cachedBodies(cache, "abcdef")[5] {
+		t.Fatalf("Rejected push evicted a body")
+	}
+	if status := pushMutations("/mutations/abc", `{"Target":5}`, "Bearer secret"); status != http.StatusOK {
+		t.Fatalf("Authorized push returned %d", status)
+	}
+	if cachedBodies(cache, "abcdef")[5] {
+		t.Fatalf("Authorized push did not evict the body")
+	}
+}
+
+func TestMutationPush(t *testing.T) {
+	defer func(saved string) { mutationAuthorization = saved }(mutationAuthorization)
+	mutationAuthorization = "Bearer secret"
+	useCache(t, newBodyCache(100))
+	for _, bodyid := range []uint64{1, 2, 3, 4, 1 << 60} {
+		cache.put(testKey("abcdef", bodyid), spansBody(bodyid, 1), 0)
+		cache.put(testKey("123456", bodyid), spansBody(bodyid, 1), 0)
+	}
+
+	// labels above 2^53 are evicted exactly
+	records := `[{"Action":"merge","Target":1,"Labels":[1152921504606846976],"MutationID":5},{"UUID":"123","Action":"split","Target":3}]`
+	if status := pushMutations("/mutations/abc", records, "Bearer secret"); status != http.StatusOK {
+		t.Fatalf("Push returned %d", status)
+	}
+	remaining := cachedBodies(cache, "abcdef")
+	if remaining[1] || remaining[1<<60] || remaining[3] || !remaining[2] || !remaining[4] {
+		t.Fatalf("Push to the node left bodies %v", remaining)
+	}
+	if len(cachedBodies(cache, "123456")) != 5 {
+		t.Fatalf("Push to another node evicted its bodies")
+	}
+
+	// records give their own node without one in the path
+	if status := pushMutations("/mutations/", `{"UUID":"123","Action":"cleave","OrigLabel":2,"CleavedLabel":9}`, "Bearer secret"); status != http.StatusOK {
+		t.Fatalf("Push returned %d", status)
+	}
+	if cachedBodies(cache, "123456")[2] {
+		t.Fatalf("Push with the node in the record did not evict the body")
+	}
+	if status := pushMutations("/mutations/", `{"Target":4}`, "Bearer secret"); status != http.StatusBadRequest {
+		t.Fatalf("Push without a node returned %d", status)
+	}
+}
+
+func TestMutationPoll(t *testing.T) {
+	useCache(t, newBodyCache(100))
+	records := `[{"Action":"cleave","OrigLabel":2,"CleavedLabel":9,"MutationID":3},{"Action":"split","Target":3,"NewLabel":10,"MutationID":4}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/node/abcdef/segmentation/mutations" {
+			http.NotFound(w, r)
+			return
+		}
+		if records == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(records))
+	}))
+	defer server.Close()
+	for _, bodyid := range []uint64{1, 2, 3} {
+		cache.put(testKey("abcdef", bodyid), spansBody(bodyid, 1), 0)
+	}
+
+	// every mutation is applied the first time the node is polled
+	node := watchedNode{server.URL, "abcdef", "segmentation"}
+	mw := &mutationWatcher{nodes: make(map[watchedNode]*watchState)}
+	mw.watch(node)
+	if err := mw.poll(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := cachedBodies(cache, "abcdef"); len(remaining) != 1 || !remaining[1] {
+		t.Fatalf("First poll left bodies %v", remaining)
+	}
+	if last := mw.nodes[node].last; last == nil || *last != 4 {
+		t.Fatalf("Last mutation was not recorded")
+	}
+
+	// mutations already processed are skipped
+	cache.put(testKey("abcdef", 3), spansBody(3, 1), 0)
+	if err := mw.poll(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if !cachedBodies(cache, "abcdef")[3] {
+		t.Fatalf("Processed mutation evicted a body again")
+	}
+	if offset := mw.nodes[node].offset; offset != 2 {
+		t.Fatalf("Poll recorded offset %d in the mutation log", offset)
+	}
+
+	// only the records added to the log are decoded
+	records = `["processed","processed",{"Action":"merge","Target":1,"Labels":[3],"MutationID":5}]`
+	if err := mw.poll(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if len(cachedBodies(cache, "abcdef")) != 0 {
+		t.Fatalf("New mutation did not evict the bodies")
+	}
+
+	// a shorter log is decoded again with the processed mutations skipped by id
+	cache.put(testKey("abcdef", 3), spansBody(3, 1), 0)
+	records = `[{"Action":"merge","Target":1,"Labels":[3],"MutationID":5}]`
+	if err := mw.poll(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if !cachedBodies(cache, "abcdef")[3] || mw.nodes[node].offset != 1 {
+		t.Fatalf("Shorter log was not decoded again (offset %d)", mw.nodes[node].offset)
+	}
+
+	// a node without mutations has no content
+	records = ""
+	if err := mw.poll(context.Background(), node); err != nil {
+		t.Fatalf("Poll without mutations failed: %v", err)
+	}
+}
+
+func TestWatchExpiry(t *testing.T) {
+	useCache(t, newBodyCache(100))
+	node := watchedNode{"http://dvid", "abcdef", "segmentation"}
+	cache.put(testKey("abcdef", 1), spansBody(1, 1), 0)
+	other := testKey("abcdef", 1)
+	other.instance = "other"
+	cache.put(other, spansBody(1, 1), 0)
+
+	mw := &mutationWatcher{nodes: make(map[watchedNode]*watchState)}
+	mw.watch(node)
+	if expired := mw.expire(time.Now()); len(expired) != 0 {
+		t.Fatalf("Node expired while in use: %v", expired)
+	}
+	expired := mw.expire(time.Now().Add(2 * watchExpiry))
+	if len(expired) != 1 || expired[0] != node || len(mw.nodes) != 0 {
+		t.Fatalf("Unused node did not expire: %v", expired)
+	}
+
+	// only the bodies of the expired instance are evicted
+	cache.evictNode(node)
+	if _, found := cache.get(testKey("abcdef", 1)); found {
+		t.Fatalf("Body of the expired node is still cached")
+	}
+	if _, found := cache.get(other); !found {
+		t.Fatalf("Body of another instance was evicted")
+	}
+}
@@ -0,0 +1,111 @@
+package overlap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// npyMagic starts every .npy file
+const npyMagic = "\x93NUMPY"
+
+var (
+	npyDescr   = regexp.MustCompile(`'descr'\s*:\s*'([^']*)'`)
+	npyFortran = regexp.MustCompile(`'fortran_order'\s*:\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`'shape'\s*:\s*\(([^)]*)\)`)
+)
+
+// openNPY reads the header of a .npy label array (C order arrays are indexed [z][y][x] and Fortran
+// order arrays are indexed [x][y][z] so that x always varies fastest)
+func openNPY(filename string) (*rawVolume, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Label volume could not be read: %v", err)
+	}
+	defer file.Close()
+
+	var preamble [10]byte
+	if _, err = io.ReadFull(file, preamble[:]); err != nil || string(preamble[:6]) != npyMagic {
+		return nil, fmt.Errorf("%s is not a .npy file", filename)
+	}
+
+	// version 1 uses a 2 byte header length and later versions use 4 bytes
+	headerlen := int64(binary.LittleEndian.Uint16(preamble[8:10]))
+	offset := int64(10)
+	if preamble[6] > 1 {
+		var extra [2]byte
+		if _, err = io.ReadFull(file, extra[:]); err != nil {
+			return nil, fmt.Errorf("%s has a truncated header", filename)
+		}
+		headerlen = int64(binary.LittleEndian.Uint32(append(preamble[8:10], extra[:]...)))
+		offset = 12
+	}
+	header := make([]byte, headerlen)
+	if _, err = io.ReadFull(file, header); err != nil {
+		return nil, fmt.Errorf("%s has a truncated header", filename)
+	}
+
+	descr := npyDescr.FindStringSubmatch(string(header))
+	fortran := npyFortran.FindStringSubmatch(string(header))
+	shapestr := npyShape.FindStringSubmatch(string(header))
+	if descr == nil || fortran == nil || shapestr == nil {
+		return nil, fmt.Errorf("%s has an invalid header", filename)
+	}
+
+	dtype, err := npyLabelType(descr[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var shape []int
+	for _, dimstr := range strings.Split(shapestr[1], ",") {
+		dimstr = strings.TrimSpace(dimstr)
+		if dimstr == "" {
+			continue
+		}
+		dim, err := strconv.Atoi(dimstr)
+		if err != nil {
+			return nil, fmt.Errorf("%s has an invalid shape", filename)
+		}
+		shape = append(shape, dim)
+	}
+	if len(shape) == 2 {
+		if fortran[1] == "True" {
+			shape = append(shape, 1)
+		} else {
+			shape = append([]int{1}, shape...)
+		}
+	}
+	if len(shape) != 3 {
+		return nil, fmt.Errorf("%s must be a 2D or 3D array", filename)
+	}
+
+	dims := [3]int{shape[2], shape[1], shape[0]}
+	if fortran[1] == "True" {
+		dims = [3]int{shape[0], shape[1], shape[2]}
+	}
+	return newRawVolume(filename, offset+headerlen, dims, dtype)
+}
+
+// npyLabelType converts a numpy type description (e.g., "<u8") to the label type
+func npyLabelType(descr string) (labelType, error) {
+	if len(descr) < 3 {
+		return labelType{}, fmt.Errorf("Array type %s is not supported", descr)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if descr[0] == '>' {
+		order = binary.BigEndian
+	}
+	if descr[1] != 'u' && descr[1] != 'i' {
+		return labelType{}, fmt.Errorf("Array type %s is not an integer type", descr)
+	}
+	size, err := strconv.Atoi(descr[2:])
+	if err != nil || (size != 1 && size != 2 && size != 4 && size != 8) {
+		return labelType{}, fmt.Errorf("Array type %s is not supported", descr)
+	}
+	return labelType{size, order}, nil
+}
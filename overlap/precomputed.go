@@ -0,0 +1,293 @@
+package overlap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// precomputedInfo is the part of the neuroglancer precomputed info file needed to read the chunks
+type precomputedInfo struct {
+	Type        string
+	DataType    string `json:"data_type"`
+	NumChannels int    `json:"num_channels"`
+	Scales      []struct {
+		Key        string
+		Size       []int
+		ChunkSizes [][]int `json:"chunk_sizes"`
+		Encoding   string
+		// size of a voxel (e.g., in nm)
+		Resolution []float64
+		// coordinate of the first voxel of the volume
+		VoxelOffset []int `json:"voxel_offset"`
+		// block size used for the compressed_segmentation encoding
+		BlockSize []int       `json:"compressed_segmentation_block_size"`
+		Sharding  interface{} `json:"sharding"`
+	}
+}
+
+// NewPrecomputedSource reads the segmentation at the given scale (0 is full resolution) of a neuroglancer
+// precomputed volume stored in a local directory (a file:// URL is also accepted).  Chunks may be raw or
+// compressed_segmentation and may be gzipped (with or without a .gz extension).
+func NewPrecomputedSource(url string, scale int) (*VolumeSource, error) {
+	path := strings.TrimPrefix(url, "precomputed://")
+	if strings.HasPrefix(path, "file://") {
+		path = strings.TrimPrefix(path, "file://")
+	} else if strings.Contains(path, "://") {
+		return nil, fmt.Errorf("Precomputed volume %s must be a local directory or file:// URL", url)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(path, "info"))
+	if err != nil {
+		return nil, fmt.Errorf("Precomputed info could not be read: %v", err)
+	}
+	var info precomputedInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("Precomputed info for %s could not be decoded", url)
+	}
+	if info.Type != "segmentation" {
+		return nil, fmt.Errorf("Precomputed volume %s is of type %s rather than segmentation", url, info.Type)
+	}
+	if info.NumChannels > 1 {
+		return nil, fmt.Errorf("Precomputed volume %s has %d channels", url, info.NumChannels)
+	}
+	dtype, err := getLabelType(info.DataType, binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	if scale < 0 || scale >= len(info.Scales) {
+		return nil, fmt.Errorf("Precomputed volume %s has no scale %d", url, scale)
+	}
+
+	scaleinfo := info.Scales[scale]
+	if scaleinfo.Sharding != nil {
+		return nil, fmt.Errorf("Sharded precomputed volumes are not supported")
+	}
+	if len(scaleinfo.Size) != 3 || len(scaleinfo.ChunkSizes) == 0 || len(scaleinfo.ChunkSizes[0]) != 3 {
+		return nil, fmt.Errorf("Precomputed scale %s must be 3D", scaleinfo.Key)
+	}
+
+	factor, err := precomputedFactor(info, scale)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset [3]int
+	copy(offset[:], scaleinfo.VoxelOffset)
+	volume := &chunkedVolume{path: filepath.Join(path, scaleinfo.Key)}
+	copy(volume.size[:], scaleinfo.Size)
+	copy(volume.chunk[:], scaleinfo.ChunkSizes[0])
+	if err = checkChunking(volume); err != nil {
+		return nil, err
+	}
+
+	var decode func(data []byte, chunksize [3]int) ([]uint64, error)
+	switch scaleinfo.Encoding {
+	case "raw":
+		decode = func(data []byte, chunksize [3]int) ([]uint64, error) {
+			count := chunksize[0] * chunksize[1] * chunksize[2]
+			if len(data) < count*dtype.size {
+				return nil, fmt.Errorf("chunk holds fewer than %d labels", count)
+			}
+			labels := make([]uint64, count)
+			dtype.decode(data, labels)
+			return labels, nil
+		}
+	case "compressed_segmentation":
+		var blocksize [3]int
+		if copy(blocksize[:], scaleinfo.BlockSize) != 3 || blocksize[0] <= 0 || blocksize[1] <= 0 || blocksize[2] <= 0 {
+			return nil, fmt.Errorf("Precomputed scale %s has an invalid compressed_segmentation block size", scaleinfo.Key)
+		}
+		decode = func(data []byte, chunksize [3]int) ([]uint64, error) {
+			return decodeCompressedSegmentation(data, chunksize, blocksize, dtype.size == 8)
+		}
+	default:
+		return nil, fmt.Errorf("Precomputed encoding %s is not supported", scaleinfo.Encoding)
+	}
+
+	// chunk files are named by their voxel range (e.g., 0-64_0-64_0-64) and are clipped to the volume
+	volume.readChunk = func(coord [3]int) ([]uint64, [3]int, error) {
+		var chunksize [3]int
+		var ranges []string
+		for i := range coord {
+			start := coord[i] * volume.chunk[i]
+			end := start + volume.chunk[i]
+			if end > volume.size[i] {
+				end = volume.size[i]
+			}
+			chunksize[i] = end - start
+			ranges = append(ranges, strconv.Itoa(offset[i]+start)+"-"+strconv.Itoa(offset[i]+end))
+		}
+
+		data, err := readPrecomputedChunk(filepath.Join(volume.path, strings.Join(ranges, "_")))
+		if err != nil || data == nil {
+			return nil, chunksize, err
+		}
+		labels, err := decode(data, chunksize)
+		return labels, chunksize, err
+	}
+
+	return &VolumeSource{volume, [3]int32{int32(offset[0]), int32(offset[1]), int32(offset[2])}, factor}, nil
+}
+
+// precomputedFactor returns the size of a voxel at the scale in voxels of scale 0 (the results are rescaled
+// by this factor, so the scale must be downsampled by the same integer factor along each axis)
+func precomputedFactor(info precomputedInfo, scale int) (int32, error) {
+	if scale == 0 {
+		return 1, nil
+	}
+	base, scaled := info.Scales[0].Resolution, info.Scales[scale].Resolution
+	if len(base) != 3 || len(scaled) != 3 {
+		return 0, fmt.Errorf("Precomputed scales must have a 3D resolution")
+	}
+	var factor float64
+	for i := range base {
+		if base[i] <= 0 {
+			return 0, fmt.Errorf("Precomputed scale %s has an invalid resolution", info.Scales[0].Key)
+		}
+		ratio := scaled[i] / base[i]
+		if i > 0 && ratio != factor {
+			return 0, fmt.Errorf("Precomputed scale %s is not downsampled equally along each axis", info.Scales[scale].Key)
+		}
+		factor = ratio
+	}
+	if factor < 1 || factor > maxCoarseBlockSize || factor != math.Trunc(factor) {
+		return 0, fmt.Errorf("Precomputed scale %s is not downsampled by an integer factor", info.Scales[scale].Key)
+	}
+	return int32(factor), nil
+}
+
+// readPrecomputedChunk reads a chunk file and decompresses it if gzipped (nil if the chunk is missing)
+func readPrecomputedChunk(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		file, err = os.Open(filename + ".gz")
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// decodeCompressedSegmentation decodes a single channel chunk in the neuroglancer compressed_segmentation
+// encoding.  Each block has a two word header with the lookup table offset (low 24 bits), the number of
+// bits per encoded value (high 8 bits), and the offset of the encoded values (offsets are in 32-bit words).
+func decodeCompressedSegmentation(data []byte, chunksize, blocksize [3]int, uint64labels bool) ([]uint64, error) {
+	numwords := len(data) / 4
+	word := func(pos int) (uint32, error) {
+		if pos < 0 || pos >= numwords {
+			return 0, fmt.Errorf("compressed segmentation is truncated")
+		}
+		return binary.LittleEndian.Uint32(data[pos*4:]), nil
+	}
+
+	// the chunk starts with the offset of each channel
+	channel, err := word(0)
+	if err != nil {
+		return nil, err
+	}
+	base := int(channel)
+
+	var grid [3]int
+	for i := range grid {
+		grid[i] = (chunksize[i] + blocksize[i] - 1) / blocksize[i]
+	}
+	labels := make([]uint64, chunksize[0]*chunksize[1]*chunksize[2])
+	blockvoxels := blocksize[0] * blocksize[1] * blocksize[2]
+
+	for bz := 0; bz < grid[2]; bz += 1 {
+		for by := 0; by < grid[1]; by += 1 {
+			for bx := 0; bx < grid[0]; bx += 1 {
+				headerpos := base + ((bz*grid[1]+by)*grid[0]+bx)*2
+				header0, err := word(headerpos)
+				if err != nil {
+					return nil, err
+				}
+				header1, err := word(headerpos + 1)
+				if err != nil {
+					return nil, err
+				}
+				tablepos := base + int(header0&0xffffff)
+				bits := uint(header0 >> 24)
+				valuespos := base + int(header1)
+				if bits > 32 || (bits > 0 && 32%bits != 0) {
+					return nil, fmt.Errorf("compressed segmentation has %d bits per value", bits)
+				}
+				if bits > 0 && valuespos+(blockvoxels*int(bits)+31)/32 > numwords {
+					return nil, fmt.Errorf("compressed segmentation is truncated")
+				}
+
+				// values index voxels of the full block (x fastest) even at the chunk edge
+				for z := 0; z < blocksize[2]; z += 1 {
+					gz := bz*blocksize[2] + z
+					if gz >= chunksize[2] {
+						break
+					}
+					for y := 0; y < blocksize[1]; y += 1 {
+						gy := by*blocksize[1] + y
+						if gy >= chunksize[1] {
+							break
+						}
+						for x := 0; x < blocksize[0]; x += 1 {
+							gx := bx*blocksize[0] + x
+							if gx >= chunksize[0] {
+								break
+							}
+							value := 0
+							if bits > 0 {
+								index := ((z*blocksize[1]+y)*blocksize[0] + x) * int(bits)
+								encoded, _ := word(valuespos + index/32)
+								value = int((encoded >> uint(index%32)) & (1<<bits - 1))
+							}
+
+							var label uint64
+							if uint64labels {
+								low, err := word(tablepos + value*2)
+								if err != nil {
+									return nil, err
+								}
+								high, err := word(tablepos + value*2 + 1)
+								if err != nil {
+									return nil, err
+								}
+								label = uint64(high)<<32 | uint64(low)
+							} else {
+								low, err := word(tablepos + value)
+								if err != nil {
+									return nil, err
+								}
+								label = uint64(low)
+							}
+							labels[(gz*chunksize[1]+gy)*chunksize[0]+gx] = label
+						}
+					}
+				}
+			}
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,177 @@
+package overlap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encodeCompressedSegmentation encodes the uint64 labels of a chunk in the compressed_segmentation encoding
+// (voxels of edge blocks that are outside of the chunk repeat the first label)
+func encodeCompressedSegmentation(labels []uint64, chunksize, blocksize [3]int) []byte {
+	var grid [3]int
+	for i := range grid {
+		grid[i] = (chunksize[i] + blocksize[i] - 1) / blocksize[i]
+	}
+	words := make([]uint32, 1+grid[0]*grid[1]*grid[2]*2)
+	words[0] = 1
+
+	for bz := 0; bz < grid[2]; bz += 1 {
+		for by := 0; by < grid[1]; by += 1 {
+			for bx := 0; bx < grid[0]; bx += 1 {
+				// lookup table of the labels in the block and the table index of each voxel
+				var table []uint64
+				indices := make(map[uint64]int)
+				var encoded []int
+				for z := 0; z < blocksize[2]; z += 1 {
+					for y := 0; y < blocksize[1]; y += 1 {
+						for x := 0; x < blocksize[0]; x += 1 {
+							label := labels[0]
+							gx, gy, gz := bx*blocksize[0]+x, by*blocksize[1]+y, bz*blocksize[2]+z
+							if gx < chunksize[0] && gy < chunksize[1] && gz < chunksize[2] {
+								label = labels[(gz*chunksize[1]+gy)*chunksize[0]+gx]
+							}
+							if _, found := indices[label]; !found {
+								indices[label] = len(table)
+								table = append(table, label)
+							}
+							encoded = append(encoded, indices[label])
+						}
+					}
+				}
+				bits := 0
+				for _, b := range []int{0, 1, 2, 4, 8, 16, 32} {
+					if 1<<b >= len(table) {
+						bits = b
+						break
+					}
+				}
+
+				values := len(words)
+				words = append(words, make([]uint32, (len(encoded)*bits+31)/32)...)
+				if bits > 0 {
+					for i, index := range encoded {
+						words[values+i*bits/32] |= uint32(index) << uint(i*bits%32)
+					}
+				}
+				lookup := len(words)
+				for _, label := range table {
+					words = append(words, uint32(label), uint32(label>>32))
+				}
+				header := 1 + ((bz*grid[1]+by)*grid[0]+bx)*2
+				words[header] = uint32(lookup-1) | uint32(bits)<<24
+				words[header+1] = uint32(values - 1)
+			}
+		}
+	}
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, words)
+	return data.Bytes()
+}
+
+// writePrecomputed writes the labels as a precomputed segmentation with 4x4x4 chunks at the offset
+func writePrecomputed(t *testing.T, dir string, labels []uint64, dims, offset [3]int, encoding string, gzipped bool) {
+	os.MkdirAll(filepath.Join(dir, "s0"), 0755)
+	info := fmt.Sprintf(`{"type":"segmentation","data_type":"uint64","num_channels":1,"scales":[{"key":"s0","size":[%d,%d,%d],"chunk_sizes":[[4,4,4]],"encoding":"%s","voxel_offset":[%d,%d,%d],"compressed_segmentation_block_size":[3,2,3]}]}`, dims[0], dims[1], dims[2], encoding, offset[0], offset[1], offset[2])
+	if err := os.WriteFile(filepath.Join(dir, "info"), []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for cz := 0; cz*4 < dims[2]; cz += 1 {
+		for cy := 0; cy*4 < dims[1]; cy += 1 {
+			for cx := 0; cx*4 < dims[0]; cx += 1 {
+				// chunks are named by their voxel ranges and are truncated at the edges of the volume
+				var chunksize [3]int
+				var ranges []string
+				for i, c := range []int{cx, cy, cz} {
+					start, end := c*4, c*4+4
+					if end > dims[i] {
+						end = dims[i]
+					}
+					chunksize[i] = end - start
+					ranges = append(ranges, fmt.Sprintf("%d-%d", start+offset[i], end+offset[i]))
+				}
+				var chunk []uint64
+				for z := 0; z < chunksize[2]; z += 1 {
+					for y := 0; y < chunksize[1]; y += 1 {
+						for x := 0; x < chunksize[0]; x += 1 {
+							chunk = append(chunk, labels[((cz*4+z)*dims[1]+cy*4+y)*dims[0]+cx*4+x])
+						}
+					}
+				}
+
+				data := encodeLabels(chunk, 8, binary.LittleEndian)
+				if encoding == "compressed_segmentation" {
+					data = encodeCompressedSegmentation(chunk, chunksize, [3]int{3, 2, 3})
+				}
+				name := strings.Join(ranges, "_")
+				if gzipped {
+					var compressed bytes.Buffer
+					gw := gzip.NewWriter(&compressed)
+					gw.Write(data)
+					gw.Close()
+					data = compressed.Bytes()
+					name += ".gz"
+				}
+				os.WriteFile(filepath.Join(dir, "s0", name), data, 0644)
+			}
+		}
+	}
+}
+
+func TestPrecomputedSource(t *testing.T) {
+	dims := [3]int{11, 10, 9}
+	offset := [3]int{100, -5, 7}
+	labels := randomLabels(dims, 2)
+	for i := 0; i < len(labels); i += 37 {
+		labels[i] = 1<<35 + uint64(i%5)
+	}
+	bodyids := []uint64{0, 1, 2, 3, 1 << 35, 1<<35 + 2, 1<<35 + 4, 77}
+
+	for _, encoding := range []string{"raw", "compressed_segmentation"} {
+		for _, gzipped := range []bool{false, true} {
+			dir := t.TempDir()
+			writePrecomputed(t, dir, labels, dims, offset, encoding, gzipped)
+			source, err := NewPrecomputedSource("file://"+dir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkVolumeBodies(t, fmt.Sprintf("%s (gzip %v)", encoding, gzipped), source, labels, dims, offset, bodyids)
+		}
+	}
+
+	if _, err := NewPrecomputedSource("gs://bucket/segmentation", 0); err == nil {
+		t.Fatalf("Remote precomputed volume was opened")
+	}
+	if _, err := NewPrecomputedSource("file://"+t.TempDir(), 0); err == nil {
+		t.Fatalf("Precomputed volume without an info file was opened")
+	}
+}
+func TestPrecomputedFactor(t *testing.T) {
+	scales := []struct {
+		info   string
+		scale  int
+		factor int32
+	}{
+		{`{"scales":[{"resolution":[8,8,8]}]}`, 0, 1},
+		{`{"scales":[{"resolution":[8,8,8]},{"resolution":[16,16,16]}]}`, 1, 2},
+		{`{"scales":[{"resolution":[4,4,40]},{"resolution":[16,16,160]}]}`, 1, 4},
+		{`{"scales":[{"resolution":[8,8,40]},{"resolution":[16,16,40]}]}`, 1, 0},
+		{`{"scales":[{"resolution":[8,8,8]},{"resolution":[12,12,12]}]}`, 1, 0},
+		{`{"scales":[{},{}]}`, 1, 0},
+	}
+	for _, scale := range scales {
+		var info precomputedInfo
+		json.Unmarshal([]byte(scale.info), &info)
+		factor, err := precomputedFactor(info, scale.scale)
+		if factor != scale.factor || (err == nil) != (scale.factor > 0) {
+			t.Fatalf("Scale %d of %s has factor %d (%v) instead of %d", scale.scale, scale.info, factor, err, scale.factor)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package overlap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// roiRegions contains a set of named ROIs used to break down the overlap and stats
+type roiRegions struct {
+	names []string
+	spans []roiSpans
+}
+
+// regionRun is part of a run that falls in a single region (an index into roiRegions or -1 if outside all ROIs)
+type regionRun struct {
+	chunk  sparseData
+	region int32
+}
+
+// regionPair is a key for the overlap between two bodies within a region
+type regionPair struct {
+	pair   bodyPair
+	region int32
+}
+
+// splitByRegion breaks the body's runs into pieces that are each labeled by the first ROI containing them
+// (the runs are unchanged and outside all ROIs if there are no regions)
+func splitByRegion(sparse_body SparseBody, regions *roiRegions) []regionRun {
+	region_runs := make([]regionRun, 0, len(sparse_body.rle))
+
+	for _, chunk := range sparse_body.rle {
+		if regions == nil {
+			region_runs = append(region_runs, regionRun{chunk, -1})
+			continue
+		}
+
+		yzpair := yzPair{blockCoord(chunk.y), blockCoord(chunk.z)}
+
+		// pieces of the run not yet assigned to a region
+		pieces := []sparseData{chunk}
+		for region, roi := range regions.spans {
+			spans, found := roi[yzpair]
+			if !found {
+				continue
+			}
+
+			var leftover []sparseData
+			for _, piece := range pieces {
+				cursor := piece.x
+				pieceend := piece.x + piece.length
+				for _, span := range spans {
+					start := span.x0 * roiBlockSize
+					end := (span.x1 + 1) * roiBlockSize
+					if start < cursor {
+						start = cursor
+					}
+					if end > pieceend {
+						end = pieceend
+					}
+					if start >= end {
+						continue
+					}
+					if start > cursor {
+						leftover = append(leftover, sparseData{cursor, chunk.y, chunk.z, start - cursor})
+					}
+					region_runs = append(region_runs, regionRun{sparseData{start, chunk.y, chunk.z, end - start}, int32(region)})
+					cursor = end
+				}
+				if cursor < pieceend {
+					leftover = append(leftover, sparseData{cursor, chunk.y, chunk.z, pieceend - cursor})
+				}
+			}
+			pieces = leftover
+		}
+
+		for _, piece := range pieces {
+			region_runs = append(region_runs, regionRun{piece, -1})
+		}
+	}
+
+	return region_runs
+}
+
+// loadRegionRunYZs indexes the region runs into a YZ map (the x index keeps the region of each run)
+func loadRegionRunYZs(bodyid uint64, region_runs []regionRun, yzmaplist map[yzPair]xIndices) {
+	for _, region_run := range region_runs {
+		chunk := region_run.chunk
+		yzpair := yzPair{chunk.y, chunk.z}
+		yzmaplist[yzpair] = append(yzmaplist[yzpair], xIndex{bodyid, chunk.x, chunk.length, region_run.region})
+	}
+}
+
+// pickRegion returns the region of the voxel that belongs to the smaller body id
+func pickRegion(bodyid1 uint64, region1 int32, xval xIndex) int32 {
+	if bodyid1 < xval.bodyID {
+		return region1
+	}
+	return xval.region
+}
+
+// newRegionLists creates an empty result list for each ROI (nil if there are no regions)
+func newRegionLists(regions *roiRegions) map[string]resultList {
+	if regions == nil {
+		return nil
+	}
+	region_lists := make(map[string]resultList)
+	for _, name := range regions.names {
+		region_lists[name] = resultList{}
+	}
+	return region_lists
+}
+
+// extractRegions fetches the ROIs named in the request for a per-ROI breakdown (nil if none are requested)
+func extractRegions(ctx context.Context, w http.ResponseWriter, json_data map[string]interface{}) (regions *roiRegions, err error) {
+	roi_list, found := json_data["rois"].([]interface{})
+	if !found {
+		return
+	}
+
+	dvidserver, err := getDVIDserver(json_data)
+	if err != nil {
+		serverError(ctx, w, dvidServerError(err))
+		return
+	}
+
+	regions = &roiRegions{}
+	seen := make(map[string]bool)
+	for _, roiinter := range roi_list {
+		roiname := roiinter.(string)
+		if seen[roiname] {
+			err = fmt.Errorf("ROI %s is listed more than once", roiname)
+			badRequest(w, err.Error())
+			return nil, err
+		}
+		seen[roiname] = true
+		roi, err2 := fetchROI(ctx, dvidserver, json_data["uuid"].(string), roiname)
+		if _, unknown := err2.(unknownROIError); unknown {
+			badRequest(w, err2.Error())
+			return nil, err2
+		} else if err2 != nil {
+			badGateway(w, err2.Error())
+			return nil, err2
+		}
+		regions.names = append(regions.names, roiname)
+		regions.spans = append(regions.spans, roi)
+	}
+
+	return
+}
@@ -0,0 +1,208 @@
+package overlap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// roiBlockSize is the size of the (cubic) blocks used by DVID to define an ROI
+const roiBlockSize = 32
+
+// blockSpan is an inclusive run of ROI blocks along x
+type blockSpan struct {
+	x0 int32
+	x1 int32
+}
+
+type blockSpans []blockSpan
+
+func (slice blockSpans) Len() int {
+	return len(slice)
+}
+
+func (slice blockSpans) Less(i, j int) bool {
+	return slice[i].x0 < slice[j].x0
+}
+
+func (slice blockSpans) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// roiSpans indexes the block spans of an ROI by their yz block coordinate
+type roiSpans map[yzPair]blockSpans
+
+// blockCoord returns the block containing the voxel coordinate (rounds toward -inf)
+func blockCoord(coord int32) int32 {
+	return floorDiv(coord, roiBlockSize)
+}
+
+// unknownROIError is returned for an ROI that DVID does not have
+type unknownROIError string
+
+func (roiname unknownROIError) Error() string {
+	return fmt.Sprintf("ROI %s does not exist", string(roiname))
+}
+
+// fetchROI retrieves the block spans for the ROI from DVID
+func fetchROI(ctx context.Context, dvidserver, uuid, roiname string) (roiSpans, error) {
+	url := dvidserver + "/api/node/" + uuid + "/" + roiname + "/roi"
+
+	// each span is [z, y, x0, x1] in block coordinates
+	var span_list [][]int32
+	if err := dvid.getJSON(ctx, url, &span_list); err != nil {
+		if status, found := err.(*dvidStatusError); found && status.status < 500 {
+			return nil, unknownROIError(roiname)
+		}
+		return nil, fmt.Errorf("ROI could not be read: %v", err)
+	}
+
+	roi := make(roiSpans)
+	for _, span := range span_list {
+		if len(span) != 4 {
+			return nil, fmt.Errorf("ROI encoding incorrect")
+		}
+		yzpair := yzPair{span[1], span[0]}
+		roi[yzpair] = append(roi[yzpair], blockSpan{span[2], span[3]})
+	}
+	for _, spans := range roi {
+		sort.Sort(spans)
+	}
+
+	return roi, nil
+}
+
+// clipBody returns the portion of the body's RLE that falls within the ROI
+func clipBody(sparse_body SparseBody, roi roiSpans) SparseBody {
+	clipped_body := SparseBody{}
+	clipped_body.bodyID = sparse_body.bodyID
+
+	for _, chunk := range sparse_body.rle {
+		spans, found := roi[yzPair{blockCoord(chunk.y), blockCoord(chunk.z)}]
+		if !found {
+			continue
+		}
+
+		xmin := chunk.x
+		xmax := chunk.x + chunk.length
+		for _, span := range spans {
+			start := span.x0 * roiBlockSize
+			end := (span.x1 + 1) * roiBlockSize
+			if start < xmin {
+				start = xmin
+			}
+			if end > xmax {
+				end = xmax
+			}
+			if start < end {
+				clipped_body.rle = append(clipped_body.rle, sparseData{start, chunk.y, chunk.z, end - start})
+			}
+		}
+	}
+
+	return clipped_body
+}
+
+// coversX returns true if one of the runs contains the x coordinate
+func coversX(xval int32, xlist xIndices) bool {
+	index, found := findLowerBound(xval, xlist)
+	return found && xlist[index].x+xlist[index].length > xval
+}
+
+// computeROIStats finds the volume and surface area of each body clipped to the ROI (only faces on the
+// surface of the whole body count, not the faces where the ROI boundary cuts through the body, and the
+// whole body is made of all its supervoxels if a supervoxel map is given)
+func computeROIStats(sparse_bodies sparseBodies, roi_bodies sparseBodies, svmap supervoxelMap) resultList {
+	wholeID := func(bodyid uint64) uint64 {
+		if svmap != nil {
+			return svmap[bodyid]
+		}
+		return bodyid
+	}
+
+	// neighbors of the clipped runs are found in the whole body
+	whole_bodies := make(map[uint64]map[yzPair]xIndices)
+	for _, sparse_body := range sparse_bodies {
+		wholeid := wholeID(sparse_body.bodyID)
+		if _, found := whole_bodies[wholeid]; !found {
+			whole_bodies[wholeid] = make(map[yzPair]xIndices)
+		}
+		loadSparseBodyYZs(sparse_body, whole_bodies[wholeid])
+	}
+	for _, yzmaplist := range whole_bodies {
+		for _, xindices := range yzmaplist {
+			sort.Sort(xindices)
+		}
+	}
+
+	stats_slice := resultList{}
+	for _, roi_body := range roi_bodies {
+		yzmaplist := whole_bodies[wholeID(roi_body.bodyID)]
+
+		// adjacencies to the whole body use the 0 body id (see computeStats)
+		var bodyvolume, totaladjacencies, selfadjacencies uint64
+		region_pairs := make(map[regionPair]uint64)
+		for _, chunk := range roi_body.rle {
+			y := chunk.y
+			z := chunk.z
+			xmin := chunk.x
+			xmax := xmin + chunk.length
+			bodyvolume += uint64(chunk.length)
+			totaladjacencies += uint64(chunk.length*4 + 2)
+
+			for _, yzpair := range []yzPair{{y + 1, z}, {y - 1, z}, {y, z + 1}, {y, z - 1}} {
+				if xlist, found := yzmaplist[yzpair]; found {
+					overlap(region_pairs, xlist, xmin, xmax, 0, -1)
+				}
+			}
+			if xlist, found := yzmaplist[yzPair{y, z}]; found {
+				if coversX(xmin-1, xlist) {
+					selfadjacencies += 1
+				}
+				if coversX(xmax, xlist) {
+					selfadjacencies += 1
+				}
+			}
+		}
+		for _, val := range region_pairs {
+			selfadjacencies += val
+		}
+
+		stats_slice = append(stats_slice, []uint64{roi_body.bodyID, bodyvolume, totaladjacencies - selfadjacencies})
+	}
+
+	// put bodies with the largest surface area first
+	sort.Sort(sort.Reverse(stats_slice))
+
+	return stats_slice
+}
+
+// extractROIBodies clips the bodies to the ROI named in the request (nil if no ROI is requested)
+func extractROIBodies(ctx context.Context, w http.ResponseWriter, json_data map[string]interface{}, sparse_bodies sparseBodies) (roi_bodies sparseBodies, err error) {
+	roiname, found := json_data["roi"].(string)
+	if !found {
+		return
+	}
+
+	dvidserver, err := getDVIDserver(json_data)
+	if err != nil {
+		serverError(ctx, w, dvidServerError(err))
+		return
+	}
+
+	roi, err := fetchROI(ctx, dvidserver, json_data["uuid"].(string), roiname)
+	if _, unknown := err.(unknownROIError); unknown {
+		badRequest(w, err.Error())
+		return
+	} else if err != nil {
+		badGateway(w, err.Error())
+		return
+	}
+
+	for _, sparse_body := range sparse_bodies {
+		roi_bodies = append(roi_bodies, clipBody(sparse_body, roi))
+	}
+
+	return
+}
@@ -0,0 +1,164 @@
+package overlap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// defaultCoarseBlockSize is the block size assumed for sparsevol-coarse if none is given
+const defaultCoarseBlockSize = 32
+
+// maxScale is the largest downsampling level accepted
+const maxScale = 10
+
+// maxCoarseBlockSize is the largest sparsevol-coarse block size accepted (so that a block volume fits in
+// the int32 rescaling factor)
+const maxCoarseBlockSize = 1024
+
+// bodyResolution describes the resolution at which the bodies are fetched from DVID
+type bodyResolution struct {
+	// DVID endpoint ("sparsevol" or "sparsevol-coarse")
+	route string
+	// downsampling level for labelmap instances (0 is full resolution)
+	scale int
+	// size of a fetched voxel in full resolution voxels along each axis
+	factor int32
+}
+
+// fullResolution fetches the bodies as stored in DVID
+var fullResolution = bodyResolution{"sparsevol", 0, 1}
+
+// getResolution retrieves the resolution for the fetch from the JSON
+func getResolution(json_data map[string]interface{}) (bodyResolution, error) {
+	res := fullResolution
+
+	coarse, _ := json_data["coarse"].(bool)
+	scaleval, hasscale := jsonFloat(json_data["scale"])
+	if coarse && hasscale {
+		return res, fmt.Errorf("Only one of coarse and scale can be requested")
+	}
+	if val, found := jsonFloat(json_data["block-size"]); found && (val < 1 || val > maxCoarseBlockSize) {
+		return res, fmt.Errorf("Block size must be between 1 and %d", maxCoarseBlockSize)
+	}
+
+	if coarse {
+		res = coarseResolution(json_data)
+	} else if hasscale {
+		if scaleval < 0 || scaleval > maxScale {
+			return res, fmt.Errorf("Scale must be between 0 and %d", maxScale)
+		}
+		res.scale = int(scaleval)
+		res.factor = int32(1) << uint(res.scale)
+	}
+
+	if res.factor > 1 {
+		_, hasroi := json_data["roi"]
+		_, hasrois := json_data["rois"]
+		if hasroi || hasrois {
+			return res, fmt.Errorf("ROIs can only be used at full resolution")
+		}
+	}
+
+	return res, nil
+}
+
+// coarseResolution fetches the blocks intersecting each body with sparsevol-coarse
+func coarseResolution(json_data map[string]interface{}) bodyResolution {
+	blocksize := int32(defaultCoarseBlockSize)
+	if val, found := jsonFloat(json_data["block-size"]); found && val >= 1 {
+		blocksize = int32(val)
+	}
+	return bodyResolution{"sparsevol-coarse", 0, blocksize}
+}
+
+// queryString returns the DVID query parameters for the resolution
+func (res bodyResolution) queryString() string {
+	if res.scale > 0 {
+		return "scale=" + strconv.Itoa(res.scale)
+	}
+	return ""
+}
+
+// rescaleOverlap converts the overlap (in faces) to full resolution units
+func (res bodyResolution) rescaleOverlap(overlap_list resultList) {
+	for _, row := range overlap_list {
+		row[2] *= uint64(res.factor * res.factor)
+	}
+}
+
+// rescaleStats converts the volume and surface area to full resolution units
+func (res bodyResolution) rescaleStats(stats_list resultList) {
+	for _, row := range stats_list {
+		row[1] *= uint64(res.factor * res.factor * res.factor)
+		row[2] *= uint64(res.factor * res.factor)
+	}
+}
+
+// floorDiv divides rounding toward -inf
+func floorDiv(coord int32, size int32) int32 {
+	if coord < 0 {
+		return (coord+1)/size - 1
+	}
+	return coord / size
+}
+
+// scaled returns the bounds in the coordinates of the given voxel size
+func (bounds *bodyBounds) scaled(factor int32) *bodyBounds {
+	scaled_bounds := *bounds
+	for i := range scaled_bounds.values {
+		scaled_bounds.values[i] = floorDiv(bounds.values[i], factor)
+	}
+	return &scaled_bounds
+}
+
+// candidateBodies returns the bodies that touch or share a block with another body at coarse resolution
+// (any bodies touching at full resolution must do so)
+func candidateBodies(coarse_bodies sparseBodies) []uint64 {
+	// hash of yz value to sorted slice of xIndices
+	var yzmaplist = make(map[yzPair]xIndices)
+	for _, sparse_body := range coarse_bodies {
+		loadSparseBodyYZs(sparse_body, yzmaplist)
+	}
+	for _, xindices := range yzmaplist {
+		sort.Sort(xindices)
+	}
+
+	candidates := make(map[uint64]bool)
+	for _, sparse_body := range coarse_bodies {
+		bodyid := sparse_body.bodyID
+		for _, chunk := range sparse_body.rle {
+			y := chunk.y
+			z := chunk.z
+			xmin := chunk.x
+			xmax := xmin + chunk.length
+
+			// blocks on the same row can be shared with or adjacent in x to another body
+			touching(candidates, yzmaplist[yzPair{y, z}], xmin-1, xmax+1, bodyid)
+			touching(candidates, yzmaplist[yzPair{y + 1, z}], xmin, xmax, bodyid)
+			touching(candidates, yzmaplist[yzPair{y - 1, z}], xmin, xmax, bodyid)
+			touching(candidates, yzmaplist[yzPair{y, z + 1}], xmin, xmax, bodyid)
+			touching(candidates, yzmaplist[yzPair{y, z - 1}], xmin, xmax, bodyid)
+		}
+	}
+
+	var bodyids []uint64
+	for _, sparse_body := range coarse_bodies {
+		if candidates[sparse_body.bodyID] {
+			bodyids = append(bodyids, sparse_body.bodyID)
+		}
+	}
+	return bodyids
+}
+
+// touching marks bodyid and any other body with a run intersecting [xmin, xmax) as candidates
+func touching(candidates map[uint64]bool, xlist xIndices, xmin int32, xmax int32, bodyid uint64) {
+	// coarse runs from different bodies can overlap so every run starting before xmax is examined
+	maxindex := sort.Search(len(xlist), func(i int) bool { return xlist[i].x >= xmax })
+	for _, xval := range xlist[:maxindex] {
+		if xval.bodyID != bodyid && xval.x+xval.length > xmin {
+			candidates[bodyid] = true
+			candidates[xval.bodyID] = true
+		}
+	}
+}
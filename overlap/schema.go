@@ -7,16 +7,48 @@ const overlapSchema = `
   "type": "object",
   "properties": {
     "dvid-server": { 
-      "description": "location of DVID server (will try to find on service proxy if not provided)",
+      "description": "location of DVID server, optionally starting with http:// or https://, or a configured alias (must be allowed by the server; will try to find on service proxy if not provided)",
       "type": "string" 
     },
     "uuid": { "type" : "string" },
+    "authorization": { "description": "Authorization header sent to DVID for this request (e.g., \"Bearer TOKEN\")", "type": "string" },
+    "backend": { "description": "name of a configured DVID backend (in place of dvid-server; by default the uuid is routed to a backend)", "type": "string" },
+    "label-instance": { "description": "name of the DVID label instance (labelblk, labelvol, labelarray, or labelmap) holding the bodies (server default if not provided)", "type": "string" },
+    "roi": {
+      "description": "name of DVID roi instance used to clip the bodies (clipped results are reported in addition to the full results)",
+      "type": "string"
+    },
+    "rois": {
+      "description": "names of DVID roi instances used to break down the results by ROI (voxels are assigned to the first ROI containing them)",
+      "type": "array",
+      "items": {"type": "string"}
+    },
+    "minx": { "description": "minimum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "maxx": { "description": "maximum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "miny": { "description": "minimum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "maxy": { "description": "maximum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "minz": { "description": "minimum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "maxz": { "description": "maximum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "scale": { "description": "fetch the bodies at this downsampling level of a labelmap instance (results are rescaled to full resolution units)", "type": "integer", "minimum": 0, "maximum": 10 },
+    "coarse": { "description": "fetch the blocks intersecting each body with sparsevol-coarse (results are rescaled to full resolution units)", "type": "boolean" },
+    "block-size": { "description": "size of the blocks returned by sparsevol-coarse (default 32)", "type": "integer", "minimum": 1, "maximum": 1024 },
+    "two-stage": { "description": "only fetch bodies at the requested resolution if they touch another body at coarse resolution", "type": "boolean" },
+    "supervoxels": { "description": "compute at the supervoxel level (labelmap only) and aggregate the results to the bodies", "type": "boolean" },
+    "mapping": {
+      "description": "map of body id to a new body id applied before computing (e.g., to preview merges), bodies mapped to the same id are merged",
+      "type": "object",
+      "additionalProperties": {"type": "integer", "minimum": 1}
+    },
+    "rles": {
+      "description": "map of body id to the list of [x, y, z, length] spans of the body, used instead of fetching the bodies from DVID (bodies defaults to these body ids)",
+      "type": "object",
+      "additionalProperties": {"type": "array", "items": {"type": "array", "items": {"type": "integer"}, "minItems": 4, "maxItems": 4}}
+    },
     "bodies": { 
       "description": "Array of body ids (should be unsigned ints but for some reason validator requries a number type",
       "type": "array",
       "minItems": 2,
-      "items": {"type": "number", "minimum": 1},
-      "uniqueItems": true
+      "items": {"type": "number", "minimum": 1}
     }
   },
   "required" : ["uuid", "bodies"]
@@ -29,16 +61,47 @@ const statsSchema = `
   "type": "object",
   "properties": {
     "dvid-server": { 
-      "description": "location of DVID server (will try to find on service proxy if not provided)",
+      "description": "location of DVID server, optionally starting with http:// or https://, or a configured alias (must be allowed by the server; will try to find on service proxy if not provided)",
       "type": "string" 
     },
     "uuid": { "type" : "string" },
+    "authorization": { "description": "Authorization header sent to DVID for this request (e.g., \"Bearer TOKEN\")", "type": "string" },
+    "backend": { "description": "name of a configured DVID backend (in place of dvid-server; by default the uuid is routed to a backend)", "type": "string" },
+    "label-instance": { "description": "name of the DVID label instance (labelblk, labelvol, labelarray, or labelmap) holding the bodies (server default if not provided)", "type": "string" },
+    "roi": {
+      "description": "name of DVID roi instance used to clip the bodies (clipped results are reported in addition to the full results)",
+      "type": "string"
+    },
+    "rois": {
+      "description": "names of DVID roi instances used to break down the results by ROI (voxels are assigned to the first ROI containing them)",
+      "type": "array",
+      "items": {"type": "string"}
+    },
+    "minx": { "description": "minimum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "maxx": { "description": "maximum x coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "miny": { "description": "minimum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "maxy": { "description": "maximum y coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "minz": { "description": "minimum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "maxz": { "description": "maximum z coordinate (inclusive) of the bounding box used to restrict the bodies", "type": "integer" },
+    "scale": { "description": "fetch the bodies at this downsampling level of a labelmap instance (results are rescaled to full resolution units)", "type": "integer", "minimum": 0, "maximum": 10 },
+    "coarse": { "description": "fetch the blocks intersecting each body with sparsevol-coarse (results are rescaled to full resolution units)", "type": "boolean" },
+    "block-size": { "description": "size of the blocks returned by sparsevol-coarse (default 32)", "type": "integer", "minimum": 1, "maximum": 1024 },
+    "supervoxels": { "description": "compute at the supervoxel level (labelmap only) and aggregate the results to the bodies", "type": "boolean" },
+    "mapping": {
+      "description": "map of body id to a new body id applied before computing (e.g., to preview merges), bodies mapped to the same id are merged",
+      "type": "object",
+      "additionalProperties": {"type": "integer", "minimum": 1}
+    },
+    "rles": {
+      "description": "map of body id to the list of [x, y, z, length] spans of the body, used instead of fetching the bodies from DVID (bodies defaults to these body ids)",
+      "type": "object",
+      "additionalProperties": {"type": "array", "items": {"type": "array", "items": {"type": "integer"}, "minItems": 4, "maxItems": 4}}
+    },
     "bodies": { 
       "description": "Array of body ids (should be unsigned ints but for some reason validator requries a number type",
       "type": "array",
       "minItems": 1,
-      "items": {"type": "number", "minimum": 1},
-      "uniqueItems": true
+      "items": {"type": "number", "minimum": 1}
     }
   },
   "required" : ["uuid", "bodies"]
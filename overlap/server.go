@@ -1,7 +1,7 @@
 package overlap
 
 import (
-	"encoding/binary"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/sigu-399/gojsonschema"
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -20,14 +21,14 @@ const (
         bodystatsPath = "/bodystats/"
 )
 
-// Address for proxy server
-var proxyServer string
-
 // webAddress is the http address for the server
 var webAddress string
 
+// shutdownTimeout is the time allowed for service calls in progress when the server stops
+const shutdownTimeout = 30 * time.Second
+
 // resultList contains the final output as a slice of [body1, body2, overalap] or [body1, volume, surface area]
-type resultList [][]uint32
+type resultList [][]uint64
 
 // Len to enable sorting by overlap or surface area
 func (slice resultList) Len() int {
@@ -44,6 +45,16 @@ func (slice resultList) Swap(i, j int) {
 	slice[i], slice[j] = slice[j], slice[i]
 }
 
+// resultOptions describes how the computed results are converted for output
+type resultOptions struct {
+	// resolution of the fetched bodies
+	res bodyResolution
+	// body of each supervoxel (nil unless computed at the supervoxel level)
+	svmap supervoxelMap
+	// bodies that could not be fetched and are missing from the results
+	failures []bodyFailure
+}
+
 // sparseData encodes the run length for part of a body
 type sparseData struct {
 	x      int32
@@ -52,14 +63,14 @@ type sparseData struct {
 	length int32
 }
 
-// sparseBody provides the run length encoding of the body
-type sparseBody struct {
-	bodyID uint32
+// SparseBody provides the run length encoding of the body (created with NewSparseBody outside the package)
+type SparseBody struct {
+	bodyID uint64
 	rle    []sparseData
 }
 
 // sparseBodies contains a slice of rle bodies
-type sparseBodies []sparseBody
+type sparseBodies []SparseBody
 
 // Len to enable sorting by number of spans
 func (slice sparseBodies) Len() int {
@@ -108,122 +119,284 @@ func badRequest(w http.ResponseWriter, msg string) {
 	http.Error(w, msg, http.StatusBadRequest)
 }
 
-// getDVIDserver retrieves the server from the JSON or looks it up
+// badGateway is a helper for printing an http error message for bad responses from DVID
+func badGateway(w http.ResponseWriter, msg string) {
+	fmt.Println(msg)
+	http.Error(w, msg, http.StatusBadGateway)
+}
+
+// getDVIDserver retrieves the server from the JSON (as a backend or a server) or routes the uuid to a
+// backend, and otherwise looks it up with the discovery (the primary server of a backend is returned)
 func getDVIDserver(jsondata map[string]interface{}) (string, error) {
-	if _, found := jsondata["dvid-server"]; found {
-		return ("http://" + jsondata["dvid-server"].(string)), nil
-	} else if proxyServer != "" {
-		resp, err := http.Get("http://" + proxyServer + "/services/dvid/node")
-		if err != nil {
-			return "", fmt.Errorf("dvid server not found at proxy")
-			// handle error
+	if val, found := jsondata["backend"]; found {
+		name, isstring := val.(string)
+		if !isstring {
+			return "", fmt.Errorf("DVID backend must be a string")
 		}
-		defer resp.Body.Close()
-		decoder := json.NewDecoder(resp.Body)
-		dvidnode := make(map[string]interface{})
-		err = decoder.Decode(&dvidnode)
+		dvidbackend, err := findBackend(name)
 		if err != nil {
-			return "", fmt.Errorf("Error decoding JSON from proxy server")
+			return "", err
 		}
-		if dvidnode["service-location"] == nil {
-			return "", fmt.Errorf("No service location found for DVID")
+		return dvidbackend.servers[0], nil
+	}
+	if val, found := jsondata["dvid-server"]; found {
+		name, isstring := val.(string)
+		if !isstring {
+			return "", fmt.Errorf("DVID server must be a string")
 		}
-		return dvidnode["service-location"].(string), nil
+		return resolveServer(name)
 	}
-	return "", fmt.Errorf("No proxy server location exists")
+	uuid, _ := jsondata["uuid"].(string)
+	if dvidbackend := routeBackend(uuid); dvidbackend != nil {
+		return dvidbackend.servers[0], nil
+	}
+	if discovery != nil {
+		location, err := discovery.Lookup(dvidService)
+		if err != nil {
+			return "", err
+		}
+		server := serverURL(location)
+		addDiscoveredServer(server)
+		return server, nil
+	}
+	return "", fmt.Errorf("No DVID discovery is configured")
+}
+
+// serverURL adds http:// to a DVID server address unless it already starts with http:// or https://
+func serverURL(dvidserver string) string {
+	if strings.HasPrefix(dvidserver, "http://") || strings.HasPrefix(dvidserver, "https://") {
+		return strings.TrimRight(dvidserver, "/")
+	}
+	return "http://" + strings.TrimRight(dvidserver, "/")
+}
+
+// requestOptions are the options of a request that are known before any body is fetched
+type requestOptions struct {
+	res     bodyResolution
+	mapping bodyMapping
+	bodyids []uint64
+	bounds  *bodyBounds
 }
 
-func extractBodies(w http.ResponseWriter, json_data map[string]interface{}, schemaData string) (sparse_bodies sparseBodies, err error) {
-        // convert schema to json data
+// checkRequest validates the JSON of a request and parses its options without contacting DVID (source is
+// the local source of the bodies, if any)
+func checkRequest(json_data map[string]interface{}, schemaData string, source BodySource, pruneCoarse bool) (request requestOptions, err error) {
+	// convert schema to json data
 	var schema_data interface{}
 	json.Unmarshal([]byte(schemaData), &schema_data)
 
 	// validate json schema
 	schema, err := gojsonschema.NewJsonSchemaDocument(schema_data)
-	validationResult := schema.Validate(json_data)
+	validationResult := schema.Validate(validationData(json_data))
 	if !validationResult.Valid() {
-		badRequest(w, "JSON did not pass validation")
-		err = fmt.Errorf("JSON did not pass validation")
-                return
+		return request, fmt.Errorf("JSON did not pass validation")
 	}
 
-	// retrieve dvid server
-	dvidserver, err := getDVIDserver(json_data)
-	if err != nil {
-		badRequest(w, "DVID server could not be located on proxy")
-		return 
+	if request.res, err = getResolution(json_data); err != nil {
+		return
+	}
+	if request.mapping, err = getMapping(json_data); err != nil {
+		return
 	}
 
-	// get data uuid
-	uuid := json_data["uuid"].(string)
-
-	// base url for all dvid queries
-	baseurl := dvidserver + "/api/node/" + uuid + "/sp2body/sparsevol/"
+	supervoxels, _ := json_data["supervoxels"].(bool)
+	if _, hasrois := json_data["rois"]; supervoxels && hasrois {
+		return request, fmt.Errorf("ROI breakdown is not available for supervoxels")
+	}
 
+	// duplicates are checked after parsing since the validator compares ids above 2^53 as float64
+	seen := make(map[uint64]bool)
 	bodyinter_list := json_data["bodies"].([]interface{})
 	for _, bodyinter := range bodyinter_list {
-		bodyid := int(bodyinter.(float64))
-		url := baseurl + strconv.Itoa(bodyid)
+		bodyid, found := jsonUint64(bodyinter)
+		if !found {
+			return request, fmt.Errorf("Body ids must be unsigned integers")
+		}
+		if seen[bodyid] {
+			return request, fmt.Errorf("Body %d is listed more than once", bodyid)
+		}
+		seen[bodyid] = true
+		request.bodyids = append(request.bodyids, bodyid)
+	}
+
+	// restrict the bodies to the bounding box if requested
+	if request.bounds, err = getBounds(json_data); err != nil {
+		return
+	}
 
-		resp, err2 := http.Get(url)
-		if err2 != nil || resp.StatusCode != 200 {
-			badRequest(w, "Body could not be read from "+url)
-		        err = fmt.Errorf("Body could not be read")
+	if source != nil {
+		err = checkLocalRequest(json_data, request.res, supervoxels, pruneCoarse)
+	}
+	return
+}
+
+// extractBodies validates the request and fetches the RLE of each body from the uploaded bodies (if source
+// is set), the configured source, or DVID (bodies that do not touch another body at coarse resolution are
+// not fetched if pruneCoarse is set, and bodies from a locked node are kept on disk)
+func extractBodies(ctx context.Context, w http.ResponseWriter, json_data map[string]interface{}, schemaData string, source BodySource, pruneCoarse, locked bool) (sparse_bodies sparseBodies, opts resultOptions, err error) {
+	if source == nil {
+		source = bodySource
+	}
+	request, err := checkRequest(json_data, schemaData, source, pruneCoarse)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	opts.res = request.res
+	mapping := request.mapping
+	uuid := json_data["uuid"].(string)
+	bodyids := request.bodyids
+	bounds := request.bounds
+
+	if source != nil {
+		if scaled, found := source.(scaledSource); found {
+			opts.res = scaled.resolution()
+		}
+	} else {
+		source, bodyids, err = dvidBodySource(ctx, json_data, uuid, bodyids, bounds, pruneCoarse, locked, &opts)
+		if err != nil {
+			serverError(ctx, w, err)
 			return
 		}
-		defer resp.Body.Close()
+	}
 
-		// not examing initial body data for now
-		var junk uint32
-		binary.Read(resp.Body, binary.LittleEndian, &junk)
-		binary.Read(resp.Body, binary.LittleEndian, &junk)
+	sparse_bodies, failures := fetchBodies(ctx, source, uuid, bodyids, scaleBounds(bounds, opts.res))
+	opts.failures = append(opts.failures, failures...)
 
-		var numspans uint32
-		binary.Read(resp.Body, binary.LittleEndian, &numspans)
+	// failed bodies are reported with the results unless nothing could be fetched
+	if len(sparse_bodies) == 0 && len(opts.failures) > 0 {
+		err = fmt.Errorf("No bodies could be fetched: %s", opts.failures[0].Error)
+		badGateway(w, err.Error())
+		return
+	}
 
-		sparse_body := sparseBody{}
-		sparse_body.bodyID = uint32(bodyid)
+	// relabel the bodies (supervoxels are relabeled when the results are aggregated)
+	if mapping != nil {
+		if opts.svmap != nil {
+			mapping.relabelSupervoxels(opts.svmap)
+		} else {
+			sparse_bodies = mapping.relabelBodies(sparse_bodies)
+		}
+	}
+        return
+}
 
-		for iter := 0; iter < int(numspans); iter += 1 {
-			var x, y, z, run int32
-			err = binary.Read(resp.Body, binary.LittleEndian, &x)
-			if err != nil {
-				badRequest(w, "Sparse body encoding incorrect")
-				return
-			}
-			err = binary.Read(resp.Body, binary.LittleEndian, &y)
-			if err != nil {
-				badRequest(w, "Sparse body encoding incorrect")
-				return
-			}
-			err = binary.Read(resp.Body, binary.LittleEndian, &z)
-			if err != nil {
-				badRequest(w, "Sparse body encoding incorrect")
-				return
-			}
-			err = binary.Read(resp.Body, binary.LittleEndian, &run)
-			if err != nil {
-				badRequest(w, "Sparse body encoding incorrect")
-				return
-			}
+// checkLocalRequest rejects the options that need DVID when the bodies come from a local source
+func checkLocalRequest(json_data map[string]interface{}, res bodyResolution, supervoxels, pruneCoarse bool) error {
+	if res.factor != 1 || pruneCoarse {
+		return fmt.Errorf("Only full resolution bodies are available from the local source")
+	}
+	if supervoxels {
+		return fmt.Errorf("Supervoxels are not available from the local source")
+	}
+	_, hasroi := json_data["roi"]
+	_, hasrois := json_data["rois"]
+	if hasroi || hasrois {
+		return fmt.Errorf("ROIs are not available from the local source")
+	}
+	return nil
+}
+
+// dvidBodySource locates the DVID label instance for the request and returns the source for the
+// bodies to fetch (bodies are replaced by their supervoxels or pruned at coarse resolution if requested)
+func dvidBodySource(ctx context.Context, json_data map[string]interface{}, uuid string, bodyids []uint64, bounds *bodyBounds, pruneCoarse, locked bool, opts *resultOptions) (BodySource, []uint64, error) {
+	// retrieve dvid server
+	dvidserver, err := getDVIDserver(json_data)
+	if err != nil {
+		return nil, nil, dvidServerError(err)
+	}
+
+	// find the label instance and its sparsevol route
+	instance, err := getLabelInstance(ctx, dvidserver, uuid, json_data)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := opts.res
+	if err = instance.checkResolution(res); err != nil {
+		return nil, nil, err
+	}
 
-			sparse_data := sparseData{x, y, z, run}
+	// cached bodies from unlocked nodes are evicted when they are changed
+	if !locked && cache != nil && watcher != nil {
+		watcher.watch(watchedNode{dvidserver, uuid, instance.name})
+	}
 
-			sparse_body.rle = append(sparse_body.rle, sparse_data)
+	// compute at the supervoxel level and aggregate to the bodies afterward
+	svquery := ""
+	if supervoxels, _ := json_data["supervoxels"].(bool); supervoxels {
+		if instance.typename != "labelmap" {
+			return nil, nil, fmt.Errorf("Supervoxels can only be requested for labelmap instances")
 		}
-		sparse_bodies = append(sparse_bodies, sparse_body)
+		var failures []bodyFailure
+		opts.svmap, bodyids, failures = expandSupervoxels(ctx, instance.baseURL(dvidserver, uuid), bodyids)
+		opts.failures = append(opts.failures, failures...)
+		svquery = "supervoxels=true"
 	}
 
-        return
+	if pruneCoarse {
+		coarse_res := coarseResolution(json_data)
+		coarse_source := &dvidSource{dvidserver, instance, coarse_res.route, joinQuery(svquery), locked}
+		coarse_bodies, failures := fetchBodies(ctx, coarse_source, uuid, bodyids, scaleBounds(bounds, coarse_res))
+		opts.failures = append(opts.failures, failures...)
+		bodyids = candidateBodies(coarse_bodies)
+	}
+
+	// bounds are only passed to DVID at full resolution and otherwise applied after the fetch
+	boundsquery := ""
+	if bounds != nil && res.factor == 1 {
+		boundsquery = bounds.queryString()
+	}
+	query := joinQuery(res.queryString(), boundsquery, svquery)
+
+	return &dvidSource{dvidserver, instance, res.route, query, locked}, bodyids, nil
+}
 
+// joinQuery builds a URL query string from the non-empty parameters
+func joinQuery(params ...string) string {
+	var nonempty []string
+	for _, param := range params {
+		if param != "" {
+			nonempty = append(nonempty, param)
+		}
+	}
+	if len(nonempty) == 0 {
+		return ""
+	}
+	return "?" + strings.Join(nonempty, "&")
 }
 
-// outputOverlap generates the overlap between bodies and outputs to json
-func outputOverlap(w http.ResponseWriter, sparse_bodies sparseBodies) { 
+// scaleBounds returns the bounds at the resolution of the fetch
+func scaleBounds(bounds *bodyBounds, res bodyResolution) *bodyBounds {
+	if bounds == nil || res.factor == 1 {
+		return bounds
+	}
+	return bounds.scaled(res.factor)
+}
+
+// outputOverlap generates the overlap between bodies (clipped or broken down by ROI if provided) and outputs to json
+func outputOverlap(w http.ResponseWriter, sparse_bodies sparseBodies, opts resultOptions, roi_bodies sparseBodies, regions *roiRegions) { 
 	// algorithm for computing overlap -- empty if there is no overlap
-	overlap_list := computeOverlap(sparse_bodies)
-	json_struct := make(map[string]resultList)
+	overlap_list, region_lists := computeOverlap(sparse_bodies, regions)
+	opts.res.rescaleOverlap(overlap_list)
+	json_struct := make(map[string]interface{})
+	if opts.svmap != nil {
+		json_struct["supervoxel-overlap-list"] = opts.svmap.overlapDetail(overlap_list)
+		overlap_list = opts.svmap.aggregateOverlap(overlap_list)
+	}
 	json_struct["overlap-list"] = overlap_list
+	if len(opts.failures) > 0 {
+		json_struct["failed-bodies"] = opts.failures
+	}
+	if roi_bodies != nil {
+		roi_list, _ := computeOverlap(roi_bodies, nil)
+		if opts.svmap != nil {
+			roi_list = opts.svmap.aggregateOverlap(roi_list)
+		}
+		json_struct["roi-overlap-list"] = roi_list
+	}
+	if regions != nil {
+		json_struct["overlap-by-roi"] = region_lists
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -231,12 +404,34 @@ func outputOverlap(w http.ResponseWriter, sparse_bodies sparseBodies) {
 	fmt.Fprintf(w, string(jsondata))
 }
 
-// outputStats generates body stats and outputs to json
-func outputStats(w http.ResponseWriter, sparse_bodies sparseBodies) { 
+// outputStats generates body stats (clipped or broken down by ROI if provided) and outputs to json
+func outputStats(w http.ResponseWriter, sparse_bodies sparseBodies, opts resultOptions, roi_bodies sparseBodies, regions *roiRegions) { 
 	// algorithm for computing overlap -- empty if there is no overlap
-	stat_list := computeStats(sparse_bodies)
-	json_struct := make(map[string]resultList)
+	stat_list, region_lists := computeStats(sparse_bodies, regions)
+	opts.res.rescaleStats(stat_list)
+	json_struct := make(map[string]interface{})
+	if opts.svmap != nil {
+		// supervoxels in the same body share faces that are not part of the body surface
+		sv_overlap, _ := computeOverlap(sparse_bodies, nil)
+		opts.res.rescaleOverlap(sv_overlap)
+		json_struct["supervoxel-stats"] = opts.svmap.statsDetail(stat_list)
+		stat_list = opts.svmap.aggregateStats(stat_list, sv_overlap)
+	}
 	json_struct["body-stats"] = stat_list
+	if len(opts.failures) > 0 {
+		json_struct["failed-bodies"] = opts.failures
+	}
+	if roi_bodies != nil {
+		// faces shared by supervoxels of the same body are already left out
+		roi_list := computeROIStats(sparse_bodies, roi_bodies, opts.svmap)
+		if opts.svmap != nil {
+			roi_list = opts.svmap.aggregateStats(roi_list, resultList{})
+		}
+		json_struct["roi-body-stats"] = roi_list
+	}
+	if regions != nil {
+		json_struct["body-stats-by-roi"] = region_lists
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -305,17 +500,25 @@ func formHandler2(w http.ResponseWriter, r *http.Request) {
 
         body_list_str := strings.Split(bodies, ",")
         for _, body_str := range body_list_str {
-               bodyid, _ := strconv.Atoi(strings.Trim(body_str, " "))
-               body_list = append(body_list, float64(bodyid))
+               bodyid, err := strconv.ParseUint(strings.Trim(body_str, " "), 10, 64)
+               if err != nil {
+                       badRequest(w, "Body ids must be unsigned integers")
+                       return
+               }
+               body_list = append(body_list, json.Number(strconv.FormatUint(bodyid, 10)))
         }
         json_data["bodies"] = body_list
 
-        sparse_bodies, err := extractBodies(w, json_data, statsSchema)
+        // bound the time spent fetching from DVID
+        ctx, cancel := requestContext(r, json_data)
+        defer cancel()
+
+        sparse_bodies, opts, err := extractBodies(ctx, w, json_data, statsSchema, nil, false, lockedNode(ctx, json_data))
         if err != nil {
                 return
         }
 
-        outputStats(w, sparse_bodies)
+        outputStats(w, sparse_bodies, opts, nil, nil)
 }
 
 
@@ -346,17 +549,25 @@ func formHandler(w http.ResponseWriter, r *http.Request) {
 
         body_list_str := strings.Split(bodies, ",")
         for _, body_str := range body_list_str {
-               bodyid, _ := strconv.Atoi(strings.Trim(body_str, " "))
-               body_list = append(body_list, float64(bodyid))
+               bodyid, err := strconv.ParseUint(strings.Trim(body_str, " "), 10, 64)
+               if err != nil {
+                       badRequest(w, "Body ids must be unsigned integers")
+                       return
+               }
+               body_list = append(body_list, json.Number(strconv.FormatUint(bodyid, 10)))
         }
         json_data["bodies"] = body_list
 
-        sparse_bodies, err := extractBodies(w, json_data, overlapSchema)
+        // bound the time spent fetching from DVID
+        ctx, cancel := requestContext(r, json_data)
+        defer cancel()
+
+        sparse_bodies, opts, err := extractBodies(ctx, w, json_data, overlapSchema, nil, false, lockedNode(ctx, json_data))
         if err != nil {
                 return
         }
 
-        outputOverlap(w, sparse_bodies)
+        outputOverlap(w, sparse_bodies, opts, nil, nil)
 }
 
 
@@ -372,16 +583,48 @@ func bodystatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// read json
-	decoder := json.NewDecoder(r.Body)
-	var json_data map[string]interface{}
-	err = decoder.Decode(&json_data)
+	// read json (and any bodies uploaded with it)
+	json_data, source, err := readRequest(w, r)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
 
-        sparse_bodies, err := extractBodies(w, json_data, statsSchema)
-        if err != nil {
-                return
-        }
-        outputStats(w, sparse_bodies)
+        // bound the time spent fetching from DVID
+        ctx, cancel := requestContext(r, json_data)
+        defer cancel()
+
+        runStats(ctx, w, json_data, source)
+}
+
+// runStats computes the body stats for a request and writes the result (or the error) to w
+func runStats(ctx context.Context, w http.ResponseWriter, json_data map[string]interface{}, source BodySource) {
+	// bodies and results from locked nodes never change so they are kept on disk (and the
+	// results may already be stored)
+	locked := source == nil && lockedNode(ctx, json_data)
+	if locked {
+		var storeResult func()
+		var stored bool
+		w, storeResult, stored = cachedResponse(ctx, w, bodystatsPath, json_data)
+		if stored {
+			return
+		}
+		defer storeResult()
+	}
+
+	sparse_bodies, opts, err := extractBodies(ctx, w, json_data, statsSchema, source, false, locked)
+	if err != nil {
+		return
+	}
+	roi_bodies, err := extractROIBodies(ctx, w, json_data, sparse_bodies)
+	if err != nil {
+		return
+	}
+	regions, err := extractRegions(ctx, w, json_data)
+	if err != nil {
+		return
+	}
+	outputStats(w, sparse_bodies, opts, roi_bodies, regions)
 }
 
 
@@ -398,26 +641,228 @@ func overlapHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// read json
-	decoder := json.NewDecoder(r.Body)
-	var json_data map[string]interface{}
-	err = decoder.Decode(&json_data)
+	// read json (and any bodies uploaded with it)
+	json_data, source, err := readRequest(w, r)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
 
-        sparse_bodies, err := extractBodies(w, json_data, overlapSchema)
-        if err != nil {
-                return
-        }
-        outputOverlap(w, sparse_bodies)
+        // bound the time spent fetching from DVID
+        ctx, cancel := requestContext(r, json_data)
+        defer cancel()
+
+        runOverlap(ctx, w, json_data, source)
 }
 
-// Serve is the main server function call that creates http server and handlers
-func Serve(proxyserver string, port int) {
-	proxyServer = proxyserver
+// runOverlap computes the overlap for a request and writes the result (or the error) to w
+func runOverlap(ctx context.Context, w http.ResponseWriter, json_data map[string]interface{}, source BodySource) {
+	// only fetch bodies that touch another body at coarse resolution
+	two_stage, _ := json_data["two-stage"].(bool)
+
+	// bodies and results from locked nodes never change so they are kept on disk (and the
+	// results may already be stored)
+	locked := source == nil && lockedNode(ctx, json_data)
+	if locked {
+		var storeResult func()
+		var stored bool
+		w, storeResult, stored = cachedResponse(ctx, w, overlapPath, json_data)
+		if stored {
+			return
+		}
+		defer storeResult()
+	}
+
+	sparse_bodies, opts, err := extractBodies(ctx, w, json_data, overlapSchema, source, two_stage, locked)
+	if err != nil {
+		return
+	}
+	roi_bodies, err := extractROIBodies(ctx, w, json_data, sparse_bodies)
+	if err != nil {
+		return
+	}
+	regions, err := extractRegions(ctx, w, json_data)
+	if err != nil {
+		return
+	}
+	outputOverlap(w, sparse_bodies, opts, roi_bodies, regions)
+}
+
+// Config contains the settings for the service
+type Config struct {
+	// Address of the serviceproxy server used to find DVID if Discovery is not set (optional)
+	ProxyServer string
+	// Discovery used to find DVID and to register the service (optional)
+	Discovery Discovery
+	// Discovery used to register the service in place of Discovery (optional)
+	Registration Discovery
+	// Time a discovered location is reused (DefaultDiscoveryTTL if 0, negative disables)
+	DiscoveryTTL time.Duration
+	// Port for the http server
+	Port int
+	// Data instance used if a request does not specify one (DefaultLabelInstance if empty)
+	LabelInstance string
+	// Maximum number of bodies fetched from DVID at once for a request (DefaultFetchParallelism if 0)
+	FetchParallelism int
+	// Time allowed for each request to DVID (DefaultDVIDTimeout if 0)
+	DVIDTimeout time.Duration
+	// Number of retries for DVID requests that fail with connection errors or 5xx responses (DefaultDVIDRetries
+	// if nil, 0 or negative for none)
+	DVIDRetries *int
+	// Time allowed for all of the DVID requests of a service call (DefaultRequestDeadline if 0)
+	RequestDeadline time.Duration
+	// Directory of sparse volume files (<dir>/<uuid>/<body>.sparsevol) used instead of DVID (optional)
+	SourceDir string
+	// Source of the bodies used instead of DVID (takes precedence over SourceDir)
+	Source BodySource
+	// Number of spans kept in the cache of bodies fetched from DVID (DefaultCacheSpans if 0, negative disables)
+	CacheSpans int
+	// Database file that keeps bodies from locked DVID nodes across restarts (optional)
+	DiskCache string
+	// Keep the overlap and stats results for locked nodes in the disk cache as well
+	CacheResults bool
+	// Authorization header that purges of the disk cache must carry (purges are refused if empty)
+	AdminAuthorization string
+	// PEM file of the certificate authorities trusted for https DVID servers (system roots if empty)
+	DVIDCABundle string
+	// Authorization header sent to DVID (e.g., "Bearer TOKEN") unless a request provides one (only sent to the
+	// backends, aliases, allowed servers, and discovered server)
+	DVIDAuthorization string
+	// Send the caller's Authorization header to DVID in place of the configured header
+	ForwardAuthorization bool
+	// Interval between polls for mutations of the nodes with cached bodies (DefaultMutationPoll if 0, negative disables)
+	MutationPoll time.Duration
+	// Authorization header that mutations pushed to /mutations must carry (pushes are refused if empty)
+	MutationAuthorization string
+	// JSON file of named DVID backends, each a list of servers (the primary and its replicas) and the uuid
+	// prefixes routed to it (optional)
+	Backends string
+	// DVID servers that requests may name ("host:port" or "https://host:port") and aliases ("prod=URL")
+	// in addition to the servers of the backends and the discovered server ("*" allows any server)
+	DVIDServers []string
+	// Number of asynchronous jobs run at once (DefaultJobWorkers if 0)
+	JobWorkers int
+	// Number of asynchronous jobs that can wait to run (DefaultJobQueue if 0)
+	JobQueue int
+	// Time allowed for all of the DVID requests of a job (no limit if 0)
+	JobDeadline time.Duration
+	// Database file that keeps the jobs and their results across restarts (optional)
+	JobStore string
+	// Time a finished job and its result are kept (DefaultJobExpiry if 0, negative keeps them until deleted)
+	JobExpiry time.Duration
+}
+
+// Serve is the main server function call that creates http server and handlers (an error is returned if
+// the service cannot start or the server stops unexpectedly)
+func Serve(config Config) error {
+	discovery = config.Discovery
+	if discovery == nil && config.ProxyServer != "" {
+		discovery = NewProxyDiscovery(config.ProxyServer, "")
+	}
+	registration = config.Registration
+	if registration == nil {
+		registration = discovery
+	}
+	if discovery != nil && config.DiscoveryTTL >= 0 {
+		ttl := DefaultDiscoveryTTL
+		if config.DiscoveryTTL > 0 {
+			ttl = config.DiscoveryTTL
+		}
+		discovery = newCachedDiscovery(discovery, ttl)
+	}
+	if config.LabelInstance != "" {
+		defaultInstance = config.LabelInstance
+	}
+	if config.FetchParallelism > 0 {
+		fetchParallelism = config.FetchParallelism
+	}
+	if config.DVIDTimeout > 0 {
+		dvid.httpclient.Timeout = config.DVIDTimeout
+	}
+	if config.DVIDRetries != nil {
+		dvid.retries = *config.DVIDRetries
+		if dvid.retries < 0 {
+			dvid.retries = 0
+		}
+	}
+	if config.RequestDeadline > 0 {
+		requestDeadline = config.RequestDeadline
+	}
+	if config.DVIDCABundle != "" {
+		if err := dvid.setCABundle(config.DVIDCABundle); err != nil {
+			return fmt.Errorf("CA bundle could not be loaded: %v", err)
+		}
+	}
+	dvidAuthorization = config.DVIDAuthorization
+	forwardAuthorization = config.ForwardAuthorization
+	setAllowlist(config.DVIDServers)
+	if config.Backends != "" {
+		if err := loadBackends(config.Backends); err != nil {
+			return fmt.Errorf("Backends could not be loaded: %v", err)
+		}
+	}
+	warnOpenServers()
+	if config.CacheSpans < 0 {
+		cache = nil
+	} else if config.CacheSpans > 0 {
+		cache = newBodyCache(config.CacheSpans)
+	}
+	if config.DiskCache != "" {
+		var err error
+		if diskcache, err = openDiskCache(config.DiskCache, config.CacheResults); err != nil {
+			return fmt.Errorf("Disk cache could not be opened: %v", err)
+		}
+	}
+	adminAuthorization = config.AdminAuthorization
+	if config.MutationPoll < 0 {
+		watcher = nil
+	} else if config.MutationPoll > 0 {
+		mutationPoll = config.MutationPoll
+	}
+	mutationAuthorization = config.MutationAuthorization
+	if watcher == nil && cache != nil {
+		if mutationAuthorization == "" {
+			fmt.Printf("Warning: mutation polling is disabled and pushes are refused, so bodies cached from unlocked nodes are never evicted\n")
+		} else {
+			fmt.Printf("Warning: mutation polling is disabled, so bodies cached from unlocked nodes are only evicted by pushed mutations\n")
+		}
+	}
+	if config.JobWorkers > 0 {
+		jobWorkers = config.JobWorkers
+	}
+	if config.JobQueue > 0 {
+		jobs = newJobQueue(config.JobQueue)
+	}
+	if config.JobDeadline > 0 {
+		jobDeadline = config.JobDeadline
+	}
+	if config.JobExpiry != 0 {
+		jobExpiry = config.JobExpiry
+	}
+	if config.JobStore != "" {
+		store, err := openJobStore(config.JobStore)
+		if err == nil {
+			err = jobs.restore(store)
+		}
+		if err != nil {
+			return fmt.Errorf("Job store could not be opened: %v", err)
+		}
+	}
+	if config.Source != nil {
+		bodySource = config.Source
+	} else if config.SourceDir != "" {
+		bodySource = NewDirectorySource(config.SourceDir)
+	}
 
 	hname, _ := os.Hostname()
-	webAddress = hname + ":" + strconv.Itoa(port)
+	webAddress = hname + ":" + strconv.Itoa(config.Port)
 
 	fmt.Printf("Web server address: %s\n", webAddress)
+	if registration != nil {
+		if err := registration.Register(serviceName, webAddress); err != nil {
+			fmt.Printf("Service could not be registered: %v\n", err)
+		}
+	}
 	fmt.Printf("Running...\n")
 
 	httpserver := &http.Server{Addr: webAddress}
@@ -440,14 +885,59 @@ func Serve(proxyserver string, port int) {
         // perform bodystats service
 	http.HandleFunc(bodystatsPath, bodystatsHandler)
 
-	// exit server if user presses Ctrl-C
+	// report the body cache hits and misses
+	http.HandleFunc(cachePath, cacheHandler)
+
+	// inspect and purge the disk cache
+	http.HandleFunc(diskCachePath, diskCacheHandler)
+
+	// evict bodies changed by pushed mutations
+	http.HandleFunc(mutationsPath, mutationsHandler)
+
+	// run overlap and stats requests in the background (until the server stops)
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	http.HandleFunc(jobsPath, jobsHandler)
+	jobs.start(ctx, jobWorkers)
+
+	// poll for mutations of the nodes with cached bodies
+	if watcher != nil {
+		go watcher.run(ctx)
+	}
+
+	// stop server if user presses Ctrl-C (waiting for the service calls in progress)
+	stopped := make(chan struct{})
 	go func() {
-		sigch := make(chan os.Signal)
+		defer close(stopped)
+		sigch := make(chan os.Signal, 1)
 		signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
 		<-sigch
 		fmt.Println("Exiting...")
-		os.Exit(0)
+		if registration != nil {
+			if err := registration.Deregister(); err != nil {
+				fmt.Printf("Service could not be deregistered: %v\n", err)
+			}
+		}
+		shutdownctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpserver.Shutdown(shutdownctx); err != nil {
+			fmt.Printf("Service calls did not finish: %v\n", err)
+			httpserver.Close()
+		}
 	}()
 
-	httpserver.ListenAndServe()
+	err := httpserver.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-stopped
+		err = nil
+	} else {
+		err = fmt.Errorf("Web server stopped: %v", err)
+	}
+
+	// interrupted jobs are queued again so that they resume after a restart
+	stopWorkers()
+	jobs.stop()
+	if diskcache != nil {
+		diskcache.db.Close()
+	}
+	return err
 }
@@ -0,0 +1,546 @@
+package overlap
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testBodies are two bodies along x that share one face
+var testBodies = map[uint64][][4]int32{
+	1: {{0, 0, 0, 2}},
+	2: {{2, 0, 0, 3}},
+}
+
+// serviceHandlers are the handlers of the service paths
+var serviceHandlers = map[string]http.HandlerFunc{
+	overlapPath:   overlapHandler,
+	bodystatsPath: bodystatsHandler,
+}
+
+// callHandler posts the request to the service path and returns the status and the trimmed response
+func callHandler(path string, request string) (int, string) {
+	w := httptest.NewRecorder()
+	serviceHandlers[path](w, httptest.NewRequest("POST", path, strings.NewReader(request)))
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+// checkHandler fails the test if the service does not return the status and response
+func checkHandler(t *testing.T, path string, request string, status int, response string) {
+	t.Helper()
+	code, body := callHandler(path, request)
+	if code != status || body != response {
+		t.Fatalf("Request %s returned %d %q instead of %d %q", request, code, body, status, response)
+	}
+}
+
+// checkHandlerStatus fails the test if the service does not return the status
+func checkHandlerStatus(t *testing.T, path string, request string, status int) string {
+	t.Helper()
+	code, body := callHandler(path, request)
+	if code != status {
+		t.Fatalf("Request %s returned %d %q instead of %d", request, code, body, status)
+	}
+	return body
+}
+
+// useSource serves the bodies from the local source until the test ends
+func useSource(t *testing.T, source BodySource) {
+	bodySource = source
+	t.Cleanup(func() { bodySource = nil })
+}
+
+// testMemorySource holds the test bodies under the uuid
+func testMemorySource(t *testing.T, uuid string) *MemorySource {
+	source := NewMemorySource()
+	for bodyid, spans := range testBodies {
+		if err := source.AddSparsevol(uuid, bodyid, bytes.NewReader(sparsevolData(0, spans, uint32(len(spans))))); err != nil {
+			t.Fatalf("Body %d could not be added: %v", bodyid, err)
+		}
+	}
+	return source
+}
+
+// testDirectorySource writes the test bodies for the uuid to a temporary directory
+func testDirectorySource(t *testing.T, uuid string) *DirectorySource {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, uuid), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for bodyid, spans := range testBodies {
+		filename := filepath.Join(dir, uuid, strconv.FormatUint(bodyid, 10)+".sparsevol")
+		if err := os.WriteFile(filename, sparsevolData(0, spans, uint32(len(spans))), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewDirectorySource(dir)
+}
+
+func TestLocalSourceHandlers(t *testing.T) {
+	sources := map[string]BodySource{
+		"memory":    testMemorySource(t, "abc"),
+		"directory": testDirectorySource(t, "abc"),
+	}
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			useSource(t, source)
+			checkHandler(t, overlapPath, `{"uuid":"abc","bodies":[1,2]}`, 200, `{"overlap-list":[[1,2,1]]}`)
+			checkHandler(t, bodystatsPath, `{"uuid":"abc","bodies":[1,2]}`, 200, `{"body-stats":[[2,3,14],[1,2,10]]}`)
+
+			// the bounding box clips body 1 to one voxel
+			checkHandler(t, bodystatsPath, `{"uuid":"abc","bodies":[1,2],"minx":1}`, 200, `{"body-stats":[[2,3,14],[1,1,6]]}`)
+
+			// merging the bodies leaves one body of five voxels
+			checkHandler(t, overlapPath, `{"uuid":"abc","bodies":[1,2],"mapping":{"2":1}}`, 200, `{"overlap-list":[]}`)
+			checkHandler(t, bodystatsPath, `{"uuid":"abc","bodies":[1,2],"mapping":{"2":1}}`, 200, `{"body-stats":[[1,5,22]]}`)
+
+			body := checkHandlerStatus(t, overlapPath, `{"uuid":"abc","bodies":[1,2,3]}`, 200)
+			if !strings.Contains(body, `"failed-bodies":[{"body":3,`) || !strings.Contains(body, `"overlap-list":[[1,2,1]]`) {
+				t.Fatalf("Missing body was not reported as failed: %s", body)
+			}
+			checkHandlerStatus(t, overlapPath, `{"uuid":"abc","bodies":[1,2],"supervoxels":true}`, 400)
+			checkHandlerStatus(t, overlapPath, `{"uuid":"abc","bodies":[1,2],"rois":["roi"]}`, 400)
+			checkHandlerStatus(t, overlapPath, `{"uuid":"abc","bodies":[1,2,1]}`, 400)
+			checkHandlerStatus(t, overlapPath, `{"uuid":"abc","bodies":[1,2],"mapping":{"2":0}}`, 400)
+		})
+	}
+}
+
+func TestDirectorySourceUUID(t *testing.T) {
+	useSource(t, testDirectorySource(t, "abc"))
+	body := checkHandlerStatus(t, overlapPath, `{"uuid":"../abc","bodies":[1,2]}`, 502)
+	if !strings.Contains(body, "not hexadecimal") {
+		t.Fatalf("Uuid that is not hexadecimal was not rejected: %s", body)
+	}
+}
+
+func TestInlineBodies(t *testing.T) {
+	checkHandler(t, overlapPath, `{"rles":{"1":[[0,0,0,2]],"2":[[2,0,0,3]]}}`, 200, `{"overlap-list":[[1,2,1]]}`)
+	checkHandler(t, bodystatsPath, `{"rles":{"1":[[0,0,0,2]],"2":[[2,0,0,3]]}}`, 200, `{"body-stats":[[2,3,14],[1,2,10]]}`)
+	checkHandlerStatus(t, bodystatsPath, `{"rles":{"1":[[0,0,0,2]],"2":[[2,0,0,-3]]}}`, 400)
+
+	// body ids above 2^53 are returned exactly
+	checkHandler(t, overlapPath, `{"rles":{"9007199254740993":[[0,0,0,2]],"18446744073709551615":[[2,0,0,3]]}}`, 200, `{"overlap-list":[[9007199254740993,18446744073709551615,1]]}`)
+
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	part, _ := form.CreateFormField("request")
+	part.Write([]byte(`{"minx":1}`))
+	for bodyid, spans := range testBodies {
+		part, _ = form.CreateFormFile(strconv.FormatUint(bodyid, 10), "body.sparsevol")
+		part.Write(sparsevolData(0, spans, uint32(len(spans))))
+	}
+	form.Close()
+
+	r := httptest.NewRequest("POST", bodystatsPath, &buf)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	bodystatsHandler(w, r)
+	if response := strings.TrimSpace(w.Body.String()); w.Code != 200 || response != `{"body-stats":[[2,3,14],[1,1,6]]}` {
+		t.Fatalf("Multipart request returned %d %q", w.Code, response)
+	}
+}
+
+// multipartRequest builds a multipart request uploading the sparse volumes named by body id
+func multipartRequest(path string, request string, sparsevols map[string][]byte) *http.Request {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	part, _ := form.CreateFormField("request")
+	part.Write([]byte(request))
+	for name, data := range sparsevols {
+		part, _ = form.CreateFormFile(name, "body.sparsevol")
+		part.Write(data)
+	}
+	form.Close()
+
+	r := httptest.NewRequest("POST", path, &buf)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestInlineLimits(t *testing.T) {
+	// spans of a body may not repeat or overlap
+	body := checkHandlerStatus(t, overlapPath, `{"rles":{"1":[[0,0,0,2],[1,0,0,3]],"2":[[5,0,0,3]]}}`, 400)
+	if !strings.Contains(body, "overlapping spans at (1, 0, 0)") {
+		t.Fatalf("Overlapping spans were not rejected: %s", body)
+	}
+	checkHandlerStatus(t, overlapPath, `{"rles":{"1":[[0,0,0,2],[0,0,0,2]]}}`, 400)
+	checkHandler(t, bodystatsPath, `{"rles":{"1":[[2,0,0,2],[0,0,0,2]]}}`, 200, `{"body-stats":[[1,4,18]]}`)
+
+	sparsevols := map[string][]byte{"1": sparsevolData(0, [][4]int32{{0, 0, 0, 2}, {1, 0, 0, 2}}, 2)}
+	w := httptest.NewRecorder()
+	overlapHandler(w, multipartRequest(overlapPath, `{}`, sparsevols))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "overlapping spans") {
+		t.Fatalf("Multipart request with overlapping spans returned %d %q", w.Code, w.Body.String())
+	}
+
+	defer func(saved int64) { maxUploadBytes = saved }(maxUploadBytes)
+	maxUploadBytes = 200
+	body = checkHandlerStatus(t, overlapPath, `{"rles":{"1":[[0,0,0,2]],"2":[[2,0,0,3]]},"padding":"`+strings.Repeat("x", 200)+`"}`, 400)
+	if !strings.Contains(body, "exceeds the limit of 200 bytes") {
+		t.Fatalf("Request above the limit was not rejected: %s", body)
+	}
+
+	// a run of 100 voxels along y is small to upload but decodes to 100 spans
+	maxUploadBytes = 1000
+	sparsevols = map[string][]byte{"1": sparsevolData(1, [][4]int32{{0, 0, 0, 100}}, 1)}
+	w = httptest.NewRecorder()
+	overlapHandler(w, multipartRequest(overlapPath, `{}`, sparsevols))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "spans exceed the limit of 62") {
+		t.Fatalf("Multipart request above the span limit returned %d %q", w.Code, w.Body.String())
+	}
+}
+
+// fakeDVID serves the sparse volumes (at the resolution and within the bounds of the query), supervoxels,
+// ROIs, node locks, and instance info used by the service from memory and records the requests it receives
+type fakeDVID struct {
+	mutex sync.Mutex
+	// spans of each body (and supervoxel) at full resolution
+	bodies map[uint64][][4]int32
+	// supervoxels of each body
+	supervoxels map[uint64][]uint64
+	// [z, y, x0, x1] block spans of each ROI
+	rois map[string][][]int32
+	// type and syncs of each data instance
+	instances map[string]instanceInfo
+	locked    bool
+	requests  []string
+}
+
+// newFakeDVID serves the test bodies from a labelmap instance named after the default instance
+func newFakeDVID() *fakeDVID {
+	dvidserver := &fakeDVID{
+		bodies:      make(map[uint64][][4]int32),
+		supervoxels: make(map[uint64][]uint64),
+		rois:        make(map[string][][]int32),
+		instances:   make(map[string]instanceInfo),
+	}
+	for bodyid, spans := range testBodies {
+		dvidserver.bodies[bodyid] = spans
+	}
+	dvidserver.addInstance(DefaultLabelInstance, "labelmap")
+	return dvidserver
+}
+
+// addInstance adds a data instance of the type synced to the other instances
+func (dvidserver *fakeDVID) addInstance(name, typename string, syncs ...string) {
+	var info instanceInfo
+	info.Base.TypeName = typename
+	info.Base.Syncs = syncs
+	dvidserver.instances[name] = info
+}
+
+// start serves the fake DVID (allowlisted and with the body cache disabled) until the test ends and returns
+// its address
+func (dvidserver *fakeDVID) start(t *testing.T) string {
+	server := httptest.NewServer(dvidserver)
+	address := strings.TrimPrefix(server.URL, "http://")
+	setAllowlist([]string{address})
+	t.Cleanup(func() {
+		server.Close()
+		setAllowlist(nil)
+	})
+	useCache(t, nil)
+	return address
+}
+
+// useCache replaces the body cache until the test ends
+func useCache(t *testing.T, replacement *bodyCache) {
+	saved := cache
+	cache = replacement
+	t.Cleanup(func() { cache = saved })
+}
+
+// requested returns the requests received with the path containing the given text
+func (dvidserver *fakeDVID) requested(text string) []string {
+	dvidserver.mutex.Lock()
+	defer dvidserver.mutex.Unlock()
+	var requests []string
+	for _, request := range dvidserver.requests {
+		if strings.Contains(request, text) {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func (dvidserver *fakeDVID) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dvidserver.mutex.Lock()
+	dvidserver.requests = append(dvidserver.requests, r.URL.RequestURI())
+	dvidserver.mutex.Unlock()
+
+	// paths are /api/node/<uuid>/<instance>/<endpoint>[/<id>]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/node/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if parts[1] == "commit" {
+		json.NewEncoder(w).Encode(map[string]bool{"Locked": dvidserver.locked})
+		return
+	}
+	if len(parts) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+	name, endpoint := parts[1], parts[2]
+	if spans, found := dvidserver.rois[name]; found && endpoint == "roi" {
+		json.NewEncoder(w).Encode(spans)
+		return
+	}
+	info, found := dvidserver.instances[name]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if endpoint == "info" {
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+	if len(parts) < 4 {
+		http.NotFound(w, r)
+		return
+	}
+	bodyid, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if supervoxels, found := dvidserver.supervoxels[bodyid]; found && endpoint == "supervoxels" {
+		json.NewEncoder(w).Encode(supervoxels)
+		return
+	}
+	if spans, found := dvidserver.bodies[bodyid]; found && (endpoint == "sparsevol" || endpoint == "sparsevol-coarse") {
+		if endpoint == "sparsevol-coarse" {
+			spans = coarseSpans(spans, defaultCoarseBlockSize)
+		} else if scale, _ := strconv.Atoi(r.URL.Query().Get("scale")); scale > 0 {
+			spans = coarseSpans(spans, 1<<uint(scale))
+		}
+		spans = boundedSpans(spans, r)
+		if len(spans) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write(sparsevolData(0, spans, uint32(len(spans))))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// coarseSpans downsamples the spans to blocks of the given size
+func coarseSpans(spans [][4]int32, blocksize int32) [][4]int32 {
+	blocks := make(map[[3]int32]bool)
+	var coarse [][4]int32
+	for _, span := range spans {
+		for x := span[0]; x < span[0]+span[3]; x += 1 {
+			block := [3]int32{floorDiv(x, blocksize), floorDiv(span[1], blocksize), floorDiv(span[2], blocksize)}
+			if !blocks[block] {
+				blocks[block] = true
+				coarse = append(coarse, [4]int32{block[0], block[1], block[2], 1})
+			}
+		}
+	}
+	return coarse
+}
+
+// boundedSpans returns the spans intersecting the bounds in the query (whole, as DVID does)
+func boundedSpans(spans [][4]int32, r *http.Request) [][4]int32 {
+	var bounded [][4]int32
+	for _, span := range spans {
+		inside := true
+		for i, name := range boundNames {
+			val, err := strconv.Atoi(r.URL.Query().Get(name))
+			if err != nil {
+				continue
+			}
+			low, high := span[i/2], span[i/2]
+			if i/2 == 0 {
+				high = span[0] + span[3] - 1
+			}
+			if (i%2 == 0 && high < int32(val)) || (i%2 == 1 && low > int32(val)) {
+				inside = false
+			}
+		}
+		if inside {
+			bounded = append(bounded, span)
+		}
+	}
+	return bounded
+}
+
+// dvidRequest builds a service request for the bodies at the fake DVID with the extra fields
+func dvidRequest(address string, bodies string, fields string) string {
+	request := `{"dvid-server":"` + address + `","uuid":"abc","bodies":` + bodies
+	if fields != "" {
+		request += "," + fields
+	}
+	return request + "}"
+}
+
+func TestDVIDBodies(t *testing.T) {
+	dvidserver := newFakeDVID()
+	address := dvidserver.start(t)
+
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", ""), 200, `{"overlap-list":[[1,2,1]]}`)
+	checkHandler(t, bodystatsPath, dvidRequest(address, "[1,2]", ""), 200, `{"body-stats":[[2,3,14],[1,2,10]]}`)
+	if len(dvidserver.requested("/sp2body/sparsevol/")) != 4 {
+		t.Fatalf("Bodies were not read from sp2body: %v", dvidserver.requested("/sparsevol/"))
+	}
+
+	// missing bodies are reported with the results unless no body can be read
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,3]", ""), 200,
+		`{"failed-bodies":[{"body":3,"error":"http://`+address+`/api/node/abc/sp2body/sparsevol/3 returned status 404"}],"overlap-list":[]}`)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[3,4]", ""), 502)
+
+	// merging the bodies leaves one body with the shared face inside it
+	checkHandler(t, bodystatsPath, dvidRequest(address, "[1,2]", `"mapping":{"2":1}`), 200, `{"body-stats":[[1,5,22]]}`)
+	checkHandlerStatus(t, bodystatsPath, dvidRequest(address, "[1,2]", `"mapping":{"x":1}`), 400)
+
+	// body ids above 2^53 are passed to DVID and returned exactly
+	dvidserver.bodies[18446744073709551615] = testBodies[2]
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,18446744073709551615]", ""), 200, `{"overlap-list":[[1,18446744073709551615,1]]}`)
+	if len(dvidserver.requested("/sparsevol/18446744073709551615")) != 1 {
+		t.Fatalf("Largest body id was not requested exactly: %v", dvidserver.requested("/sparsevol/"))
+	}
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2.5]", ""), 400)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,18446744073709551615,18446744073709551615]", ""), 400)
+}
+
+func TestLabelInstances(t *testing.T) {
+	dvidserver := newFakeDVID()
+	dvidserver.addInstance("labels", "labelblk", "grayscale", "bodies")
+	dvidserver.addInstance("bodies", "labelvol")
+	dvidserver.addInstance("grayscale", "uint8blk")
+	dvidserver.addInstance("unsynced", "labelblk")
+	address := dvidserver.start(t)
+
+	// labelblk instances are read through their synced labelvol
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", `"label-instance":"labels"`), 200, `{"overlap-list":[[1,2,1]]}`)
+	if len(dvidserver.requested("/bodies/sparsevol/")) != 2 {
+		t.Fatalf("Synced labelvol was not read: %v", dvidserver.requested("/sparsevol/"))
+	}
+
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"label-instance":"unsynced"`), 400)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"label-instance":"grayscale"`), 400)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"label-instance":"bodies","scale":1`), 400)
+}
+
+func TestBoundsQuery(t *testing.T) {
+	dvidserver := newFakeDVID()
+	dvidserver.bodies[3] = [][4]int32{{100, 0, 0, 1}}
+	address := dvidserver.start(t)
+
+	// DVID has no content for body 3 and returns all of body 2 although only part is in the bounds
+	checkHandler(t, bodystatsPath, dvidRequest(address, "[1,2,3]", `"maxx":2`), 200, `{"body-stats":[[1,2,10],[2,1,6],[3,0,0]]}`)
+	for _, request := range dvidserver.requested("/sparsevol/") {
+		if !strings.HasSuffix(request, "?maxx=2") {
+			t.Fatalf("Bounds were not passed to DVID: %s", request)
+		}
+	}
+
+	// bounds that do not fit in 32 bits are rejected rather than wrapped
+	body := checkHandlerStatus(t, bodystatsPath, dvidRequest(address, "[1,2]", `"maxx":4294967298`), 400)
+	if !strings.Contains(body, "maxx") {
+		t.Fatalf("Out of range bound was not named: %s", body)
+	}
+	checkHandlerStatus(t, bodystatsPath, dvidRequest(address, "[1,2]", `"minz":-2147483649`), 400)
+}
+
+func TestResolutions(t *testing.T) {
+	dvidserver := newFakeDVID()
+	dvidserver.bodies[3] = [][4]int32{{1000, 0, 0, 1}}
+	address := dvidserver.start(t)
+
+	// at scale 1 the bodies share one face of 2x2 voxels
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", `"scale":1`), 200, `{"overlap-list":[[1,2,4]]}`)
+	if len(dvidserver.requested("?scale=1")) != 2 {
+		t.Fatalf("Scale was not passed to DVID: %v", dvidserver.requested("/sparsevol/"))
+	}
+
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"coarse":true`), 200)
+	if len(dvidserver.requested("/sparsevol-coarse/")) != 2 {
+		t.Fatalf("Coarse bodies were not requested: %v", dvidserver.requested("/sparsevol"))
+	}
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"coarse":true,"scale":1`), 400)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"coarse":true,"block-size":2048`), 400)
+
+	// body 3 does not share a block with the other bodies so it is only fetched at coarse resolution
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2,3]", `"two-stage":true`), 200, `{"overlap-list":[[1,2,1]]}`)
+	if len(dvidserver.requested("/sparsevol/3")) != 0 || len(dvidserver.requested("/sparsevol-coarse/3")) != 1 {
+		t.Fatalf("Two-stage request fetched body 3 at full resolution: %v", dvidserver.requested("/sparsevol"))
+	}
+}
+
+func TestSupervoxels(t *testing.T) {
+	dvidserver := newFakeDVID()
+	dvidserver.bodies[3] = [][4]int32{{2, 1, 0, 3}}
+	dvidserver.supervoxels[10] = []uint64{1, 3}
+	dvidserver.supervoxels[20] = []uint64{2}
+	address := dvidserver.start(t)
+
+	checkHandler(t, overlapPath, dvidRequest(address, "[10,20]", `"supervoxels":true`), 200,
+		`{"overlap-list":[[10,20,4]],"supervoxel-overlap-list":[[10,20,3,2,3],[10,20,1,2,1]]}`)
+	for _, request := range dvidserver.requested("/sparsevol/") {
+		if !strings.HasSuffix(request, "?supervoxels=true") {
+			t.Fatalf("Supervoxels were not requested: %s", request)
+		}
+	}
+
+	// supervoxels 1 and 3 do not touch so the surface of body 10 is the sum of theirs
+	body := checkHandlerStatus(t, bodystatsPath, dvidRequest(address, "[10,20]", `"supervoxels":true`), 200)
+	if !strings.Contains(body, `"body-stats":[[10,5,24],[20,3,14]]`) {
+		t.Fatalf("Supervoxel stats were not aggregated: %s", body)
+	}
+
+	// bodies whose supervoxels cannot be read are reported with the results
+	body = checkHandlerStatus(t, overlapPath, dvidRequest(address, "[10,30]", `"supervoxels":true`), 200)
+	if !strings.Contains(body, `"failed-bodies":[{"body":30,`) {
+		t.Fatalf("Body without supervoxels was not reported: %s", body)
+	}
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[30]", `"supervoxels":true`), 502)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[10,20]", `"supervoxels":true,"rois":["a"]`), 400)
+}
+
+func TestROI(t *testing.T) {
+	dvidserver := newFakeDVID()
+	dvidserver.bodies[1] = [][4]int32{{0, 0, 0, 40}}
+	dvidserver.bodies[2] = [][4]int32{{0, 1, 0, 40}}
+	dvidserver.rois["first"] = [][]int32{{0, 0, 0, 0}}
+	dvidserver.rois["second"] = [][]int32{{0, 0, 0, 1}}
+	address := dvidserver.start(t)
+
+	// the bodies share 40 faces, 32 in the first block (the faces at the block boundary are not surface)
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", `"roi":"first"`), 200,
+		`{"overlap-list":[[1,2,40]],"roi-overlap-list":[[1,2,32]]}`)
+	checkHandler(t, bodystatsPath, dvidRequest(address, "[1,2]", `"roi":"first"`), 200,
+		`{"body-stats":[[1,40,162],[2,40,162]],"roi-body-stats":[[1,32,129],[2,32,129]]}`)
+	if len(dvidserver.requested("/api/node/abc/first/roi")) != 2 {
+		t.Fatalf("ROI was not read: %v", dvidserver.requested("/roi"))
+	}
+
+	// blocks in both ROIs belong to the first one listed
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", `"rois":["first","second"]`), 200,
+		`{"overlap-by-roi":{"first":[[1,2,32]],"second":[[1,2,8]]},"overlap-list":[[1,2,40]]}`)
+	checkHandler(t, overlapPath, dvidRequest(address, "[1,2]", `"rois":["second","first"]`), 200,
+		`{"overlap-by-roi":{"first":[],"second":[[1,2,40]]},"overlap-list":[[1,2,40]]}`)
+	checkHandler(t, bodystatsPath, dvidRequest(address, "[1,2]", `"rois":["first","second"]`), 200,
+		`{"body-stats":[[1,40,162],[2,40,162]],"body-stats-by-roi":{"first":[[1,32,129],[2,32,129]],"second":[[1,8,33],[2,8,33]]}}`)
+
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"roi":"missing"`), 400)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"rois":["first","missing"]`), 400)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"rois":["first","first"]`), 400)
+
+	// a malformed ROI is a DVID failure rather than a bad request
+	dvidserver.rois["broken"] = [][]int32{{0, 0, 0}}
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"roi":"broken"`), 502)
+	checkHandlerStatus(t, overlapPath, dvidRequest(address, "[1,2]", `"rois":["first","broken"]`), 502)
+}
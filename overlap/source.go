@@ -0,0 +1,192 @@
+package overlap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// BodySource provides the run length encoding of bodies at a version of the segmentation
+type BodySource interface {
+	// FetchBody returns the RLE of the body at the given uuid
+	FetchBody(ctx context.Context, uuid string, bodyid uint64) (SparseBody, error)
+}
+
+// Span is a run of voxels along x starting at (X, Y, Z)
+type Span struct {
+	X      int32
+	Y      int32
+	Z      int32
+	Length int32
+}
+
+// NewSparseBody creates the RLE of a body from its spans
+func NewSparseBody(bodyid uint64, spans []Span) SparseBody {
+	sparse_body := SparseBody{bodyID: bodyid, rle: make([]sparseData, len(spans))}
+	for i, span := range spans {
+		sparse_body.rle[i] = sparseData{span.X, span.Y, span.Z, span.Length}
+	}
+	return sparse_body
+}
+
+// BodyID returns the id of the body
+func (sparse_body SparseBody) BodyID() uint64 {
+	return sparse_body.bodyID
+}
+
+// Spans returns the runs of the body
+func (sparse_body SparseBody) Spans() []Span {
+	spans := make([]Span, len(sparse_body.rle))
+	for i, chunk := range sparse_body.rle {
+		spans[i] = Span{chunk.x, chunk.y, chunk.z, chunk.length}
+	}
+	return spans
+}
+
+// bodySource replaces DVID as the source of all bodies if set
+var bodySource BodySource
+
+// dvidSource fetches sparse volumes from a DVID label instance
+type dvidSource struct {
+	dvidserver string
+	instance   labelInstance
+	// sparsevol route ("sparsevol" or "sparsevol-coarse")
+	route string
+	// query string added to each request (including the "?")
+	query string
+	// the node is locked so its bodies can be kept in the disk cache
+	locked bool
+}
+
+// FetchBody returns the cached body (from memory or, for locked nodes, from disk) or reads and decodes its
+// sparse volume (the response is closed as soon as it is decoded)
+func (source *dvidSource) FetchBody(ctx context.Context, uuid string, bodyid uint64) (SparseBody, error) {
+	key := bodyKey{source.dvidserver, uuid, source.instance.name, source.route + source.query, credentialID(ctx), bodyid}
+	var generation uint64
+	if cache != nil {
+		if sparse_body, found := cache.get(key); found {
+			return sparse_body, nil
+		}
+		generation = cache.startFetch(uuid)
+		defer cache.finishFetch(uuid)
+	}
+	if source.locked {
+		if sparse_body, found := diskcache.getBody(key); found {
+			if cache != nil {
+				cache.put(key, sparse_body, generation)
+			}
+			return sparse_body, nil
+		}
+	}
+
+	url := source.instance.baseURL(source.dvidserver, uuid) + source.route + "/" + strconv.FormatUint(bodyid, 10) + source.query
+	resp, err := dvid.get(ctx, url)
+	if err != nil {
+		return SparseBody{}, err
+	}
+	defer resp.Body.Close()
+
+	// DVID has no content if none of the body is within the bounds
+	sparse_body := SparseBody{bodyID: bodyid}
+	if resp.StatusCode != http.StatusNoContent {
+		sparse_body, err = decodeSparsevol(resp.Body, bodyid)
+		if err != nil {
+			return sparse_body, err
+		}
+	}
+	if cache != nil {
+		cache.put(key, sparse_body, generation)
+	}
+	if source.locked {
+		diskcache.putBody(key, sparse_body)
+	}
+	return sparse_body, nil
+}
+
+// DirectorySource reads DVID-format sparse volumes from files stored as <dir>/<uuid>/<body>.sparsevol
+type DirectorySource struct {
+	dir string
+}
+
+// NewDirectorySource creates a source for the sparse volumes stored under dir
+func NewDirectorySource(dir string) *DirectorySource {
+	return &DirectorySource{dir}
+}
+
+// FetchBody reads and decodes the sparse volume file for one body (the uuid must be hexadecimal so that
+// it cannot name a file outside the directory)
+func (source *DirectorySource) FetchBody(ctx context.Context, uuid string, bodyid uint64) (SparseBody, error) {
+	if !isHexUUID(uuid) {
+		return SparseBody{}, fmt.Errorf("UUID %q is not hexadecimal", uuid)
+	}
+	filename := filepath.Join(source.dir, uuid, strconv.FormatUint(bodyid, 10)+".sparsevol")
+	file, err := os.Open(filename)
+	if err != nil {
+		return SparseBody{}, fmt.Errorf("Sparse volume for body %d could not be read: %v", bodyid, err)
+	}
+	defer file.Close()
+
+	return decodeSparsevol(file, bodyid)
+}
+
+// isHexUUID checks that the uuid (or uuid prefix) only has hexadecimal digits
+func isHexUUID(uuid string) bool {
+	if uuid == "" {
+		return false
+	}
+	for _, c := range uuid {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// MemorySource holds decoded bodies in memory
+type MemorySource struct {
+	mutex  sync.RWMutex
+	bodies map[string]map[uint64]SparseBody
+}
+
+// NewMemorySource creates an empty in-memory source
+func NewMemorySource() *MemorySource {
+	return &MemorySource{bodies: make(map[string]map[uint64]SparseBody)}
+}
+
+// AddSparsevol decodes a DVID-format sparse volume and stores it as the body at the uuid
+func (source *MemorySource) AddSparsevol(uuid string, bodyid uint64, reader io.Reader) error {
+	sparse_body, err := decodeSparsevol(reader, bodyid)
+	if err != nil {
+		return err
+	}
+	source.addBody(uuid, sparse_body)
+	return nil
+}
+
+// addBody stores the body at the uuid (replacing any body with the same id)
+func (source *MemorySource) addBody(uuid string, sparse_body SparseBody) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if source.bodies[uuid] == nil {
+		source.bodies[uuid] = make(map[uint64]SparseBody)
+	}
+	source.bodies[uuid][sparse_body.bodyID] = sparse_body
+}
+
+// FetchBody returns the stored body (the RLE is shared so it must not be modified)
+func (source *MemorySource) FetchBody(ctx context.Context, uuid string, bodyid uint64) (SparseBody, error) {
+	source.mutex.RLock()
+	defer source.mutex.RUnlock()
+
+	sparse_body, found := source.bodies[uuid][bodyid]
+	if !found {
+		return SparseBody{}, fmt.Errorf("Body %d is not available at %s", bodyid, uuid)
+	}
+	return sparse_body, nil
+}
@@ -0,0 +1,143 @@
+package overlap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// sparsevolHeaderSize is the number of bytes before the spans in a DVID sparse volume
+	sparsevolHeaderSize = 12
+	// spanSize is the number of bytes for each span (3 coordinates and the run length)
+	spanSize = 16
+	// maxSpans is the largest number of spans accepted for a body
+	maxSpans = 1 << 28
+	// maxPreallocSpans limits the memory reserved before the spans are actually read
+	maxPreallocSpans = 1 << 22
+	// chunkSpans is the number of spans read from the response at a time
+	chunkSpans = 4096
+)
+
+// sparsevolError reports a truncated or malformed sparse volume from DVID
+type sparsevolError struct {
+	bodyID uint64
+	offset int64
+	msg    string
+}
+
+func (e *sparsevolError) Error() string {
+	return fmt.Sprintf("Sparse volume for body %d is malformed at byte %d: %s", e.bodyID, e.offset, e.msg)
+}
+
+// sparsevolHeader describes the encoding of a DVID sparse volume
+type sparsevolHeader struct {
+	// 0 indicates a binary sparse volume with no per-voxel payload
+	payload uint8
+	// number of coordinates for each span
+	numdims uint8
+	// dimension along which the spans run (0 = x, 1 = y, 2 = z)
+	rundim uint8
+	// number of spans that follow the header
+	numspans uint32
+}
+
+// decodeSparsevolHeader reads and checks the sparse volume header
+func decodeSparsevolHeader(reader io.Reader, bodyid uint64) (header sparsevolHeader, err error) {
+	var buf [sparsevolHeaderSize]byte
+	if n, err2 := io.ReadFull(reader, buf[:]); err2 != nil {
+		err = &sparsevolError{bodyid, int64(n), "header is truncated"}
+		return
+	}
+
+	// buf[3] is reserved and buf[4:8] is the voxel count (not set by DVID)
+	header.payload = buf[0]
+	header.numdims = buf[1]
+	header.rundim = buf[2]
+	header.numspans = binary.LittleEndian.Uint32(buf[8:12])
+
+	if header.payload != 0 {
+		err = &sparsevolError{bodyid, 0, fmt.Sprintf("payload descriptor %d is not a binary sparse volume", header.payload)}
+	} else if header.numdims != 3 {
+		err = &sparsevolError{bodyid, 1, fmt.Sprintf("%d dimensions are not supported", header.numdims)}
+	} else if header.rundim > 2 {
+		err = &sparsevolError{bodyid, 2, fmt.Sprintf("run dimension %d is not valid", header.rundim)}
+	} else if header.numspans > maxSpans {
+		err = &sparsevolError{bodyid, 8, fmt.Sprintf("%d spans exceeds the limit of %d", header.numspans, maxSpans)}
+	}
+	return
+}
+
+// decodeSparsevol reads a DVID sparse volume into the RLE of a body (runs along y or z are
+// converted to runs along x).  The spans are read in large chunks and decoded directly
+// rather than through binary.Read.
+func decodeSparsevol(reader io.Reader, bodyid uint64) (SparseBody, error) {
+	return decodeSparsevolLimit(reader, bodyid, maxSpans)
+}
+
+// decodeSparsevolLimit reads a DVID sparse volume that decodes to at most limit runs along x
+func decodeSparsevolLimit(reader io.Reader, bodyid uint64, limit int64) (sparse_body SparseBody, err error) {
+	header, err := decodeSparsevolHeader(reader, bodyid)
+	if err != nil {
+		return
+	}
+	if int64(header.numspans) > limit {
+		err = &sparsevolError{bodyid, 8, fmt.Sprintf("%d spans exceeds the limit of %d", header.numspans, limit)}
+		return
+	}
+
+	sparse_body.bodyID = bodyid
+	prealloc := header.numspans
+	if prealloc > maxPreallocSpans {
+		prealloc = maxPreallocSpans
+	}
+	sparse_body.rle = make([]sparseData, 0, prealloc)
+
+	chunk := make([]byte, chunkSpans*spanSize)
+	numspans := int64(header.numspans)
+	for iter := int64(0); iter < numspans; {
+		numchunk := numspans - iter
+		if numchunk > chunkSpans {
+			numchunk = chunkSpans
+		}
+		offset := sparsevolHeaderSize + iter*spanSize
+		buf := chunk[:numchunk*spanSize]
+		if n, err2 := io.ReadFull(reader, buf); err2 != nil {
+			err = &sparsevolError{bodyid, offset + int64(n), fmt.Sprintf("truncated after %d of %d spans", iter+int64(n)/spanSize, numspans)}
+			return
+		}
+
+		for pos := 0; pos < len(buf); pos += spanSize {
+			var coords [3]int32
+			coords[0] = int32(binary.LittleEndian.Uint32(buf[pos:]))
+			coords[1] = int32(binary.LittleEndian.Uint32(buf[pos+4:]))
+			coords[2] = int32(binary.LittleEndian.Uint32(buf[pos+8:]))
+			run := int32(binary.LittleEndian.Uint32(buf[pos+12:]))
+
+			if run <= 0 || int64(coords[header.rundim])+int64(run) > math.MaxInt32 {
+				err = &sparsevolError{bodyid, offset + int64(pos) + 12, fmt.Sprintf("run length %d is not valid", run)}
+				return
+			}
+
+			if header.rundim == 0 {
+				sparse_body.rle = append(sparse_body.rle, sparseData{coords[0], coords[1], coords[2], run})
+				continue
+			}
+
+			// every voxel of a run along y or z is a separate run along x
+			for step := int32(0); step < run; step += 1 {
+				if int64(len(sparse_body.rle)) >= limit {
+					err = &sparsevolError{bodyid, offset + int64(pos) + 12, fmt.Sprintf("spans exceed the limit of %d", limit)}
+					return
+				}
+				voxel := coords
+				voxel[header.rundim] += step
+				sparse_body.rle = append(sparse_body.rle, sparseData{voxel[0], voxel[1], voxel[2], 1})
+			}
+		}
+		iter += numchunk
+	}
+
+	return
+}
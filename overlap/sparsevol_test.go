@@ -0,0 +1,179 @@
+package overlap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// sparsevolData encodes spans of [x, y, z, length] as a DVID sparse volume with runs along rundim
+// (numspans is written to the header as given so that truncated volumes can be built)
+func sparsevolData(rundim byte, spans [][4]int32, numspans uint32) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 3, rundim, 0})
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+	binary.Write(&buf, binary.LittleEndian, numspans)
+	for _, span := range spans {
+		binary.Write(&buf, binary.LittleEndian, span)
+	}
+	return buf.Bytes()
+}
+
+// decodeSparsevolLoop is the span decoding that decodeSparsevol replaced (each field is read with
+// binary.Read), kept to check that both give the same body and to compare their speed
+func decodeSparsevolLoop(reader io.Reader, bodyid uint64) (SparseBody, error) {
+	header, err := decodeSparsevolHeader(reader, bodyid)
+	if err != nil {
+		return SparseBody{}, err
+	}
+
+	sparse_body := SparseBody{bodyID: bodyid}
+	for iter := uint32(0); iter < header.numspans; iter += 1 {
+		var coords [3]int32
+		var run int32
+		for i := range coords {
+			if err = binary.Read(reader, binary.LittleEndian, &coords[i]); err != nil {
+				return sparse_body, err
+			}
+		}
+		if err = binary.Read(reader, binary.LittleEndian, &run); err != nil {
+			return sparse_body, err
+		}
+		if header.rundim == 0 {
+			sparse_body.rle = append(sparse_body.rle, sparseData{coords[0], coords[1], coords[2], run})
+			continue
+		}
+		for step := int32(0); step < run; step += 1 {
+			voxel := coords
+			voxel[header.rundim] += step
+			sparse_body.rle = append(sparse_body.rle, sparseData{voxel[0], voxel[1], voxel[2], 1})
+		}
+	}
+	return sparse_body, nil
+}
+
+// randomSpans returns spans with random coordinates (including negative ones) and lengths
+func randomSpans(rng *rand.Rand, numspans int, maxlength int32) [][4]int32 {
+	spans := make([][4]int32, numspans)
+	for i := range spans {
+		spans[i] = [4]int32{rng.Int31n(20000) - 10000, rng.Int31n(20000) - 10000, rng.Int31n(20000) - 10000, rng.Int31n(maxlength) + 1}
+	}
+	return spans
+}
+
+func TestDecodeSparsevolMatchesLoop(t *testing.T) {
+	rng := rand.New(rand.NewSource(35))
+	// sizes below, at, and across the chunk boundary
+	for _, numspans := range []int{0, 1, chunkSpans - 1, chunkSpans, chunkSpans + 1, 3*chunkSpans + 17} {
+		for rundim := byte(0); rundim < 3; rundim += 1 {
+			data := sparsevolData(rundim, randomSpans(rng, numspans, 4), uint32(numspans))
+			expected, err := decodeSparsevolLoop(bytes.NewReader(data), 7)
+			if err != nil {
+				t.Fatalf("Loop decoding of %d spans failed: %v", numspans, err)
+			}
+			sparse_body, err := decodeSparsevol(bytes.NewReader(data), 7)
+			if err != nil {
+				t.Fatalf("Decoding of %d spans along %d failed: %v", numspans, rundim, err)
+			}
+			if sparse_body.bodyID != 7 || len(sparse_body.rle) != len(expected.rle) {
+				t.Fatalf("Decoding of %d spans along %d gave %d runs for body %d, expected %d", numspans, rundim, len(sparse_body.rle), sparse_body.bodyID, len(expected.rle))
+			}
+			if len(expected.rle) > 0 && !reflect.DeepEqual(sparse_body.rle, expected.rle) {
+				t.Fatalf("Decoding of %d spans along %d differs from the loop", numspans, rundim)
+			}
+		}
+	}
+}
+
+func TestDecodeSparsevolRunDimensions(t *testing.T) {
+	data := sparsevolData(1, [][4]int32{{1, 2, 3, 3}}, 1)
+	sparse_body, err := decodeSparsevol(bytes.NewReader(data), 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sparseData{{1, 2, 3, 1}, {1, 3, 3, 1}, {1, 4, 3, 1}}
+	if !reflect.DeepEqual(sparse_body.rle, expected) {
+		t.Errorf("Runs along y gave %v, expected %v", sparse_body.rle, expected)
+	}
+
+	data = sparsevolData(2, [][4]int32{{1, 2, 3, 2}}, 1)
+	sparse_body, err = decodeSparsevol(bytes.NewReader(data), 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []sparseData{{1, 2, 3, 1}, {1, 2, 4, 1}}
+	if !reflect.DeepEqual(sparse_body.rle, expected) {
+		t.Errorf("Runs along z gave %v, expected %v", sparse_body.rle, expected)
+	}
+}
+
+func TestDecodeSparsevolErrors(t *testing.T) {
+	spans := randomSpans(rand.New(rand.NewSource(1)), chunkSpans+2, 4)
+	data := sparsevolData(0, spans, uint32(len(spans)))
+	tests := []struct {
+		name string
+		data []byte
+		msg  string
+	}{
+		{"short header", data[:10], "Sparse volume for body 9 is malformed at byte 10: header is truncated"},
+		{"truncated span", data[:30], "Sparse volume for body 9 is malformed at byte 30: truncated after 1 of 4098 spans"},
+		{"truncated second chunk", data[:len(data)-20], "Sparse volume for body 9 is malformed at byte 65560: truncated after 4096 of 4098 spans"},
+		{"payload", append([]byte{1}, data[1:]...), "Sparse volume for body 9 is malformed at byte 0: payload descriptor 1 is not a binary sparse volume"},
+		{"dimensions", []byte{0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, "Sparse volume for body 9 is malformed at byte 1: 2 dimensions are not supported"},
+		{"run dimension", sparsevolData(3, nil, 0), "Sparse volume for body 9 is malformed at byte 2: run dimension 3 is not valid"},
+		{"span limit", sparsevolData(0, nil, maxSpans+1), "Sparse volume for body 9 is malformed at byte 8: 268435457 spans exceeds the limit of 268435456"},
+		{"run length", sparsevolData(0, [][4]int32{{0, 0, 0, 1}, {0, 0, 0, 0}}, 2), "Sparse volume for body 9 is malformed at byte 40: run length 0 is not valid"},
+	}
+	for _, test := range tests {
+		_, err := decodeSparsevol(bytes.NewReader(test.data), 9)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.msg)
+		}
+	}
+}
+
+func TestEncodeSparsevol(t *testing.T) {
+	spans := randomSpans(rand.New(rand.NewSource(2)), 100, 50)
+	expected, err := decodeSparsevol(bytes.NewReader(sparsevolData(0, spans, uint32(len(spans)))), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sparse_body, err := decodeSparsevol(bytes.NewReader(encodeSparsevol(expected)), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sparse_body, expected) {
+		t.Errorf("Encoded body does not decode to the original body")
+	}
+}
+
+// BenchmarkDecodeSparsevol compares the chunked decoding with the binary.Read loop on a body of 2M spans
+func BenchmarkDecodeSparsevol(b *testing.B) {
+	const numspans = 2000000
+	spans := make([][4]int32, numspans)
+	for i := range spans {
+		spans[i] = [4]int32{int32(i % 1000), int32(i / 1000 % 1000), int32(i / 1000000), 5}
+	}
+	data := sparsevolData(0, spans, numspans)
+
+	decoders := []struct {
+		name   string
+		decode func(io.Reader, uint64) (SparseBody, error)
+	}{
+		{"loop", decodeSparsevolLoop},
+		{"chunked", decodeSparsevol},
+	}
+	for _, decoder := range decoders {
+		b.Run(decoder.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := decoder.decode(bytes.NewReader(data), 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package overlap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// supervoxelMap maps each supervoxel to the body containing it
+type supervoxelMap map[uint64]uint64
+
+// resultsByLast enables sorting results by their last column
+type resultsByLast resultList
+
+func (slice resultsByLast) Len() int {
+	return len(slice)
+}
+
+func (slice resultsByLast) Less(i, j int) bool {
+	return slice[i][len(slice[i])-1] < slice[j][len(slice[j])-1]
+}
+
+func (slice resultsByLast) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// fetchSupervoxels retrieves the supervoxels of a body from a labelmap instance
+func fetchSupervoxels(ctx context.Context, baseurl string, bodyid uint64) ([]uint64, error) {
+	url := baseurl + "supervoxels/" + strconv.FormatUint(bodyid, 10)
+
+	var supervoxels []uint64
+	if err := dvid.getJSON(ctx, url, &supervoxels); err != nil {
+		return nil, fmt.Errorf("Supervoxels for body %d could not be read: %v", bodyid, err)
+	}
+	return supervoxels, nil
+}
+
+// expandSupervoxels replaces each body by its supervoxels (fetched concurrently like the bodies, and
+// bodies whose supervoxels cannot be read are reported as failures)
+func expandSupervoxels(ctx context.Context, baseurl string, bodyids []uint64) (supervoxelMap, []uint64, []bodyFailure) {
+	supervoxels := make([][]uint64, len(bodyids))
+	errs := make([]error, len(bodyids))
+	fetchConcurrently(len(bodyids), func(index int) {
+		supervoxels[index], errs[index] = fetchSupervoxels(ctx, baseurl, bodyids[index])
+	})
+
+	svmap := make(supervoxelMap)
+	var svids []uint64
+	var failures []bodyFailure
+	for index, bodyid := range bodyids {
+		if errs[index] != nil {
+			failures = append(failures, bodyFailure{bodyid, errs[index].Error()})
+			continue
+		}
+		for _, svid := range supervoxels[index] {
+			svmap[svid] = bodyid
+			svids = append(svids, svid)
+		}
+	}
+	return svmap, svids, failures
+}
+
+// overlapDetail lists the supervoxel contacts as [body 1, body 2, supervoxel 1, supervoxel 2, overlap]
+// (contacts between supervoxels of the same body are included)
+func (svmap supervoxelMap) overlapDetail(sv_overlap resultList) resultList {
+	detail_list := resultList{}
+	for _, row := range sv_overlap {
+		sv1, sv2 := row[0], row[1]
+		body1, body2 := svmap[sv1], svmap[sv2]
+		if body2 < body1 {
+			body1, body2 = body2, body1
+			sv1, sv2 = sv2, sv1
+		}
+		detail_list = append(detail_list, []uint64{body1, body2, sv1, sv2, row[2]})
+	}
+
+	sort.Sort(sort.Reverse(resultsByLast(detail_list)))
+	return detail_list
+}
+
+// aggregateOverlap sums the supervoxel contacts for each pair of bodies
+func (svmap supervoxelMap) aggregateOverlap(sv_overlap resultList) resultList {
+	body_pairs := make(map[bodyPair]uint64)
+	for _, row := range sv_overlap {
+		body1, body2 := svmap[row[0]], svmap[row[1]]
+		if body1 != body2 {
+			body_pairs[*newBodyPair(body1, body2)] += row[2]
+		}
+	}
+
+	overlap_list := resultList{}
+	for pair, val := range body_pairs {
+		overlap_list = append(overlap_list, []uint64{pair.body1, pair.body2, val})
+	}
+
+	sort.Sort(sort.Reverse(overlap_list))
+	return overlap_list
+}
+
+// statsDetail lists the supervoxel stats as [body, supervoxel, volume, surface area]
+func (svmap supervoxelMap) statsDetail(sv_stats resultList) resultList {
+	detail_list := resultList{}
+	for _, row := range sv_stats {
+		detail_list = append(detail_list, []uint64{svmap[row[0]], row[0], row[1], row[2]})
+	}
+
+	sort.Sort(sort.Reverse(resultsByLast(detail_list)))
+	return detail_list
+}
+
+// aggregateStats sums the supervoxel stats for each body (faces shared by supervoxels of the same
+// body are not part of the body surface)
+func (svmap supervoxelMap) aggregateStats(sv_stats resultList, sv_overlap resultList) resultList {
+	volumes := make(map[uint64]uint64)
+	areas := make(map[uint64]uint64)
+	var bodyids []uint64
+	for _, row := range sv_stats {
+		bodyid := svmap[row[0]]
+		if _, found := volumes[bodyid]; !found {
+			bodyids = append(bodyids, bodyid)
+		}
+		volumes[bodyid] += row[1]
+		areas[bodyid] += row[2]
+	}
+	for _, row := range sv_overlap {
+		body1, body2 := svmap[row[0]], svmap[row[1]]
+		if body1 == body2 {
+			areas[body1] -= 2 * row[2]
+		}
+	}
+
+	stats_list := resultList{}
+	for _, bodyid := range bodyids {
+		stats_list = append(stats_list, []uint64{bodyid, volumes[bodyid], areas[bodyid]})
+	}
+
+	sort.Sort(sort.Reverse(stats_list))
+	return stats_list
+}
@@ -0,0 +1,200 @@
+package overlap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// TIFF tags needed to read uncompressed label pages
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffStripByteCounts = 279
+	tiffTileWidth       = 322
+)
+
+// tiffPage locates the strips of one page (z-slice) of a TIFF stack
+type tiffPage struct {
+	offsets []uint32
+	counts  []uint32
+}
+
+// tiffVolume is a multi-page TIFF with one uncompressed single channel page per z-slice
+type tiffVolume struct {
+	filename string
+	size     [3]int
+	dtype    labelType
+	pages    []tiffPage
+}
+
+// openTIFF reads the directory of each page and checks that the pages can be read as labels
+func openTIFF(filename string) (*tiffVolume, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Label volume could not be read: %v", err)
+	}
+	defer file.Close()
+
+	var header [8]byte
+	if _, err = io.ReadFull(file, header[:]); err != nil {
+		return nil, fmt.Errorf("%s is not a TIFF file", filename)
+	}
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%s is not a TIFF file (BigTIFF is not supported)", filename)
+	}
+
+	volume := &tiffVolume{filename: filename}
+	bits := 0
+	for ifd := int64(order.Uint32(header[4:8])); ifd != 0; {
+		if len(volume.pages) >= 1<<20 {
+			return nil, fmt.Errorf("%s has too many pages", filename)
+		}
+		tags, next, err := readTIFFDirectory(file, order, ifd)
+		if err != nil {
+			return nil, fmt.Errorf("%s has an invalid page %d: %v", filename, len(volume.pages), err)
+		}
+		ifd = next
+
+		width, length := int(tiffValue(tags, tiffImageWidth)), int(tiffValue(tags, tiffImageLength))
+		pagebits := int(tiffValue(tags, tiffBitsPerSample))
+		switch {
+		case len(tags[tiffTileWidth]) > 0:
+			return nil, fmt.Errorf("%s has tiled pages which are not supported", filename)
+		case tiffValue(tags, tiffCompression) > 1:
+			return nil, fmt.Errorf("%s has compressed pages which are not supported", filename)
+		case tiffValue(tags, tiffSamplesPerPixel) > 1:
+			return nil, fmt.Errorf("%s has more than one sample per pixel", filename)
+		case len(tags[tiffStripOffsets]) == 0 || len(tags[tiffStripOffsets]) != len(tags[tiffStripByteCounts]):
+			return nil, fmt.Errorf("%s has a page without valid strips", filename)
+		}
+		if len(volume.pages) == 0 {
+			volume.size[0], volume.size[1], bits = width, length, pagebits
+		} else if width != volume.size[0] || length != volume.size[1] || pagebits != bits {
+			return nil, fmt.Errorf("%s has pages of different sizes or types", filename)
+		}
+		volume.pages = append(volume.pages, tiffPage{tags[tiffStripOffsets], tags[tiffStripByteCounts]})
+	}
+	if len(volume.pages) == 0 {
+		return nil, fmt.Errorf("%s has no pages", filename)
+	}
+	volume.size[2] = len(volume.pages)
+
+	if bits%8 != 0 {
+		return nil, fmt.Errorf("%s has %d bits per sample which is not supported", filename, bits)
+	}
+	volume.dtype, err = getLabelType(fmt.Sprintf("uint%d", bits), order)
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// readTIFFDirectory reads the short and long valued tags of an image file directory
+func readTIFFDirectory(file io.ReaderAt, order binary.ByteOrder, offset int64) (map[uint16][]uint32, int64, error) {
+	var countbuf [2]byte
+	if _, err := file.ReadAt(countbuf[:], offset); err != nil {
+		return nil, 0, err
+	}
+	numentries := int(order.Uint16(countbuf[:]))
+	buf := make([]byte, numentries*12+4)
+	if _, err := file.ReadAt(buf, offset+2); err != nil {
+		return nil, 0, err
+	}
+
+	tags := make(map[uint16][]uint32)
+	for entry := 0; entry < numentries; entry += 1 {
+		field := buf[entry*12 : entry*12+12]
+		tag, fieldtype, count := order.Uint16(field[0:2]), order.Uint16(field[2:4]), order.Uint32(field[4:8])
+
+		// only SHORT (3) and LONG (4) values are needed
+		size := uint32(2)
+		if fieldtype == 4 {
+			size = 4
+		} else if fieldtype != 3 {
+			continue
+		}
+		if count > 1<<24 {
+			return nil, 0, fmt.Errorf("tag %d has %d values", tag, count)
+		}
+
+		data := field[8:12]
+		if count*size > 4 {
+			data = make([]byte, count*size)
+			if _, err := file.ReadAt(data, int64(order.Uint32(field[8:12]))); err != nil {
+				return nil, 0, err
+			}
+		}
+		values := make([]uint32, count)
+		for i := range values {
+			if size == 2 {
+				values[i] = uint32(order.Uint16(data[i*2:]))
+			} else {
+				values[i] = order.Uint32(data[i*4:])
+			}
+		}
+		tags[tag] = values
+	}
+
+	next := int64(order.Uint32(buf[numentries*12:]))
+	return tags, next, nil
+}
+
+// tiffValue returns the first value of a tag (0 if missing)
+func tiffValue(tags map[uint16][]uint32, tag uint16) uint32 {
+	if len(tags[tag]) == 0 {
+		return 0
+	}
+	return tags[tag][0]
+}
+
+func (volume *tiffVolume) dims() [3]int {
+	return volume.size
+}
+
+func (volume *tiffVolume) scan(ctx context.Context, visit func(z int32, labels []uint64) error) error {
+	file, err := os.Open(volume.filename)
+	if err != nil {
+		return fmt.Errorf("Label volume could not be read: %v", err)
+	}
+	defer file.Close()
+
+	slicelen := volume.size[0] * volume.size[1]
+	buf := make([]byte, slicelen*volume.dtype.size)
+	labels := make([]uint64, slicelen)
+	for z, page := range volume.pages {
+		// the strips hold consecutive rows of the page
+		pos := 0
+		for strip, offset := range page.offsets {
+			count := int(page.counts[strip])
+			if count > len(buf)-pos {
+				count = len(buf) - pos
+			}
+			if _, err = file.ReadAt(buf[pos:pos+count], int64(offset)); err != nil {
+				return fmt.Errorf("Label volume %s is truncated at page %d", volume.filename, z)
+			}
+			pos += count
+		}
+		if pos < len(buf) {
+			return fmt.Errorf("Label volume %s has incomplete strips at page %d", volume.filename, z)
+		}
+
+		volume.dtype.decode(buf, labels)
+		if err = visit(int32(z), labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
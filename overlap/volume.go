@@ -0,0 +1,232 @@
+package overlap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// labelType describes how the labels of a volume are stored
+type labelType struct {
+	// bytes per label (1, 2, 4, or 8)
+	size  int
+	order binary.ByteOrder
+}
+
+// getLabelType converts a type name (e.g., "uint64") to the label type
+func getLabelType(typename string, order binary.ByteOrder) (labelType, error) {
+	switch typename {
+	case "uint8", "int8":
+		return labelType{1, order}, nil
+	case "uint16", "int16":
+		return labelType{2, order}, nil
+	case "uint32", "int32":
+		return labelType{4, order}, nil
+	case "uint64", "int64":
+		return labelType{8, order}, nil
+	}
+	return labelType{}, fmt.Errorf("Label type %s is not supported", typename)
+}
+
+// decode converts the stored labels to uint64
+func (dtype labelType) decode(buf []byte, labels []uint64) {
+	for i := range labels {
+		pos := i * dtype.size
+		switch dtype.size {
+		case 1:
+			labels[i] = uint64(buf[pos])
+		case 2:
+			labels[i] = uint64(dtype.order.Uint16(buf[pos:]))
+		case 4:
+			labels[i] = uint64(dtype.order.Uint32(buf[pos:]))
+		case 8:
+			labels[i] = dtype.order.Uint64(buf[pos:])
+		}
+	}
+}
+
+// labelVolume is a dense label volume that is read one z-slice at a time
+type labelVolume interface {
+	// dims returns the size of the volume (x, y, z)
+	dims() [3]int
+	// scan calls visit for each z-slice in order with the labels of the slice (x varies fastest)
+	scan(ctx context.Context, visit func(z int32, labels []uint64) error) error
+}
+
+// batchSource is implemented by sources that read many bodies at once more efficiently than one at a time
+type batchSource interface {
+	// fetchBodies returns the result for each body in the order requested
+	fetchBodies(ctx context.Context, uuid string, bodyids []uint64) []fetchResult
+}
+
+// VolumeSource converts the requested labels of a dense label volume (local files or a neuroglancer
+// precomputed segmentation) into bodies (the volume is the same for every uuid)
+type VolumeSource struct {
+	volume labelVolume
+	// coordinate of the first voxel of the volume
+	offset [3]int32
+	// size of a voxel in full resolution voxels along each axis (0 is treated as 1)
+	factor int32
+}
+
+// scaledSource is implemented by sources whose bodies are below full resolution
+type scaledSource interface {
+	// resolution returns the resolution of the bodies (the results are rescaled to full resolution units)
+	resolution() bodyResolution
+}
+
+// resolution returns the resolution of the volume
+func (source *VolumeSource) resolution() bodyResolution {
+	res := fullResolution
+	if source.factor > 1 {
+		res.factor = source.factor
+	}
+	return res
+}
+
+// NewVolumeSource opens a label volume file: .npy, multi-page .tif/.tiff, N5 (directory with attributes.json),
+// zarr (directory with .zarray), or otherwise raw little-endian labels of the given type and dims (x, y, z)
+func NewVolumeSource(path string, dims [3]int, typename string) (*VolumeSource, error) {
+	var volume labelVolume
+	var err error
+
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case ext == ".npy":
+		volume, err = openNPY(path)
+	case ext == ".tif" || ext == ".tiff":
+		volume, err = openTIFF(path)
+	case fileExists(filepath.Join(path, "attributes.json")):
+		volume, err = openN5(path)
+	case fileExists(filepath.Join(path, ".zarray")):
+		volume, err = openZarr(path)
+	default:
+		volume, err = openRaw(path, dims, typename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeSource{volume: volume}, nil
+}
+
+// fileExists checks whether a regular file exists at the path
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// FetchBody reads the body from the volume
+func (source *VolumeSource) FetchBody(ctx context.Context, uuid string, bodyid uint64) (SparseBody, error) {
+	result := source.fetchBodies(ctx, uuid, []uint64{bodyid})[0]
+	return result.sparse_body, result.err
+}
+
+// fetchBodies reads all of the bodies in a single pass through the volume (each row of each slice is
+// run length encoded and only the runs of the requested labels are kept)
+func (source *VolumeSource) fetchBodies(ctx context.Context, uuid string, bodyids []uint64) []fetchResult {
+	results := make([]fetchResult, len(bodyids))
+	indices := make(map[uint64]int)
+	for index, bodyid := range bodyids {
+		indices[bodyid] = index
+		results[index].sparse_body.bodyID = bodyid
+	}
+
+	width := source.volume.dims()[0]
+	err := source.volume.scan(ctx, func(z int32, labels []uint64) error {
+		for y := 0; y*width < len(labels); y += 1 {
+			row := labels[y*width : (y+1)*width]
+			for x := 0; x < width; {
+				label := row[x]
+				start := x
+				for x < width && row[x] == label {
+					x += 1
+				}
+				if index, found := indices[label]; found {
+					results[index].sparse_body.rle = append(results[index].sparse_body.rle, sparseData{int32(start) + source.offset[0], int32(y) + source.offset[1], z + source.offset[2], int32(x - start)})
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("Request deadline exceeded reading the label volume")
+		}
+		return nil
+	})
+
+	for index := range results {
+		if err != nil {
+			results[index] = fetchResult{err: err}
+		} else if len(results[index].sparse_body.rle) == 0 {
+			results[index].err = fmt.Errorf("Body %d is not in the label volume", bodyids[index])
+		}
+	}
+	return results
+}
+
+// rawVolume is a file of labels with x varying fastest (also used for the data of .npy files)
+type rawVolume struct {
+	filename string
+	// byte offset of the labels in the file
+	offset int64
+	size   [3]int
+	dtype  labelType
+}
+
+// openRaw opens a raw label file and checks its size against the dims
+func openRaw(filename string, dims [3]int, typename string) (*rawVolume, error) {
+	dtype, err := getLabelType(typename, binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	if dims[0] <= 0 || dims[1] <= 0 || dims[2] <= 0 {
+		return nil, fmt.Errorf("Dims must be given for raw label volume %s", filename)
+	}
+	return newRawVolume(filename, 0, dims, dtype)
+}
+
+// newRawVolume checks that the file holds the labels for the dims after the offset
+func newRawVolume(filename string, offset int64, dims [3]int, dtype labelType) (*rawVolume, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Label volume could not be read: %v", err)
+	}
+	expected := offset + int64(dims[0])*int64(dims[1])*int64(dims[2])*int64(dtype.size)
+	if info.Size() < expected {
+		return nil, fmt.Errorf("Label volume %s has %d bytes but %d are needed for %dx%dx%d labels", filename, info.Size(), expected, dims[0], dims[1], dims[2])
+	}
+	return &rawVolume{filename, offset, dims, dtype}, nil
+}
+
+func (volume *rawVolume) dims() [3]int {
+	return volume.size
+}
+
+func (volume *rawVolume) scan(ctx context.Context, visit func(z int32, labels []uint64) error) error {
+	file, err := os.Open(volume.filename)
+	if err != nil {
+		return fmt.Errorf("Label volume could not be read: %v", err)
+	}
+	defer file.Close()
+	if _, err = file.Seek(volume.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("Label volume could not be read: %v", err)
+	}
+
+	reader := bufio.NewReaderSize(file, 1<<20)
+	slicelen := volume.size[0] * volume.size[1]
+	buf := make([]byte, slicelen*volume.dtype.size)
+	labels := make([]uint64, slicelen)
+	for z := 0; z < volume.size[2]; z += 1 {
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			return fmt.Errorf("Label volume %s is truncated at slice %d", volume.filename, z)
+		}
+		volume.dtype.decode(buf, labels)
+		if err = visit(int32(z), labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package overlap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// randomLabels returns labels 0-3 for the dims (x, y, z) with x varying fastest
+func randomLabels(dims [3]int, seed int64) []uint64 {
+	r := rand.New(rand.NewSource(seed))
+	labels := make([]uint64, dims[0]*dims[1]*dims[2])
+	for i := range labels {
+		labels[i] = uint64(r.Intn(4))
+	}
+	return labels
+}
+
+// labelRuns run length encodes each row of the labels and returns the runs of each label at the offset
+func labelRuns(labels []uint64, dims [3]int, offset [3]int) map[uint64][]sparseData {
+	runs := make(map[uint64][]sparseData)
+	for z := 0; z < dims[2]; z += 1 {
+		for y := 0; y < dims[1]; y += 1 {
+			row := labels[(z*dims[1]+y)*dims[0] : (z*dims[1]+y+1)*dims[0]]
+			for x := 0; x < dims[0]; {
+				start := x
+				for x < dims[0] && row[x] == row[start] {
+					x += 1
+				}
+				runs[row[start]] = append(runs[row[start]], sparseData{int32(start + offset[0]), int32(y + offset[1]), int32(z + offset[2]), int32(x - start)})
+			}
+		}
+	}
+	return runs
+}
+
+// encodeLabels writes the labels as 4 or 8 byte words in the byte order
+func encodeLabels(labels []uint64, size int, order binary.ByteOrder) []byte {
+	data := make([]byte, len(labels)*size)
+	for i, label := range labels {
+		if size == 4 {
+			order.PutUint32(data[i*4:], uint32(label))
+		} else {
+			order.PutUint64(data[i*8:], label)
+		}
+	}
+	return data
+}
+
+// checkVolumeBodies fails the test if the bodies read from the source do not match the runs of the labels
+// (bodies that are not in the labels must fail)
+func checkVolumeBodies(t *testing.T, name string, source *VolumeSource, labels []uint64, dims [3]int, offset [3]int, bodyids []uint64) {
+	t.Helper()
+	runs := labelRuns(labels, dims, offset)
+	results := source.fetchBodies(context.Background(), "", bodyids)
+	for index, bodyid := range bodyids {
+		if runs[bodyid] == nil {
+			if results[index].err == nil {
+				t.Fatalf("%s: body %d is not in the volume but was read", name, bodyid)
+			}
+			continue
+		}
+		if results[index].err != nil {
+			t.Fatalf("%s: body %d could not be read: %v", name, bodyid, results[index].err)
+		}
+		if !reflect.DeepEqual(results[index].sparse_body.rle, runs[bodyid]) {
+			t.Fatalf("%s: body %d is %v instead of %v", name, bodyid, results[index].sparse_body.rle, runs[bodyid])
+		}
+	}
+}
+
+// writeNPY writes the labels as a version 1 .npy file of C order uint64 labels
+func writeNPY(t *testing.T, filename string, labels []uint64, dims [3]int) {
+	header := fmt.Sprintf("{'descr': '<u8', 'fortran_order': False, 'shape': (%d, %d, %d), }", dims[2], dims[1], dims[0])
+	for (10+len(header)+1)%64 != 0 {
+		header += " "
+	}
+	header += "\n"
+	var data bytes.Buffer
+	data.WriteString(npyMagic + "\x01\x00")
+	binary.Write(&data, binary.LittleEndian, uint16(len(header)))
+	data.WriteString(header)
+	data.Write(encodeLabels(labels, 8, binary.LittleEndian))
+	if err := os.WriteFile(filename, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTIFF writes the labels as a big-endian multi-page TIFF of uint32 labels with two strips per page
+func writeTIFF(t *testing.T, filename string, labels []uint64, dims [3]int) {
+	var data bytes.Buffer
+	data.WriteString("MM\x00*")
+	binary.Write(&data, binary.BigEndian, uint32(8))
+
+	// tag writes a directory entry (short values are left justified in the value field)
+	tag := func(id, typ uint16, count, value uint32) {
+		binary.Write(&data, binary.BigEndian, []uint16{id, typ})
+		binary.Write(&data, binary.BigEndian, count)
+		if typ == 3 && count == 1 {
+			binary.Write(&data, binary.BigEndian, []uint16{uint16(value), 0})
+		} else {
+			binary.Write(&data, binary.BigEndian, value)
+		}
+	}
+
+	pagesize := dims[0] * dims[1]
+	for z := 0; z < dims[2]; z += 1 {
+		page := encodeLabels(labels[z*pagesize:(z+1)*pagesize], 4, binary.BigEndian)
+		pixels := data.Len() + 2 + 7*12 + 4
+		strips := pixels + len(page)
+		firststrip := (dims[1] / 2) * dims[0] * 4
+		next := uint32(strips + 16)
+		if z == dims[2]-1 {
+			next = 0
+		}
+
+		binary.Write(&data, binary.BigEndian, uint16(7))
+		tag(256, 3, 1, uint32(dims[0]))
+		tag(257, 4, 1, uint32(dims[1]))
+		tag(258, 3, 1, 32)
+		tag(259, 3, 1, 1)
+		tag(273, 4, 2, uint32(strips))
+		tag(277, 3, 1, 1)
+		tag(279, 4, 2, uint32(strips+8))
+		binary.Write(&data, binary.BigEndian, next)
+		data.Write(page)
+		binary.Write(&data, binary.BigEndian, []uint32{uint32(pixels), uint32(pixels + firststrip)})
+		binary.Write(&data, binary.BigEndian, []uint32{uint32(firststrip), uint32(len(page) - firststrip)})
+	}
+	if err := os.WriteFile(filename, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeChunks writes the labels as a gzip N5 dataset with truncated edge blocks and as a zlib zarr array with
+// padded edge chunks (both are chunked 5x4x3 and the chunk at 1,1,1 is missing)
+func writeChunks(n5path, zarrpath string, labels []uint64, dims [3]int) {
+	os.MkdirAll(n5path, 0755)
+	os.MkdirAll(zarrpath, 0755)
+	os.WriteFile(filepath.Join(n5path, "attributes.json"), []byte(fmt.Sprintf(`{"dimensions":[%d,%d,%d],"blockSize":[5,4,3],"dataType":"uint64","compression":{"type":"gzip"}}`, dims[0], dims[1], dims[2])), 0644)
+	os.WriteFile(filepath.Join(zarrpath, ".zarray"), []byte(fmt.Sprintf(`{"shape":[%d,%d,%d],"chunks":[3,4,5],"dtype":"<u8","order":"C","fill_value":0,"compressor":{"id":"zlib"},"zarr_format":2}`, dims[2], dims[1], dims[0])), 0644)
+
+	chunk := [3]int{5, 4, 3}
+	for cz := 0; cz*chunk[2] < dims[2]; cz += 1 {
+		for cy := 0; cy*chunk[1] < dims[1]; cy += 1 {
+			for cx := 0; cx*chunk[0] < dims[0]; cx += 1 {
+				if cx == 1 && cy == 1 && cz == 1 {
+					continue
+				}
+				var block, padded []uint64
+				for z := 0; z < chunk[2]; z += 1 {
+					for y := 0; y < chunk[1]; y += 1 {
+						for x := 0; x < chunk[0]; x += 1 {
+							var label uint64
+							gx, gy, gz := cx*chunk[0]+x, cy*chunk[1]+y, cz*chunk[2]+z
+							if gx < dims[0] && gy < dims[1] && gz < dims[2] {
+								label = labels[(gz*dims[1]+gy)*dims[0]+gx]
+								block = append(block, label)
+							}
+							padded = append(padded, label)
+						}
+					}
+				}
+
+				var n5block bytes.Buffer
+				binary.Write(&n5block, binary.BigEndian, []uint16{0, 3})
+				var blocksize [3]uint32
+				for i, c := range []int{cx, cy, cz} {
+					blocksize[i] = uint32(chunk[i])
+					if (c+1)*chunk[i] > dims[i] {
+						blocksize[i] = uint32(dims[i] - c*chunk[i])
+					}
+				}
+				binary.Write(&n5block, binary.BigEndian, blocksize)
+				gw := gzip.NewWriter(&n5block)
+				gw.Write(encodeLabels(block, 8, binary.BigEndian))
+				gw.Close()
+				blockdir := filepath.Join(n5path, fmt.Sprint(cx), fmt.Sprint(cy))
+				os.MkdirAll(blockdir, 0755)
+				os.WriteFile(filepath.Join(blockdir, fmt.Sprint(cz)), n5block.Bytes(), 0644)
+
+				var zarrchunk bytes.Buffer
+				zw := zlib.NewWriter(&zarrchunk)
+				zw.Write(encodeLabels(padded, 8, binary.LittleEndian))
+				zw.Close()
+				os.WriteFile(filepath.Join(zarrpath, fmt.Sprintf("%d.%d.%d", cz, cy, cx)), zarrchunk.Bytes(), 0644)
+			}
+		}
+	}
+}
+
+func TestVolumeSource(t *testing.T) {
+	dims := [3]int{13, 9, 7}
+	labels := randomLabels(dims, 1)
+	labels[5] = 1 << 40
+	bodyids := []uint64{1, 2, 3, 1 << 40, 99}
+	dir := t.TempDir()
+
+	// raw and .npy files hold the labels as they are
+	os.WriteFile(filepath.Join(dir, "labels.raw"), encodeLabels(labels, 8, binary.LittleEndian), 0644)
+	writeNPY(t, filepath.Join(dir, "labels.npy"), labels, dims)
+	for _, filename := range []string{"labels.raw", "labels.npy"} {
+		source, err := NewVolumeSource(filepath.Join(dir, filename), dims, "uint64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkVolumeBodies(t, filename, source, labels, dims, [3]int{}, bodyids)
+	}
+
+	// TIFF labels are at most 32 bits
+	labels32 := append([]uint64{}, labels...)
+	labels32[5] = 7
+	writeTIFF(t, filepath.Join(dir, "labels.tif"), labels32, dims)
+	source, err := NewVolumeSource(filepath.Join(dir, "labels.tif"), [3]int{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVolumeBodies(t, "labels.tif", source, labels32, dims, [3]int{}, append(bodyids, 7))
+
+	// missing chunks are background
+	chunked := append([]uint64{}, labels...)
+	for z := 3; z < 6; z += 1 {
+		for y := 4; y < 8; y += 1 {
+			for x := 5; x < 10; x += 1 {
+				chunked[(z*dims[1]+y)*dims[0]+x] = 0
+			}
+		}
+	}
+	writeChunks(filepath.Join(dir, "labels.n5"), filepath.Join(dir, "labels.zarr"), labels, dims)
+	for _, path := range []string{"labels.n5", "labels.zarr"} {
+		source, err := NewVolumeSource(filepath.Join(dir, path), [3]int{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkVolumeBodies(t, path, source, chunked, dims, [3]int{}, bodyids)
+	}
+}
+
+func TestInvalidVolume(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "labels.raw")
+	os.WriteFile(filename, make([]byte, 100), 0644)
+	if _, err := NewVolumeSource(filename, [3]int{4, 4, 1}, "uint64"); err == nil {
+		t.Fatalf("Raw file that is too small for the dims was opened")
+	}
+	if _, err := NewVolumeSource(filename, [3]int{}, "uint8"); err == nil {
+		t.Fatalf("Raw file without dims was opened")
+	}
+	if _, err := NewVolumeSource(filename, [3]int{5, 5, 1}, "float32"); err == nil {
+		t.Fatalf("Raw file of float labels was opened")
+	}
+	os.WriteFile(filepath.Join(dir, "labels.npy"), []byte("not a numpy file"), 0644)
+	if _, err := NewVolumeSource(filepath.Join(dir, "labels.npy"), [3]int{}, ""); err == nil {
+		t.Fatalf("Invalid .npy file was opened")
+	}
+
+	// chunks with an unsupported compression are rejected before they are read
+	os.MkdirAll(filepath.Join(dir, "blosc.n5"), 0755)
+	os.WriteFile(filepath.Join(dir, "blosc.n5", "attributes.json"), []byte(`{"dimensions":[4,4,4],"blockSize":[2,2,2],"dataType":"uint64","compression":{"type":"blosc"}}`), 0644)
+	os.MkdirAll(filepath.Join(dir, "blosc.zarr"), 0755)
+	os.WriteFile(filepath.Join(dir, "blosc.zarr", ".zarray"), []byte(`{"shape":[4,4,4],"chunks":[2,2,2],"dtype":"<u8","order":"C","fill_value":0,"compressor":{"id":"blosc"},"zarr_format":2}`), 0644)
+	for _, path := range []string{"blosc.n5", "blosc.zarr"} {
+		if _, err := NewVolumeSource(filepath.Join(dir, path), [3]int{}, ""); err == nil {
+			t.Fatalf("%s with blosc chunks was opened", path)
+		}
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"github.com/janelia-flyem/overlapservice/overlap"
-	"github.com/janelia-flyem/serviceproxy/register"
 	"os"
+	"strings"
 )
 
 const defaultPort = 25123
@@ -14,6 +14,37 @@ var (
 	proxy    = flag.String("proxy", "", "")
 	registry = flag.String("registry", "", "")
 	portNum  = flag.Int("port", defaultPort, "")
+	instance = flag.String("instance", overlap.DefaultLabelInstance, "")
+	fetchers = flag.Int("fetchers", overlap.DefaultFetchParallelism, "")
+	timeout  = flag.Duration("dvid-timeout", overlap.DefaultDVIDTimeout, "")
+	retries  = flag.Int("dvid-retries", overlap.DefaultDVIDRetries, "")
+	deadline = flag.Duration("deadline", overlap.DefaultRequestDeadline, "")
+	srcdir   = flag.String("source-dir", "", "")
+	volume   = flag.String("volume", "", "")
+	voldims  = flag.String("volume-dims", "", "")
+	voltype  = flag.String("volume-type", "uint64", "")
+	precomp  = flag.String("precomputed", "", "")
+	pcscale  = flag.Int("precomputed-scale", 0, "")
+	cachemax = flag.Int("cache-spans", overlap.DefaultCacheSpans, "")
+	diskfile = flag.String("disk-cache", "", "")
+	cacheres = flag.Bool("cache-results", false, "")
+	admauth  = flag.String("admin-auth", os.Getenv("ADMIN_AUTHORIZATION"), "")
+	mutpoll  = flag.Duration("mutation-poll", overlap.DefaultMutationPoll, "")
+	mutauth  = flag.String("mutation-auth", os.Getenv("MUTATION_AUTHORIZATION"), "")
+	cabundle = flag.String("dvid-ca", "", "")
+	dvidauth = flag.String("dvid-auth", os.Getenv("DVID_AUTHORIZATION"), "")
+	fwdauth  = flag.Bool("forward-auth", false, "")
+	allowed  = flag.String("dvid-allow", "", "")
+	backends = flag.String("backends", "", "")
+	dvidaddr = flag.String("dvid-location", "", "")
+	srvdns   = flag.String("srv-domain", "", "")
+	discfile = flag.String("discovery-file", "", "")
+	discttl  = flag.Duration("discovery-ttl", overlap.DefaultDiscoveryTTL, "")
+	jobwork  = flag.Int("job-workers", overlap.DefaultJobWorkers, "")
+	jobqueue = flag.Int("job-queue", overlap.DefaultJobQueue, "")
+	jobdline = flag.Duration("job-deadline", 0, "")
+	jobstore = flag.String("job-store", "", "")
+	jobexp   = flag.Duration("job-expiry", overlap.DefaultJobExpiry, "")
 	showHelp = flag.Bool("help", false, "")
 )
 
@@ -24,6 +55,37 @@ Usage: adderexample
       -proxy    (string)        Server and port number for proxy address of serviceproxy
       -registry (string)        Server and port number for registry address of serviceproxy
       -port     (number)        Port for HTTP server
+      -instance (string)        Default DVID label instance for sparse volumes (default "sp2body")
+      -fetchers (number)        Maximum number of bodies fetched from DVID at once per request (default 8)
+      -dvid-timeout (duration)  Time allowed for each request to DVID (default 2m)
+      -dvid-retries (number)    Retries for DVID requests failing with connection errors or 5xx (default 3, 0 for none)
+      -deadline (duration)      Time allowed for all DVID requests of a service call (default 10m)
+      -source-dir (string)      Directory of sparse volumes (<uuid>/<body>.sparsevol) used instead of DVID
+      -volume (string)          Label volume (raw, .npy, .tif, N5, or zarr) used instead of DVID
+      -volume-dims (string)     Size of a raw label volume as X,Y,Z
+      -volume-type (string)     Label type of a raw label volume (default "uint64")
+      -precomputed (string)     Neuroglancer precomputed segmentation (directory or file:// URL) used instead of DVID
+      -precomputed-scale (number) Scale of the precomputed segmentation (default 0)
+      -cache-spans (number)     Spans kept in the cache of bodies fetched from DVID (default 16777216, -1 to disable)
+      -disk-cache (string)      Database file keeping bodies from locked DVID nodes across restarts
+      -cache-results (flag)     Also keep overlap and stats results for locked nodes in the disk cache
+      -admin-auth (string)      Authorization header required to purge the disk cache (default $ADMIN_AUTHORIZATION)
+      -mutation-poll (duration) Interval between polls for mutations of cached unlocked nodes (default 30s, -1s to disable)
+      -mutation-auth (string)   Authorization header required to push mutations (default $MUTATION_AUTHORIZATION)
+      -dvid-ca (string)         PEM file of certificate authorities trusted for https DVID servers
+      -dvid-auth (string)       Authorization header sent to DVID (default $DVID_AUTHORIZATION)
+      -forward-auth (flag)      Send the caller's Authorization header to DVID
+      -dvid-allow (string)      Comma-separated DVID servers (host:port or URL) and aliases (NAME=URL) requests may use (* for any)
+      -backends (string)        JSON file of named DVID backends with replicas and the uuid prefixes routed to them
+      -dvid-location (string)   DVID server used when a request names no server or backend (instead of the proxy)
+      -srv-domain (string)      Domain whose SRV record _dvid._tcp locates DVID (instead of the proxy)
+      -discovery-file (string)  JSON file of service addresses that locates DVID and registers the service
+      -discovery-ttl (duration) Time a discovered DVID location is reused (default 30s, -1s to disable)
+      -job-workers (number)     Asynchronous jobs run at once (default 2)
+      -job-queue (number)       Asynchronous jobs that can wait to run (default 100)
+      -job-deadline (duration)  Time allowed for all DVID requests of an asynchronous job (default none)
+      -job-store (string)       Database file keeping jobs and their results across restarts
+      -job-expiry (duration)    Time finished jobs and their results are kept (default 24h, -1s to keep them)
   -h, -help     (flag)          Show help message
 `
 
@@ -36,11 +98,83 @@ func main() {
 		os.Exit(0)
 	}
 
+	var source overlap.BodySource
+	if *volume != "" {
+		var dims [3]int
+		if *voldims != "" {
+			if _, err := fmt.Sscanf(*voldims, "%d,%d,%d", &dims[0], &dims[1], &dims[2]); err != nil {
+				fmt.Printf("Volume dims must be given as X,Y,Z\n")
+				os.Exit(1)
+			}
+		}
+		volsource, err := overlap.NewVolumeSource(*volume, dims, *voltype)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		source = volsource
+	} else if *precomp != "" {
+		pcsource, err := overlap.NewPrecomputedSource(*precomp, *pcscale)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		source = pcsource
+	}
+
+	var dvidservers []string
+	if *allowed != "" {
+		dvidservers = strings.Split(*allowed, ",")
+	}
+
+	// the service registers with (and deregisters from) the discovery when it starts (and stops), or with
+	// the serviceproxy registry if given
+	var discovery, registration overlap.Discovery
+	if *dvidaddr != "" {
+		discovery = overlap.NewStaticDiscovery(map[string]string{"dvid": *dvidaddr})
+	} else if *srvdns != "" {
+		discovery = overlap.NewSRVDiscovery(*srvdns)
+	} else if *discfile != "" {
+		discovery = overlap.NewFileDiscovery(*discfile)
+	} else if *proxy != "" || *registry != "" {
+		discovery = overlap.NewProxyDiscovery(*proxy, *registry)
+	}
 	if *registry != "" {
-		// creates adder service and points to first argument
-		serfagent := register.NewAgent("calcoverlap", *portNum)
-		serfagent.RegisterService(*registry)
+		registration = overlap.NewProxyDiscovery(*proxy, *registry)
 	}
 
-	overlap.Serve(*proxy, *portNum)
+	err := overlap.Serve(overlap.Config{
+		ProxyServer:           *proxy,
+		Discovery:             discovery,
+		Registration:          registration,
+		DiscoveryTTL:          *discttl,
+		JobWorkers:            *jobwork,
+		JobQueue:              *jobqueue,
+		JobDeadline:           *jobdline,
+		JobStore:              *jobstore,
+		JobExpiry:             *jobexp,
+		Port:                  *portNum,
+		LabelInstance:         *instance,
+		FetchParallelism:      *fetchers,
+		DVIDTimeout:           *timeout,
+		DVIDRetries:           retries,
+		RequestDeadline:       *deadline,
+		SourceDir:             *srcdir,
+		Source:                source,
+		CacheSpans:            *cachemax,
+		DiskCache:             *diskfile,
+		CacheResults:          *cacheres,
+		AdminAuthorization:    *admauth,
+		MutationPoll:          *mutpoll,
+		MutationAuthorization: *mutauth,
+		DVIDCABundle:          *cabundle,
+		DVIDAuthorization:     *dvidauth,
+		ForwardAuthorization:  *fwdauth,
+		DVIDServers:           dvidservers,
+		Backends:              *backends,
+	})
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
 }